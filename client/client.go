@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/jiangz222/go-nat-discovery/nats"
 )
@@ -17,12 +18,51 @@ func check(err error) {
 	}
 }
 
+// readResult loads a DiscoverResult written with -json.
+func readResult(path string) *nats.DiscoverResult {
+	data, err := os.ReadFile(path)
+	check(err)
+	res := &nats.DiscoverResult{}
+	check(json.Unmarshal(data, res))
+	return res
+}
+
+// predict implements "client predict a.json b.json".
+func predict(args []string) {
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: client predict resultA.json resultB.json")
+		os.Exit(2)
+	}
+	c, err := nats.PredictConnectivity(readResult(args[0]), readResult(args[1]))
+	check(err)
+	fmt.Printf("Strategy: %s\nRationale: %s\n", c.Strategy, c.Rationale)
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "predict" {
+		predict(os.Args[2:])
+		return
+	}
+
 	server := flag.String("H", "stun.sipgate.net", "STUN server address.")
 	port := flag.String("P", "3478", "STUN server port.")
 	mappingAddr := flag.String("m", "", "STUN local addr used for mapping behavior discovery. ip or ip:port")
 	filteringAddr := flag.String("f", "", "STUN local addr used for filtering behavior discovery. ip or ip:port")
 	verbose := flag.Bool("v", false, "Verbose")
+	jsonOut := flag.Bool("json", false, "print the full result as JSON, e.g. as input for \"client predict\"")
+	username := flag.String("u", "", "STUN username, enables MESSAGE-INTEGRITY")
+	password := flag.String("p", "", "STUN password")
+	longTerm := flag.Bool("long-term", false, "use long-term credentials (REALM/NONCE challenge)")
+	useSHA256 := flag.Bool("sha256", false, "use MESSAGE-INTEGRITY-SHA256")
+	turnServer := flag.String("turn", "", "TURN server host:port, also checks whether data can be relayed through it")
+	turnUser := flag.String("turn-user", "", "TURN username")
+	turnPass := flag.String("turn-pass", "", "TURN password")
+	turnRealm := flag.String("turn-realm", "", "TURN realm, learnt from the server if empty")
+	punch := flag.String("punch", "", "meet the peer using the same session ID at the server and try a UDP hole punch; use a random ID of 16+ characters unless authenticating")
+	punchTimeout := flag.Duration("punch-timeout", 10*time.Second, "how long to wait for the peer and the punch")
+	maxRedirects := flag.Int("max-redirects", 0, "follow up to this many server redirects (300 Try Alternate), 0 for 3, -1 to not follow them")
+	hairpin := flag.Bool("hairpin", false, "also test whether the NAT loops back datagrams sent to its external address")
+	mtu := flag.Int("mtu", 0, "probe the largest request/response size up to this many bytes using PADDING, 0 to skip")
 
 	flag.Parse()
 	if !strings.Contains(*mappingAddr, ":") {
@@ -36,16 +76,60 @@ func main() {
 		Verbose:        *verbose,
 		MappingLocal:   *mappingAddr,
 		FilteringLocal: *filteringAddr,
+		Username:       *username,
+		Password:       *password,
+		LongTermAuth:   *longTerm,
+		UseSHA256:      *useSHA256,
+		TURNServer:     *turnServer,
+		TURNUsername:   *turnUser,
+		TURNPassword:   *turnPass,
+		TURNRealm:      *turnRealm,
+		MaxRedirects:   *maxRedirects,
+		Hairpinning:    *hairpin,
 	})
 	check(err)
 
+	if *mtu > 0 {
+		mtuRes, err := n.ProbeMTU(0, *mtu)
+		check(err)
+		fmt.Printf("Max STUN Message Size: %d\n", mtuRes.MaxSize)
+		return
+	}
+
+	if *punch != "" {
+		punchRes, err := n.HolePunch(*punch, *punchTimeout)
+		check(err)
+		fmt.Printf("Peer Address: %s\nDirect Path: %v\n", punchRes.PeerAddress, punchRes.Established)
+		if punchRes.Established {
+			fmt.Printf("Remote Address: %s\nElapsed: %s\n", punchRes.RemoteAddress, punchRes.Elapsed)
+		}
+		return
+	}
+
 	res, err := n.Discover()
 	check(err)
 
-	_, err = json.MarshalIndent(res, "", "  ")
+	bytes, err := json.MarshalIndent(res, "", "  ")
 	check(err)
+	if *jsonOut {
+		fmt.Println(string(bytes))
+		return
+	}
 
 	// change output as https://github.com/jtriley/pystun
 	fmt.Printf("NAT Type: %s\nExternal IP: %s\nExternal Port: %s\n", res.NATType, res.ExternalIP, res.ExternalPort)
-	//fmt.Println(string(bytes))
+	if res.Server != "" {
+		fmt.Printf("Redirected To: %s\n", res.Server)
+	}
+	if res.TURN != nil {
+		fmt.Printf("TURN Allocated: %v\n", res.TURN.Allocated)
+		if res.TURN.Allocated {
+			fmt.Printf("TURN Relayed Address: %s\n", res.TURN.RelayedAddress)
+		}
+		if res.TURN.Error != "" {
+			fmt.Printf("TURN Error: %s\n", res.TURN.Error)
+		} else {
+			fmt.Printf("TURN Round Trip: %s\n", res.TURN.RoundTrip)
+		}
+	}
 }
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+	"github.com/jiangz222/go-nat-discovery/nats"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the nat_discover configuration. Each field is read from the
+// config file (JSON, YAML or TOML), then from the environment variable
+// NAT_DISCOVER_<NAME> and then from the flag -<name>, each source
+// overriding the previous one. NAME is the json name in upper snake case,
+// e.g. NAT_DISCOVER_PRIMARY_ADDR for primaryAddr. Maps and lists are given
+// as JSON in environment variables and flags.
+type Config struct {
+	MaxProcs int `json:"max_procs"`
+	// Workers read each listening address, with SO_REUSEPORT on Linux
+	Workers int `json:"workers"`
+	// BatchSize datagrams are read and written per system call on Linux
+	BatchSize     int    `json:"batchSize"`
+	PrimaryAddr   string `json:"primaryAddr"`
+	SecondaryAddr string `json:"secondaryAddr"`
+	Pri2SecAddr   string `json:"pri2SecAddr"`
+	Role          string `json:"role"`
+	DebugLevel    int    `json:"debug_level"`
+	// AuthFile enables authentication with "username:password" lines
+	AuthFile     string `json:"authFile"`
+	AuthRealm    string `json:"authRealm"`
+	AuthLongTerm bool   `json:"authLongTerm"`
+	// TurnPort enables the embedded TURN relay on the primary IP
+	TurnPort         int               `json:"turnPort"`
+	TurnRealm        string            `json:"turnRealm"`
+	TurnUsers        map[string]string `json:"turnUsers"`
+	TurnSecret       string            `json:"turnSecret"`
+	TurnRelayAddr    string            `json:"turnRelayAddr"`
+	TurnRelayMinPort int               `json:"turnRelayMinPort"`
+	TurnRelayMaxPort int               `json:"turnRelayMaxPort"`
+	// Rendezvous enables the hole-punching rendezvous service
+	Rendezvous bool `json:"rendezvous"`
+	// Topology lists the listening endpoints explicitly, replacing the
+	// ones derived from primaryAddr and secondaryAddr
+	Topology []nats.Endpoint `json:"topology"`
+	// AccessLog enables the JSON lines access log at this path
+	AccessLog           string  `json:"accessLog"`
+	AccessLogSampleRate float64 `json:"accessLogSampleRate"`
+	AccessLogAnonymize  string  `json:"accessLogAnonymize"`
+	AccessLogMaxSize    int64   `json:"accessLogMaxSize"`
+	AccessLogMaxBackups int     `json:"accessLogMaxBackups"`
+	// Software is sent in responses, ResponseProfile selects their
+	// attributes
+	Software        string `json:"software"`
+	ResponseProfile string `json:"responseProfile"`
+	// HealthAddr enables the self-test and serves its results at /health
+	HealthAddr string `json:"healthAddr"`
+	// SelfTestInterval is in seconds, 30 by default
+	SelfTestInterval int    `json:"selfTestInterval"`
+	SelfTestUser     string `json:"selfTestUser"`
+	SelfTestPassword string `json:"selfTestPassword"`
+	// Secondaries replaces pri2SecAddr of a primary with a pool it fails
+	// over between; heartbeatInterval is in seconds, 5 by default
+	Secondaries       []nats.Secondary `json:"secondaries"`
+	HeartbeatInterval int              `json:"heartbeatInterval"`
+	// Alternates enables redirecting clients to other servers, beyond
+	// redirectMaxRate tests per second or past this server's
+	// redirectLocalWeight
+	Alternates          []nats.Alternate `json:"alternates"`
+	RedirectMaxRate     int              `json:"redirectMaxRate"`
+	RedirectLocalWeight int              `json:"redirectLocalWeight"`
+}
+
+const envPrefix = "NAT_DISCOVER_"
+
+// flagAliases are the short flags of the former flag-only server.
+var flagAliases = map[string]string{
+	"p":   "primaryAddr",
+	"s":   "secondaryAddr",
+	"p2s": "pri2SecAddr",
+	"r":   "role",
+}
+
+// options are the command line settings that are not part of Config.
+type options struct {
+	path        string
+	watch       time.Duration
+	printConfig bool
+
+	explicitPath bool       // -f was given
+	overrides    []override // the flags overriding Config fields, in order
+}
+
+// override is a flag setting the Config field of json name to value.
+type override struct {
+	name  string
+	value string
+}
+
+type configField struct {
+	name  string // json name
+	value reflect.Value
+}
+
+// fields returns the settable fields of c by json name.
+func (c *Config) fields() []configField {
+	var fields []configField
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0]
+		fields = append(fields, configField{name: name, value: v.Field(i)})
+	}
+	return fields
+}
+
+// set parses s into the field: strings are taken as is, anything else is
+// JSON.
+func (f configField) set(s string) error {
+	if f.value.Kind() == reflect.String {
+		f.value.SetString(s)
+		return nil
+	}
+	ptr := reflect.New(f.value.Type())
+	if err := json.Unmarshal([]byte(s), ptr.Interface()); err != nil {
+		return fmt.Errorf("%s: %s", f.name, err.Error())
+	}
+	f.value.Set(ptr.Elem())
+	return nil
+}
+
+// envName maps a json name to its environment variable.
+func envName(name string) string {
+	var b strings.Builder
+	b.WriteString(envPrefix)
+	for i, r := range name {
+		if unicode.IsUpper(r) && i > 0 {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// loadConfig builds the configuration from the file, the environment (read
+// with getenv) and the command line args, and validates it.
+func loadConfig(args []string, getenv func(string) string) (*Config, *options, error) {
+	opts, err := parseArgs(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg, err := opts.load(getenv)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cfg, opts, nil
+}
+
+// parseArgs parses the command line args once; load applies them to the
+// config file every time it is read.
+func parseArgs(args []string) (*options, error) {
+	opts := &options{}
+	fs := flag.NewFlagSet("nat_discover", flag.ContinueOnError)
+	fs.StringVar(&opts.path, "f", "nat_discovery.conf", "config file path, .json (or any other extension), .yaml, .yml or .toml")
+	fs.DurationVar(&opts.watch, "watch", 2*time.Second, "config file poll interval, 0 to only reload on SIGHUP")
+	fs.BoolVar(&opts.printConfig, "print-config", false, "print the effective configuration and exit")
+
+	for _, f := range (&Config{}).fields() {
+		name := f.name
+		fs.Func(name, "overrides "+name+", also "+envName(name), func(s string) error {
+			opts.overrides = append(opts.overrides, override{name, s})
+			return nil
+		})
+	}
+	for alias, name := range flagAliases {
+		name := name
+		fs.Func(alias, "alias of -"+name, func(s string) error {
+			opts.overrides = append(opts.overrides, override{name, s})
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		opts.explicitPath = opts.explicitPath || f.Name == "f"
+	})
+	return opts, nil
+}
+
+// load reads the config file, applies the environment (read with getenv)
+// and the command line overrides over it, and validates the result.
+func (o *options) load(getenv func(string) string) (*Config, error) {
+	cfg := &Config{Role: "both"}
+	fields := cfg.fields()
+	if err := loadFile(o.path, cfg); err != nil {
+		if o.explicitPath || !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	byName := map[string]configField{}
+	for _, f := range fields {
+		byName[f.name] = f
+		if s := getenv(envName(f.name)); s != "" {
+			if err := f.set(s); err != nil {
+				return nil, fmt.Errorf("%s: %s", envName(f.name), err.Error())
+			}
+		}
+	}
+	for _, o := range o.overrides {
+		if err := byName[o.name].set(o.value); err != nil {
+			return nil, fmt.Errorf("-%s", err.Error())
+		}
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadFile decodes the config file at path into cfg by its extension, JSON
+// unless it is .yaml, .yml or .toml. Unknown fields are errors.
+func loadFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var generic interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &generic)
+	case ".toml":
+		var m map[string]interface{}
+		_, err = toml.Decode(string(data), &m)
+		generic = m
+	default:
+		generic = json.RawMessage(data)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err.Error())
+	}
+	// YAML and TOML go through JSON so that one set of names applies
+	if data, err = json.Marshal(generic); err != nil {
+		return fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(cfg); err != nil {
+		return fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return nil
+}
+
+// configErrors lists every invalid field, one per line.
+type configErrors []string
+
+func (e configErrors) Error() string {
+	return strings.Join(e, "\n")
+}
+
+// checkAddr returns why addr is not host:port (or a bare host if
+// portOptional), "" if it is valid.
+func checkAddr(addr string, portOptional bool) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		if portOptional && !strings.Contains(addr, ":") {
+			return ""
+		}
+		return "want host:port"
+	}
+	if host == "" && !portOptional {
+		return "missing host"
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 0xFFFF {
+		return "invalid port " + port
+	}
+	return ""
+}
+
+func (c *Config) validate() error {
+	var errs configErrors
+	fail := func(field, format string, a ...interface{}) {
+		errs = append(errs, field+": "+fmt.Sprintf(format, a...))
+	}
+
+	if c.MaxProcs < 0 {
+		fail("max_procs", "must not be negative")
+	}
+	if c.Workers < 0 {
+		fail("workers", "must not be negative")
+	}
+	if c.BatchSize < 0 {
+		fail("batchSize", "must not be negative")
+	}
+	if c.DebugLevel < 0 || c.DebugLevel > 2 {
+		fail("debug_level", "must be 0 (info), 1 (debug) or 2 (trace)")
+	}
+	if c.Role != "both" && c.Role != "pri" && c.Role != "sec" {
+		fail("role", "must be both, pri or sec, got %q", c.Role)
+	}
+	pooled := c.Role == "pri" && len(c.Secondaries) > 0
+	if c.Pri2SecAddr == "" && (c.Role == "pri" && !pooled || c.Role == "sec") {
+		fail("pri2SecAddr", "required when role is %s", c.Role)
+	} else if c.Pri2SecAddr != "" {
+		if why := checkAddr(c.Pri2SecAddr, false); why != "" {
+			fail("pri2SecAddr", "%s", why)
+		}
+	}
+
+	if len(c.Topology) == 0 {
+		for _, f := range []struct{ name, addr string }{
+			{"primaryAddr", c.PrimaryAddr},
+			{"secondaryAddr", c.SecondaryAddr},
+		} {
+			if f.addr == "" {
+				fail(f.name, "required unless topology is set")
+			} else if why := checkAddr(f.addr, true); why != "" {
+				fail(f.name, "%s", why)
+			}
+		}
+	}
+	names := map[string]bool{}
+	for _, e := range c.Topology {
+		name := e.Name
+		if name == "" {
+			name = e.Address
+		}
+		names[name] = true
+	}
+	for i, e := range c.Topology {
+		field := fmt.Sprintf("topology[%d]", i)
+		if why := checkAddr(e.Address, false); why != "" {
+			fail(field+".address", "%s", why)
+		}
+		if e.Host != "" && e.Host != "pri" && e.Host != "sec" {
+			fail(field+".host", "must be pri or sec, got %q", e.Host)
+		}
+		for _, p := range []struct{ name, partner string }{
+			{"changeIP", e.ChangeIP},
+			{"changePort", e.ChangePort},
+			{"changeBoth", e.ChangeBoth},
+		} {
+			if p.partner != "" && !names[p.partner] {
+				fail(field+"."+p.name, "unknown endpoint %q", p.partner)
+			}
+		}
+	}
+
+	if c.AuthLongTerm && c.AuthRealm == "" {
+		fail("authRealm", "required when authLongTerm is set")
+	}
+	if (c.AuthLongTerm || c.AuthRealm != "") && c.AuthFile == "" {
+		fail("authFile", "required to enable authentication")
+	}
+
+	if c.TurnPort < 0 || c.TurnPort > 0xFFFF {
+		fail("turnPort", "invalid port %d", c.TurnPort)
+	}
+	if c.TurnPort != 0 {
+		if c.TurnRealm == "" {
+			fail("turnRealm", "required when turnPort is set")
+		}
+		if len(c.TurnUsers) == 0 && c.TurnSecret == "" {
+			fail("turnUsers", "turnUsers or turnSecret required when turnPort is set")
+		}
+		if c.TurnRelayAddr != "" && net.ParseIP(c.TurnRelayAddr) == nil {
+			fail("turnRelayAddr", "invalid IP %q", c.TurnRelayAddr)
+		}
+		if c.TurnRelayMinPort < 0 || c.TurnRelayMinPort > 0xFFFF {
+			fail("turnRelayMinPort", "invalid port %d", c.TurnRelayMinPort)
+		}
+		if c.TurnRelayMaxPort < 0 || c.TurnRelayMaxPort > 0xFFFF {
+			fail("turnRelayMaxPort", "invalid port %d", c.TurnRelayMaxPort)
+		}
+		if c.TurnRelayMaxPort != 0 && c.TurnRelayMinPort > c.TurnRelayMaxPort {
+			fail("turnRelayMinPort", "above turnRelayMaxPort")
+		}
+	}
+
+	if c.AccessLogSampleRate < 0 || c.AccessLogSampleRate > 1 {
+		fail("accessLogSampleRate", "must be between 0 and 1")
+	}
+	switch nats.AnonymizeMode(c.AccessLogAnonymize) {
+	case nats.AnonymizeNone, nats.AnonymizeTruncate, nats.AnonymizeHash:
+	default:
+		fail("accessLogAnonymize", "must be truncate or hash, got %q", c.AccessLogAnonymize)
+	}
+	if c.AccessLogMaxSize < 0 {
+		fail("accessLogMaxSize", "must not be negative")
+	}
+	if c.AccessLogMaxBackups < 0 {
+		fail("accessLogMaxBackups", "must not be negative")
+	}
+
+	switch nats.ResponseProfile(c.ResponseProfile) {
+	case nats.ProfileDefault, nats.ProfileRFC3489, nats.ProfileRFC5389, nats.ProfileRFC5780, nats.ProfileMinimal:
+	default:
+		fail("responseProfile", "must be rfc3489, rfc5389, rfc5780 or minimal, got %q", c.ResponseProfile)
+	}
+
+	if c.HealthAddr != "" {
+		if _, _, err := net.SplitHostPort(c.HealthAddr); err != nil {
+			fail("healthAddr", "want host:port")
+		}
+		if c.Role == "sec" {
+			fail("healthAddr", "the self-test runs on the primary")
+		}
+	}
+	if len(c.Secondaries) > 0 && c.Role != "pri" {
+		fail("secondaries", "only a primary (role pri) has secondaries")
+	}
+	for i, sec := range c.Secondaries {
+		if why := checkAddr(sec.Host, false); why != "" {
+			fail(fmt.Sprintf("secondaries[%d].host", i), "%s", why)
+		}
+		if net.ParseIP(sec.IP) == nil {
+			fail(fmt.Sprintf("secondaries[%d].ip", i), "invalid IP %q", sec.IP)
+		}
+	}
+	if c.HeartbeatInterval < 0 {
+		fail("heartbeatInterval", "must not be negative")
+	}
+	weights := 0
+	for i, a := range c.Alternates {
+		if why := checkAddr(a.Address, false); why != "" {
+			fail(fmt.Sprintf("alternates[%d].address", i), "%s", why)
+		}
+		if a.Weight < 0 {
+			fail(fmt.Sprintf("alternates[%d].weight", i), "must not be negative")
+		}
+		weights += a.Weight
+		for _, prefix := range a.Prefixes {
+			if _, _, err := net.ParseCIDR(prefix); err != nil {
+				fail(fmt.Sprintf("alternates[%d].prefixes", i), "invalid prefix %q", prefix)
+			}
+		}
+	}
+	if c.RedirectMaxRate < 0 {
+		fail("redirectMaxRate", "must not be negative")
+	}
+	if c.RedirectLocalWeight < 0 {
+		fail("redirectLocalWeight", "must not be negative")
+	}
+	if weights == 0 && (c.RedirectMaxRate > 0 || c.RedirectLocalWeight > 0) {
+		fail("alternates", "an alternate needs a weight when redirectMaxRate or redirectLocalWeight is set")
+	}
+	if c.SelfTestInterval < 0 {
+		fail("selfTestInterval", "must not be negative")
+	}
+	if c.AuthFile != "" && c.HealthAddr != "" && c.SelfTestUser == "" {
+		fail("selfTestUser", "required when authFile and healthAddr are set")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// printable returns c with its secrets masked, for -print-config.
+func (c *Config) printable() *Config {
+	p := *c
+	if p.TurnSecret != "" {
+		p.TurnSecret = "***"
+	}
+	if p.SelfTestPassword != "" {
+		p.SelfTestPassword = "***"
+	}
+	if len(p.TurnUsers) > 0 {
+		p.TurnUsers = map[string]string{}
+		for user := range c.TurnUsers {
+			p.TurnUsers[user] = "***"
+		}
+	}
+	return &p
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jiangz222/go-nat-discovery/nats"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func noEnv(string) string { return "" }
+
+func TestLoadConfigFormats(t *testing.T) {
+	want := &Config{
+		PrimaryAddr:   "1.2.3.4:3478",
+		SecondaryAddr: "1.2.3.5:3479",
+		Role:          "both",
+		TurnPort:      3480,
+		TurnRealm:     "example.org",
+		TurnUsers:     map[string]string{"alice": "secret"},
+	}
+	for _, file := range []struct{ name, content string }{
+		{"a.conf", `{"primaryAddr": "1.2.3.4:3478", "secondaryAddr": "1.2.3.5:3479",
+			"turnPort": 3480, "turnRealm": "example.org", "turnUsers": {"alice": "secret"}}`},
+		{"a.yaml", "primaryAddr: 1.2.3.4:3478\nsecondaryAddr: 1.2.3.5:3479\n" +
+			"turnPort: 3480\nturnRealm: example.org\nturnUsers:\n  alice: secret\n"},
+		{"a.toml", "primaryAddr = \"1.2.3.4:3478\"\nsecondaryAddr = \"1.2.3.5:3479\"\n" +
+			"turnPort = 3480\nturnRealm = \"example.org\"\n[turnUsers]\nalice = \"secret\"\n"},
+	} {
+		cfg, _, err := loadConfig([]string{"-f", writeFile(t, file.name, file.content)}, noEnv)
+		if assert.NoError(t, err, "should succeed: %s", file.name) {
+			assert.Equal(t, want, cfg, "should match: %s", file.name)
+		}
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeFile(t, "a.yaml", "primaryAddr: 1.2.3.4:3478\nsecondaryAddr: 1.2.3.5:3479\nrole: pri\npri2SecAddr: 10.0.0.1:8080\n")
+	env := map[string]string{
+		"NAT_DISCOVER_PRI2_SEC_ADDR": "10.0.0.2:8080",
+		"NAT_DISCOVER_DEBUG_LEVEL":   "1",
+		"NAT_DISCOVER_TOPOLOGY":      `[{"address": "1.2.3.4:3478"}]`,
+	}
+
+	cfg, opts, err := loadConfig([]string{"-f", path, "-watch", "0", "-debug_level", "2", "-r", "both"},
+		func(name string) string { return env[name] })
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	assert.Equal(t, "1.2.3.4:3478", cfg.PrimaryAddr, "should come from the file")
+	assert.Equal(t, "10.0.0.2:8080", cfg.Pri2SecAddr, "env should override the file")
+	assert.Equal(t, 2, cfg.DebugLevel, "flag should override env")
+	assert.Equal(t, "both", cfg.Role, "alias should override the file")
+	assert.Equal(t, []nats.Endpoint{{Address: "1.2.3.4:3478"}}, cfg.Topology, "should decode JSON from env")
+	assert.Zero(t, opts.watch, "should match")
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	_, _, err := loadConfig([]string{"-f", filepath.Join(t.TempDir(), "missing.conf")}, noEnv)
+	assert.Error(t, err, "should fail on an explicit missing file")
+
+	_, _, err = loadConfig([]string{"-f", writeFile(t, "a.json", `{"primaryAdr": "1.2.3.4"}`)}, noEnv)
+	assert.Error(t, err, "should fail on an unknown field")
+
+	_, _, err = loadConfig([]string{"-f", writeFile(t, "a.json", `{}`), "-turnPort", "x"}, noEnv)
+	assert.Error(t, err, "should fail on a bad flag value")
+
+	_, _, err = loadConfig([]string{"-f", writeFile(t, "a.json", `{
+		"role": "pri", "debug_level": 3, "turnPort": 3480, "healthAddr": "8080",
+		"responseProfile": "rfc1234",
+		"topology": [{"address": "1.2.3.4", "changeIP": "b"}]}`)}, noEnv)
+	if assert.Error(t, err, "should fail") {
+		assert.Equal(t, configErrors{
+			"debug_level: must be 0 (info), 1 (debug) or 2 (trace)",
+			"pri2SecAddr: required when role is pri",
+			"topology[0].address: want host:port",
+			`topology[0].changeIP: unknown endpoint "b"`,
+			"turnRealm: required when turnPort is set",
+			"turnUsers: turnUsers or turnSecret required when turnPort is set",
+			`responseProfile: must be rfc3489, rfc5389, rfc5780 or minimal, got "rfc1234"`,
+			"healthAddr: want host:port",
+		}, err, "should list every invalid field")
+	}
+
+	_, _, err = loadConfig([]string{"-f", writeFile(t, "a.json", `{
+		"role": "pri", "primaryAddr": "1.2.3.4:3478", "secondaryAddr": "1.2.3.5:3479",
+		"secondaries": [{"host": "10.0.0.2:8080", "ip": "1.2.3.5"}, {"host": "10.0.0.3", "ip": "x"}]}`)}, noEnv)
+	if assert.Error(t, err, "should fail") {
+		assert.Equal(t, configErrors{
+			"secondaries[1].host: want host:port",
+			`secondaries[1].ip: invalid IP "x"`,
+		}, err, "should not require pri2SecAddr with secondaries")
+	}
+
+	_, _, err = loadConfig([]string{"-f", writeFile(t, "a.json", `{
+		"role": "both", "primaryAddr": "1.2.3.4:3478", "secondaryAddr": "1.2.3.5:3479",
+		"secondaries": [{"host": "10.0.0.2:8080", "ip": "1.2.3.5"}]}`)}, noEnv)
+	if assert.Error(t, err, "should fail") {
+		assert.Equal(t, configErrors{
+			"secondaries: only a primary (role pri) has secondaries",
+		}, err, "should reject secondaries of another role")
+	}
+
+	_, _, err = loadConfig([]string{"-f", writeFile(t, "a.json", `{
+		"role": "both", "primaryAddr": "1.2.3.4:3478", "secondaryAddr": "1.2.3.5:3479", "redirectMaxRate": 100,
+		"alternates": [{"address": "10.0.0.2:3478", "prefixes": ["10.0.0.0/8"]}, {"address": "10.0.0.3", "prefixes": ["x"]}]}`)}, noEnv)
+	if assert.Error(t, err, "should fail") {
+		assert.Equal(t, configErrors{
+			"alternates[1].address: want host:port",
+			`alternates[1].prefixes: invalid prefix "x"`,
+			"alternates: an alternate needs a weight when redirectMaxRate or redirectLocalWeight is set",
+		}, err, "should check the redirect policy")
+	}
+}
+
+func TestConfigPrintable(t *testing.T) {
+	cfg := &Config{TurnSecret: "s", TurnUsers: map[string]string{"alice": "secret"}, SelfTestPassword: "p"}
+	p := cfg.printable()
+	assert.Equal(t, "***", p.TurnSecret, "should mask")
+	assert.Equal(t, "***", p.SelfTestPassword, "should mask")
+	assert.Equal(t, map[string]string{"alice": "***"}, p.TurnUsers, "should mask")
+	assert.Equal(t, "secret", cfg.TurnUsers["alice"], "should not change the config")
+}
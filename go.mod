@@ -1,12 +1,31 @@
 module github.com/jiangz222/go-nat-discovery
 
-
-go 1.12
+go 1.18
 
 require (
+	github.com/BurntSushi/toml v1.3.2
 	github.com/pion/logging v0.2.2
-	github.com/pion/stun v0.3.3
+	github.com/pion/stun v0.6.1
 	github.com/pion/transport v0.8.8
 	github.com/pion/turn v1.3.7
-	github.com/stretchr/testify v1.4.0
+	github.com/pion/turn/v2 v2.1.3
+	github.com/stretchr/testify v1.8.4
+	go.opentelemetry.io/otel v1.11.2
+	go.opentelemetry.io/otel/sdk v1.11.2
+	go.opentelemetry.io/otel/trace v1.11.2
+	golang.org/x/net v0.9.0
+	golang.org/x/sys v0.9.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/go-logr/logr v1.2.3 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/pion/dtls/v2 v2.2.7 // indirect
+	github.com/pion/randutil v0.1.0 // indirect
+	github.com/pion/transport/v2 v2.2.1 // indirect
+	github.com/pkg/errors v0.8.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/crypto v0.8.0 // indirect
 )
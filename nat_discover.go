@@ -4,94 +4,220 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/jiangz222/go-nat-discovery/nats"
 	"github.com/pion/logging"
 )
 
-type Config struct {
-	MaxProcs      int    `json:"max_procs"`
-	PrimaryAddr   string `json:"primaryAddr"`
-	SecondaryAddr string `json:"secondaryAddr"`
-	Pri2SecAddr   string `json:"pri2SecAddr"`
-	Role          string `json:"role"`
-	DebugLevel    int    `json:"debug_level"`
-}
+// serverConfig maps cfg to the server configuration.
+func serverConfig(cfg *Config) *nats.STUNServerConfig {
+	level := logging.LogLevelInfo
+	switch cfg.DebugLevel {
+	case 1:
+		level = logging.LogLevelDebug
+	case 2:
+		level = logging.LogLevelTrace
+	}
 
-var (
-	cfgPath = flag.String("f", "nat_discovery.conf", "config file path")
-)
+	var auth *nats.AuthConfig
+	if cfg.AuthFile != "" {
+		auth = &nats.AuthConfig{
+			LongTerm:        cfg.AuthLongTerm,
+			Realm:           cfg.AuthRealm,
+			CredentialsFile: cfg.AuthFile,
+		}
+	}
 
-func init() {
-	flag.Parse()
-}
+	var turn *nats.TURNConfig
+	if cfg.TurnPort != 0 {
+		turn = &nats.TURNConfig{
+			Port:         cfg.TurnPort,
+			Realm:        cfg.TurnRealm,
+			Users:        cfg.TurnUsers,
+			SharedSecret: cfg.TurnSecret,
+			RelayAddress: cfg.TurnRelayAddr,
+			RelayMinPort: cfg.TurnRelayMinPort,
+			RelayMaxPort: cfg.TurnRelayMaxPort,
+		}
+	}
 
-func parseConfig() *Config {
-	data, err := os.ReadFile(*cfgPath)
-	if err != nil {
-		fmt.Println("read config file failed:", err)
-		return nil
+	var rendezvous *nats.RendezvousConfig
+	if cfg.Rendezvous {
+		rendezvous = &nats.RendezvousConfig{}
 	}
 
-	cfg := &Config{}
-	err = json.Unmarshal(data, &cfg)
-	if err != nil {
-		fmt.Println("unmarshal config failed:", err)
-		return nil
+	var accessLog *nats.AccessLogConfig
+	if cfg.AccessLog != "" {
+		accessLog = &nats.AccessLogConfig{
+			Path:       cfg.AccessLog,
+			SampleRate: cfg.AccessLogSampleRate,
+			Anonymize:  nats.AnonymizeMode(cfg.AccessLogAnonymize),
+			MaxSize:    cfg.AccessLogMaxSize,
+			MaxBackups: cfg.AccessLogMaxBackups,
+		}
+	}
+
+	var selfTest *nats.SelfTestConfig
+	if cfg.HealthAddr != "" {
+		selfTest = &nats.SelfTestConfig{
+			Interval:     time.Duration(cfg.SelfTestInterval) * time.Second,
+			Username:     cfg.SelfTestUser,
+			Password:     cfg.SelfTestPassword,
+			LongTermAuth: cfg.AuthLongTerm,
+		}
+	}
+
+	var pool *nats.SecondaryPoolConfig
+	if len(cfg.Secondaries) > 0 {
+		pool = &nats.SecondaryPoolConfig{
+			Secondaries: cfg.Secondaries,
+			Interval:    time.Duration(cfg.HeartbeatInterval) * time.Second,
+		}
+	}
+
+	var redirect *nats.RedirectConfig
+	if len(cfg.Alternates) > 0 {
+		redirect = &nats.RedirectConfig{
+			Alternates:  cfg.Alternates,
+			MaxRate:     cfg.RedirectMaxRate,
+			LocalWeight: cfg.RedirectLocalWeight,
+		}
 	}
 
-	if cfg.Role != "both" && cfg.Role != "pri" && cfg.Role != "sec" {
-		fmt.Println("wrong role, only support: both 、 pri 、 sec")
-		return nil
+	return &nats.STUNServerConfig{
+		PrimaryAddress:   cfg.PrimaryAddr,
+		SecondaryAddress: cfg.SecondaryAddr,
+		Role:             cfg.Role,
+		Pri2SecHost:      cfg.Pri2SecAddr,
+		LogLevel:         level,
+		Auth:             auth,
+		TURN:             turn,
+		Rendezvous:       rendezvous,
+		Topology:         cfg.Topology,
+		AccessLog:        accessLog,
+		Workers:          cfg.Workers,
+		BatchSize:        cfg.BatchSize,
+		Software:         cfg.Software,
+		ResponseProfile:  nats.ResponseProfile(cfg.ResponseProfile),
+		SelfTest:         selfTest,
+		SecondaryPool:    pool,
+		Redirect:         redirect,
 	}
+}
 
-	if cfg.Role == "pri" && cfg.Pri2SecAddr == "" {
-		fmt.Println("need pri2SecAddr when current role is pri")
-		return nil
+// reloadLoop reloads the configuration on SIGHUP, or when the config
+// file's modification time changes, and applies it to s, logging through
+// the server's logger. The command line in opts is parsed once, at start;
+// maxProcs is the running GOMAXPROCS setting, which needs a restart. A bad
+// config keeps the running one.
+func reloadLoop(s *nats.STUNServer, opts *options, maxProcs int) {
+	log := s.Logger()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	var modTime time.Time
+	if opts.watch > 0 {
+		if info, err := os.Stat(opts.path); err == nil {
+			modTime = info.ModTime()
+		}
+		ticker := time.NewTicker(opts.watch)
+		defer ticker.Stop()
+		tick = ticker.C
 	}
 
-	if cfg.PrimaryAddr == "" || cfg.SecondaryAddr == "" {
-		fmt.Println("need primary addr and secondary addr")
-		return nil
+	for {
+		select {
+		case <-hup:
+			log.Infof("SIGHUP, reloading %s", opts.path)
+		case <-tick:
+			info, err := os.Stat(opts.path)
+			if err != nil || info.ModTime().Equal(modTime) {
+				continue
+			}
+			modTime = info.ModTime()
+			log.Infof("config changed, reloading %s", opts.path)
+		}
+
+		cfg, err := opts.load(os.Getenv)
+		if err != nil {
+			log.Errorf("invalid config, keeping the running one:\n%s", err.Error())
+			continue
+		}
+		if cfg.MaxProcs != maxProcs {
+			log.Warnf("reload: max_procs cannot change without a restart, keeping %d", maxProcs)
+		}
+		if err := s.Reload(serverConfig(cfg)); err != nil {
+			log.Errorf("reload failed, keeping the running config: %s", err.Error())
+			continue
+		}
+		log.Infof("config reloaded")
 	}
+}
 
-	return cfg
+// serveHealth serves the self-test results of s at /health on addr.
+func serveHealth(addr string, s *nats.STUNServer) {
+	mux := http.NewServeMux()
+	mux.Handle("/health", s.SelfTestHandler())
+	server := &http.Server{
+		Addr:         addr,
+		Handler:      mux,
+		ReadTimeout:  3 * time.Second,
+		WriteTimeout: 3 * time.Second,
+	}
+	if err := server.ListenAndServe(); err != nil {
+		fmt.Println("health server error:", err)
+	}
 }
 
 func main() {
-	cfg := parseConfig()
-	if cfg == nil {
+	opts, err := parseArgs(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	var cfg *Config
+	if err == nil {
+		cfg, err = opts.load(os.Getenv)
+	}
+	if err != nil {
+		fmt.Printf("invalid config:\n%s\n", err.Error())
+		os.Exit(2)
+	}
+	if opts.printConfig {
+		bytes, err := json.MarshalIndent(cfg.printable(), "", "  ")
+		if err != nil {
+			fmt.Println("marshal config failed:", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(bytes))
 		return
 	}
 
 	runtime.GOMAXPROCS(cfg.MaxProcs)
 
-	level := logging.LogLevelInfo
-	switch cfg.DebugLevel {
-	case 1:
-		level = logging.LogLevelDebug
-	case 2:
-		level = logging.LogLevelTrace
-	}
-
-	s, err := nats.NewSTUNServer(&nats.STUNServerConfig{
-		PrimaryAddress:   cfg.PrimaryAddr,
-		SecondaryAddress: cfg.SecondaryAddr,
-		Role:             cfg.Role,
-		Pri2SecHost:      cfg.Pri2SecAddr,
-		LogLevel:         level,
-	})
+	s, err := nats.NewSTUNServer(serverConfig(cfg))
 	if err != nil {
-		fmt.Println("err new stun server")
+		fmt.Println("err new stun server:", err)
 		return
 	}
 
 	wg := sync.WaitGroup{}
 	wg.Add(1)
-	s.Start()
+	if err = s.Start(); err != nil {
+		fmt.Println("err start stun server:", err)
+		return
+	}
+	go reloadLoop(s, opts, cfg.MaxProcs)
+	if cfg.HealthAddr != "" {
+		go serveHealth(cfg.HealthAddr, s)
+	}
 	if cfg.Role == "sec" {
 		wg.Done()
 		s.StartListenServer()
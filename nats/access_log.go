@@ -0,0 +1,269 @@
+package nats
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+const defaultAccessLogBackups = 3
+
+// AnonymizeMode says how the access log records source IPs.
+type AnonymizeMode string
+
+const (
+	// AnonymizeNone records source IPs as they are.
+	AnonymizeNone AnonymizeMode = ""
+	// AnonymizeTruncate zeroes the host part: IPv4 to /24, IPv6 to /48.
+	AnonymizeTruncate AnonymizeMode = "truncate"
+	// AnonymizeHash replaces IPs with a keyed hash. The key is random per
+	// process, so the same client can be followed within one run only.
+	AnonymizeHash AnonymizeMode = "hash"
+)
+
+// AccessLogConfig enables the access log: one JSON object per line for
+// every datagram the server reads.
+type AccessLogConfig struct {
+	// Path of the log file, opened for appending. Writer takes precedence.
+	Path   string
+	Writer io.Writer
+	// SampleRate is the fraction (0..1] of successful requests logged,
+	// defaults to all. Failures are always logged.
+	SampleRate float64
+	Anonymize  AnonymizeMode
+	// MaxSize rotates the file once it would grow beyond this many bytes,
+	// 0 never rotates. MaxBackups rotated files (Path.1 being the newest)
+	// are kept, defaulting to 3.
+	MaxSize    int64
+	MaxBackups int
+}
+
+// Relay decisions of an access log entry.
+const (
+	relayLocal       = "local"        // answered by this server
+	relaySecondary   = "secondary"    // handed to the secondary over HTTP
+	relayFromPrimary = "from-primary" // received from the primary over HTTP
+	relayNone        = "none"         // not answered with a binding response
+)
+
+// Outcomes of an access log entry.
+const (
+	outcomeOK           = "ok"
+	outcomeMalformed    = "malformed"
+	outcomeIgnored      = "ignored" // not a binding request
+	outcomeUnauthorized = "unauthorized"
+	outcomeRendezvous   = "rendezvous"
+	outcomeNoPartner    = "no-partner"
+	outcomeRelayed      = "relayed"
+	outcomeRedirected   = "redirected" // answered with 300 (Try Alternate)
+	outcomeFailed       = "failed"
+)
+
+type accessEntry struct {
+	Time       string `json:"ts"`
+	Source     string `json:"src"`
+	Listener   int    `json:"listener"`
+	Endpoint   string `json:"endpoint"`
+	ChangeIP   bool   `json:"changeIP,omitempty"`
+	ChangePort bool   `json:"changePort,omitempty"`
+	Relay      string `json:"relay"`
+	Outcome    string `json:"outcome"`
+	Error      string `json:"error,omitempty"`
+}
+
+type accessLog struct {
+	configured AccessLogConfig // as given, to detect changes on reload
+	config     AccessLogConfig // with defaults
+	hashKey    []byte
+
+	mutex sync.Mutex
+	w     io.Writer
+	file  *os.File // nil when writing to config.Writer
+	size  int64
+	// retryRotate delays the next rotation after a failed one
+	retryRotate time.Time
+	failing     bool // the last write failed
+}
+
+func newAccessLog(config *AccessLogConfig) (*accessLog, error) {
+	l := &accessLog{configured: *config, config: *config}
+	if l.config.SampleRate < 0 || l.config.SampleRate > 1 {
+		return nil, fmt.Errorf("access log: invalid sample rate %v", l.config.SampleRate)
+	}
+	if l.config.SampleRate == 0 {
+		l.config.SampleRate = 1
+	}
+	if l.config.MaxBackups <= 0 {
+		l.config.MaxBackups = defaultAccessLogBackups
+	}
+	switch l.config.Anonymize {
+	case AnonymizeNone, AnonymizeTruncate:
+	case AnonymizeHash:
+		l.hashKey = make([]byte, 16)
+		if _, err := rand.Read(l.hashKey); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("access log: unknown anonymize mode %q", l.config.Anonymize)
+	}
+
+	if l.config.Writer != nil {
+		l.w = l.config.Writer
+		return l, nil
+	}
+	if l.config.Path == "" {
+		return nil, errors.New("access log: need a path or a writer")
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *accessLog) open() error {
+	f, err := os.OpenFile(l.config.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close() // nolint:errcheck,gosec
+		return err
+	}
+	l.file, l.w, l.size = f, f, info.Size()
+	return nil
+}
+
+// rotate shifts Path.i to Path.i+1, dropping the oldest, and starts a new
+// file. The current file stays open, and in use if rotate fails, until the
+// new one is in place.
+func (l *accessLog) rotate() error {
+	path := l.config.Path
+	next := path + ".next"
+	f, err := os.OpenFile(next, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	os.Remove(fmt.Sprintf("%s.%d", path, l.config.MaxBackups)) // nolint:errcheck,gosec
+	for i := l.config.MaxBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1)) // nolint:errcheck,gosec
+	}
+	if err = os.Rename(path, path+".1"); err == nil {
+		if err = os.Rename(next, path); err != nil {
+			os.Rename(path+".1", path) // nolint:errcheck,gosec
+		}
+	}
+	if err != nil {
+		f.Close()       // nolint:errcheck,gosec
+		os.Remove(next) // nolint:errcheck,gosec
+		return err
+	}
+
+	old := l.file
+	l.file, l.w, l.size = f, f, 0
+	return old.Close()
+}
+
+// anonymize returns addr as the log records it.
+func (l *accessLog) anonymize(addr net.Addr) string {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok || l.config.Anonymize == AnonymizeNone {
+		return addr.String()
+	}
+	ip := udpAddr.IP
+	if l.config.Anonymize == AnonymizeHash {
+		mac := hmac.New(sha256.New, l.hashKey)
+		mac.Write(ip.To16()) // nolint:errcheck,gosec
+		return net.JoinHostPort(hex.EncodeToString(mac.Sum(nil)[:8]), fmt.Sprint(udpAddr.Port))
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4.Mask(net.CIDRMask(24, 32))
+	} else {
+		ip = ip.Mask(net.CIDRMask(48, 128))
+	}
+	return (&net.UDPAddr{IP: ip, Port: udpAddr.Port}).String()
+}
+
+// write logs one entry for the request m (nil if it did not decode) from
+// from, received on endpoint e (nil if unknown). It returns the errors of
+// rotation, retried after a second, and the first of a run of failed
+// writes.
+func (l *accessLog) write(e *endpoint, from net.Addr, m *stun.Message, relay, outcome string, err error) error {
+	if outcome == outcomeOK && l.config.SampleRate < 1 && mrand.Float64() >= l.config.SampleRate { // nolint:gosec
+		return nil
+	}
+
+	entry := accessEntry{
+		Time:     time.Now().UTC().Format(time.RFC3339Nano),
+		Source:   l.anonymize(from),
+		Listener: -1,
+		Relay:    relay,
+		Outcome:  outcome,
+	}
+	if e != nil {
+		entry.Listener, entry.Endpoint = e.index, e.Name
+	}
+	if m != nil {
+		changeReq := attrChangeRequest{}
+		if changeReq.GetFrom(m) == nil {
+			entry.ChangeIP, entry.ChangePort = changeReq.ChangeIP, changeReq.ChangePort
+		}
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	line, err := json.Marshal(&entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	var rerr error
+	if l.file != nil && l.config.MaxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.config.MaxSize &&
+		time.Now().After(l.retryRotate) {
+		if rerr = l.rotate(); rerr != nil {
+			l.retryRotate = time.Now().Add(time.Second)
+			rerr = fmt.Errorf("rotate: %s", rerr.Error())
+		}
+	}
+	n, werr := l.w.Write(line)
+	l.size += int64(n)
+	failing := l.failing
+	l.failing = werr != nil
+	if werr != nil && !failing {
+		return werr
+	}
+	return rerr
+}
+
+func (l *accessLog) close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// logAccess writes an access log entry to l if the access log is enabled.
+func (s *STUNServer) logAccess(l *accessLog, e *endpoint, from net.Addr, m *stun.Message, relay, outcome string, err error) {
+	if l != nil {
+		if werr := l.write(e, from, m, relay, outcome, err); werr != nil {
+			s.log.Errorf("access log: %s", werr.Error())
+		}
+	}
+}
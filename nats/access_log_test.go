@@ -0,0 +1,206 @@
+package nats
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+// entryWriter hands every written line to a channel.
+type entryWriter chan accessEntry
+
+func (w entryWriter) Write(p []byte) (int, error) {
+	var entry accessEntry
+	if err := json.Unmarshal(p, &entry); err != nil {
+		return 0, err
+	}
+	w <- entry
+	return len(p), nil
+}
+
+func (w entryWriter) next(t *testing.T) *accessEntry {
+	select {
+	case entry := <-w:
+		return &entry
+	case <-time.After(time.Second):
+		t.Error("no access log entry")
+		return nil
+	}
+}
+
+func TestAccessLogAnonymize(t *testing.T) {
+	v4 := &net.UDPAddr{IP: net.IPv4(27, 1, 1, 9), Port: 5000}
+	v6 := &net.UDPAddr{IP: net.ParseIP("2001:db8:1:2::9"), Port: 5000}
+
+	l, err := newAccessLog(&AccessLogConfig{Writer: entryWriter(nil)})
+	if assert.NoError(t, err, "should succeed") {
+		assert.Equal(t, "27.1.1.9:5000", l.anonymize(v4), "should keep the address")
+	}
+
+	l, err = newAccessLog(&AccessLogConfig{Writer: entryWriter(nil), Anonymize: AnonymizeTruncate})
+	if assert.NoError(t, err, "should succeed") {
+		assert.Equal(t, "27.1.1.0:5000", l.anonymize(v4), "should truncate to /24")
+		assert.Equal(t, "[2001:db8:1::]:5000", l.anonymize(v6), "should truncate to /48")
+	}
+
+	l, err = newAccessLog(&AccessLogConfig{Writer: entryWriter(nil), Anonymize: AnonymizeHash})
+	if assert.NoError(t, err, "should succeed") {
+		hashed := l.anonymize(v4)
+		assert.NotContains(t, hashed, "27.1.1", "should hide the address")
+		assert.Equal(t, hashed, l.anonymize(v4), "should be stable")
+		assert.NotEqual(t, hashed, l.anonymize(v6), "should tell clients apart")
+	}
+
+	for _, c := range []*AccessLogConfig{
+		{},
+		{Writer: entryWriter(nil), SampleRate: 2},
+		{Writer: entryWriter(nil), Anonymize: "bogus"},
+	} {
+		_, err = newAccessLog(c)
+		assert.Error(t, err, "should fail: %+v", c)
+	}
+}
+
+func TestAccessLogRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	l, err := newAccessLog(&AccessLogConfig{Path: path, MaxSize: 200, MaxBackups: 2})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	from := &net.UDPAddr{IP: net.IPv4(27, 1, 1, 9), Port: 5000}
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, l.write(nil, from, nil, relayNone, outcomeMalformed, nil), "should succeed")
+	}
+	assert.NoError(t, l.close(), "should succeed")
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		if assert.NoError(t, err, "should exist: %s", name) {
+			assert.True(t, info.Size() <= 200, "should be rotated: %s has %d bytes", name, info.Size())
+		}
+	}
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err), "should keep 2 backups")
+}
+
+func TestAccessLogRotateFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	l, err := newAccessLog(&AccessLogConfig{Path: path, MaxSize: 200})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer l.close() // nolint:errcheck,gosec
+	// the new file cannot be created over a directory
+	if !assert.NoError(t, os.Mkdir(path+".next", 0750), "should succeed") {
+		return
+	}
+
+	from := &net.UDPAddr{IP: net.IPv4(27, 1, 1, 9), Port: 5000}
+	var errs []error
+	for i := 0; i < 4; i++ {
+		if err = l.write(nil, from, nil, relayNone, outcomeMalformed, nil); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if assert.Len(t, errs, 1, "should report the failed rotation once until the retry") {
+		assert.Contains(t, errs[0].Error(), "rotate", "should match")
+	}
+	info, err := os.Stat(path)
+	if assert.NoError(t, err, "should succeed") {
+		assert.True(t, info.Size() > 200, "should keep writing to the old file, has %d bytes", info.Size())
+	}
+	_, err = os.Stat(path + ".1")
+	assert.True(t, os.IsNotExist(err), "should not have rotated")
+
+	assert.NoError(t, os.Remove(path+".next"), "should succeed")
+	l.retryRotate = time.Time{}
+	assert.NoError(t, l.write(nil, from, nil, relayNone, outcomeMalformed, nil), "should rotate")
+	_, err = os.Stat(path + ".1")
+	assert.NoError(t, err, "should have rotated")
+}
+
+// failingWriter fails while fail is set.
+type failingWriter struct{ fail bool }
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.fail {
+		return 0, errors.New("disk full")
+	}
+	return len(p), nil
+}
+
+func TestAccessLogWriteErrors(t *testing.T) {
+	w := &failingWriter{fail: true}
+	l, err := newAccessLog(&AccessLogConfig{Writer: w})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	from := &net.UDPAddr{IP: net.IPv4(27, 1, 1, 9), Port: 5000}
+	write := func() error {
+		return l.write(nil, from, nil, relayNone, outcomeMalformed, nil)
+	}
+	assert.Error(t, write(), "should report the failure")
+	assert.NoError(t, write(), "should not repeat the same failure")
+	w.fail = false
+	assert.NoError(t, write(), "should succeed")
+	w.fail = true
+	assert.Error(t, write(), "should report a new failure")
+}
+
+func TestAccessLogOnVNet(t *testing.T) {
+	w := make(entryWriter, 16)
+	v, err := buildVNetWithServer(&vnet.NATType{
+		MappingBehavior:   vnet.EndpointIndependent,
+		FilteringBehavior: vnet.EndpointIndependent,
+	}, &STUNServerConfig{Topology: testTopology, AccessLog: &AccessLogConfig{Writer: w}})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer v.close()
+	conn, err := v.net0.ListenPacket("udp4", "0.0.0.0:0")
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer conn.Close() // nolint:errcheck,gosec
+
+	exchange(t, conn, "1.2.3.4:3478")
+	if entry := w.next(t); entry != nil {
+		assert.True(t, strings.HasPrefix(entry.Source, "27.1.1.1:"), "should be the NAT's address, got %s", entry.Source)
+		assert.Equal(t, 0, entry.Listener, "should match")
+		assert.Equal(t, "pp", entry.Endpoint, "should match")
+		assert.Equal(t, relayLocal, entry.Relay, "should match")
+		assert.Equal(t, outcomeOK, entry.Outcome, "should match")
+		_, err = time.Parse(time.RFC3339Nano, entry.Time)
+		assert.NoError(t, err, "should have a timestamp")
+	}
+
+	exchange(t, conn, "1.2.3.4:5000", &attrChangeRequest{ChangeIP: true})
+	if entry := w.next(t); entry != nil {
+		assert.Equal(t, 4, entry.Listener, "should match")
+		assert.True(t, entry.ChangeIP, "should record the flags")
+		assert.False(t, entry.ChangePort, "should record the flags")
+		assert.Equal(t, outcomeOK, entry.Outcome, "should match")
+	}
+
+	exchange(t, conn, "1.2.3.4:5000", &attrChangeRequest{ChangePort: true})
+	if entry := w.next(t); entry != nil {
+		assert.Equal(t, relayNone, entry.Relay, "should match")
+		assert.Equal(t, outcomeNoPartner, entry.Outcome, "should match")
+	}
+
+	to := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 3478}
+	if _, err = conn.WriteTo([]byte("not stun"), to); assert.NoError(t, err, "should succeed") {
+		if entry := w.next(t); entry != nil {
+			assert.Equal(t, outcomeMalformed, entry.Outcome, "should match")
+			assert.NotEmpty(t, entry.Error, "should say why")
+		}
+	}
+}
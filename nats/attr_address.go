@@ -16,9 +16,18 @@ const (
 )
 
 const (
-	attrTypeChangeRequest  stun.AttrType = 0x0003 // CHANGE-REQUEST
-	attrTypeChangedAddress stun.AttrType = 0x0005 // CHANGED-ADDRESS
-	attrTypeOtherAddress   stun.AttrType = 0x802C // OTHER-ADDRESS
+	attrTypeChangeRequest          stun.AttrType = 0x0003 // CHANGE-REQUEST
+	attrTypeSourceAddress          stun.AttrType = 0x0004 // SOURCE-ADDRESS
+	attrTypeChangedAddress         stun.AttrType = 0x0005 // CHANGED-ADDRESS
+	attrTypeMessageIntegritySHA256 stun.AttrType = 0x001C // MESSAGE-INTEGRITY-SHA256
+	attrTypePadding                stun.AttrType = 0x0026 // PADDING
+	attrTypeResponsePort           stun.AttrType = 0x0027 // RESPONSE-PORT
+	attrTypeResponseOrigin         stun.AttrType = 0x802B // RESPONSE-ORIGIN
+	attrTypeOtherAddress           stun.AttrType = 0x802C // OTHER-ADDRESS
+
+	// private, used by the rendezvous service
+	attrTypeRendezvousSession stun.AttrType = 0xC001 // RENDEZVOUS-SESSION
+	attrTypePeerAddress       stun.AttrType = 0xC002 // PEER-ADDRESS
 )
 
 // attrAddress represents MAPPED-ADDRESS attribute.
@@ -52,6 +61,9 @@ func (a *attrAddress) getAs(m *stun.Message, t stun.AttrType) error {
 	if family == familyIPv6 {
 		ipLen = net.IPv6len
 	}
+	if len(v) != 4+ipLen {
+		return fmt.Errorf("attrAddr: bad length %d for family %d", len(v), family)
+	}
 	// Ensuring len(a.IP) == ipLen and reusing a.IP.
 	if len(a.IP) < ipLen {
 		a.IP = a.IP[:cap(a.IP)]
@@ -82,6 +94,9 @@ func (a *attrAddress) addAs(m *stun.Message, t stun.AttrType) error {
 	} else if len(ip) != net.IPv4len {
 		return fmt.Errorf("attrAddr: bad IPv4 length %d", len(ip))
 	}
+	if a.Port < 0 || a.Port > 0xffff {
+		return fmt.Errorf("attrAddr: bad port %d", a.Port)
+	}
 	value := make([]byte, 128)
 	value[0] = 0 // first 8 bits are zeroes
 	binary.BigEndian.PutUint16(value[0:2], family)
@@ -91,10 +106,29 @@ func (a *attrAddress) addAs(m *stun.Message, t stun.AttrType) error {
 	return nil
 }
 
-type attrChangedAddress struct {
-	attrAddress
+// getMappedAddress reads XOR-MAPPED-ADDRESS from m, or MAPPED-ADDRESS if
+// the server follows RFC 3489.
+func getMappedAddress(m *stun.Message) (*net.UDPAddr, error) {
+	var xorAddr stun.XORMappedAddress
+	if err := xorAddr.GetFrom(m); err == nil {
+		return &net.UDPAddr{IP: xorAddr.IP, Port: xorAddr.Port}, nil
+	}
+	var addr stun.MappedAddress
+	if err := addr.GetFrom(m); err != nil {
+		return nil, fmt.Errorf("XOR-MAPPED-ADDRESS not found")
+	}
+	return &net.UDPAddr{IP: addr.IP, Port: addr.Port}, nil
 }
 
-func (a *attrChangedAddress) AddTo(m *stun.Message) error {
-	return a.addAs(m, attrTypeChangedAddress)
+// getChangedAddress reads CHANGED-ADDRESS from m, or OTHER-ADDRESS if the
+// server follows RFC 5780.
+func getChangedAddress(m *stun.Message) (*attrAddress, error) {
+	var addr attrAddress
+	if err := addr.getAs(m, attrTypeChangedAddress); err == nil {
+		return &addr, nil
+	}
+	if err := addr.getAs(m, attrTypeOtherAddress); err != nil {
+		return nil, fmt.Errorf("CHANGED-ADDRESS not found")
+	}
+	return &addr, nil
 }
@@ -0,0 +1,93 @@
+package nats
+
+import (
+	"net"
+	"testing"
+
+	"github.com/pion/stun"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAttrAddress(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		for _, ip := range []string{"1.2.3.4", "::ffff:1.2.3.4", "2001:db8::1"} {
+			m := new(stun.Message)
+			in := attrAddress{IP: net.ParseIP(ip), Port: 3478}
+			if !assert.NoError(t, in.addAs(m, attrTypeChangedAddress), "should succeed") {
+				continue
+			}
+			var out attrAddress
+			if assert.NoError(t, out.getAs(m, attrTypeChangedAddress), "should succeed") {
+				assert.True(t, in.IP.Equal(out.IP), "should match")
+				assert.Equal(t, in.Port, out.Port, "should match")
+			}
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		for _, v := range [][]byte{
+			{0, 1, 0x0d, 0x96, 1, 2, 3},                   // IPv4, 3 bytes
+			{0, 2, 0x0d, 0x96, 1, 2, 3, 4},                // IPv6, 4 bytes
+			{0, 1, 0x0d, 0x96, 1, 2, 3, 4, 5, 6, 7, 8, 9}, // IPv4, 9 bytes
+		} {
+			m := new(stun.Message)
+			m.Add(attrTypeChangedAddress, v)
+			var a attrAddress
+			assert.Error(t, a.getAs(m, attrTypeChangedAddress), "should fail")
+		}
+	})
+
+	t.Run("bad port", func(t *testing.T) {
+		a := attrAddress{IP: net.ParseIP("1.2.3.4"), Port: 65536}
+		assert.Error(t, a.addAs(new(stun.Message), attrTypeChangedAddress), "should fail")
+	})
+}
+
+func FuzzAttrAddressGet(f *testing.F) {
+	f.Add([]byte{0, 1, 0x0d, 0x96, 1, 2, 3, 4})
+	f.Add([]byte{0, 2, 0x0d, 0x96, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1})
+	f.Add([]byte{0, 2, 0x0d, 0x96, 1})
+	f.Fuzz(func(t *testing.T, v []byte) {
+		m := new(stun.Message)
+		m.Add(attrTypeChangedAddress, v)
+		var a attrAddress
+		if err := a.getAs(m, attrTypeChangedAddress); err != nil {
+			return
+		}
+		if len(v) != 4+len(a.IP) {
+			t.Fatalf("accepted %d bytes for a %d byte address", len(v), len(a.IP))
+		}
+
+		out := new(stun.Message)
+		if err := a.addAs(out, attrTypeChangedAddress); err != nil {
+			t.Fatalf("decoded address does not encode: %s", err.Error())
+		}
+		var b attrAddress
+		if err := b.getAs(out, attrTypeChangedAddress); err != nil {
+			t.Fatalf("encoded address does not decode: %s", err.Error())
+		}
+		if !a.IP.Equal(b.IP) || a.Port != b.Port {
+			t.Fatalf("round trip: %s != %s", a.String(), b.String())
+		}
+	})
+}
+
+func FuzzAttrAddressAdd(f *testing.F) {
+	f.Add([]byte{1, 2, 3, 4}, 3478)
+	f.Add([]byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, 0)
+	f.Add([]byte{1, 2, 3}, 65536)
+	f.Fuzz(func(t *testing.T, ip []byte, port int) {
+		a := attrAddress{IP: ip, Port: port}
+		m := new(stun.Message)
+		if err := a.addAs(m, attrTypeChangedAddress); err != nil {
+			return
+		}
+		var b attrAddress
+		if err := b.getAs(m, attrTypeChangedAddress); err != nil {
+			t.Fatalf("encoded address does not decode: %s", err.Error())
+		}
+		if !net.IP(ip).Equal(b.IP) || port != b.Port {
+			t.Fatalf("round trip: %s != %s", a.String(), b.String())
+		}
+	})
+}
@@ -30,6 +30,9 @@ func (a *attrChangeRequest) getAs(m *stun.Message, t stun.AttrType) error {
 	if len(bytes) < 4 {
 		return io.ErrUnexpectedEOF
 	}
+	if len(bytes) > 4 {
+		return fmt.Errorf("change-request: bad length %d", len(bytes))
+	}
 	val := binary.BigEndian.Uint32(bytes[0:4])
 	a.ChangeIP = val&0x4 != 0
 	a.ChangePort = val&0x2 != 0
@@ -53,3 +56,7 @@ func (a *attrChangeRequest) addAs(m *stun.Message, t stun.AttrType) error {
 func (a *attrChangeRequest) GetFrom(m *stun.Message) error {
 	return a.getAs(m, attrTypeChangeRequest)
 }
+
+func (a *attrChangeRequest) AddTo(m *stun.Message) error {
+	return a.addAs(m, attrTypeChangeRequest)
+}
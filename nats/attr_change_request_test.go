@@ -0,0 +1,40 @@
+package nats
+
+import (
+	"testing"
+
+	"github.com/pion/stun"
+)
+
+func FuzzAttrChangeRequest(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 0})
+	f.Add([]byte{0, 0, 0, 6})
+	f.Add([]byte{0, 0})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff})
+	f.Fuzz(func(t *testing.T, v []byte) {
+		m := new(stun.Message)
+		m.Add(attrTypeChangeRequest, v)
+		var a attrChangeRequest
+		if err := a.GetFrom(m); err != nil {
+			if len(v) == 4 {
+				t.Fatalf("rejected a 4 byte value: %s", err.Error())
+			}
+			return
+		}
+		if len(v) != 4 {
+			t.Fatalf("accepted a %d byte value", len(v))
+		}
+
+		out := new(stun.Message)
+		if err := a.AddTo(out); err != nil {
+			t.Fatalf("decoded value does not encode: %s", err.Error())
+		}
+		var b attrChangeRequest
+		if err := b.GetFrom(out); err != nil {
+			t.Fatalf("encoded value does not decode: %s", err.Error())
+		}
+		if a != b {
+			t.Fatalf("round trip: %s != %s", a.String(), b.String())
+		}
+	})
+}
@@ -0,0 +1,44 @@
+package nats
+
+import (
+	"github.com/pion/stun"
+)
+
+// attrPadding represents PADDING attribute.
+//
+// The value is meaningless; only its length matters. Clients use it to
+// inflate requests (and responses) when probing the path MTU.
+//
+// RFC 5780 Section 7.6
+type attrPadding struct {
+	Length int
+}
+
+func (a *attrPadding) getAs(m *stun.Message, t stun.AttrType) error {
+	v, err := m.Get(t)
+	if err != nil {
+		return err
+	}
+	a.Length = len(v)
+	return nil
+}
+
+// zeroPadding backs the PADDING values that fit in it.
+var zeroPadding [maxDatagramSize]byte
+
+func (a *attrPadding) addAs(m *stun.Message, t stun.AttrType) error {
+	if a.Length <= len(zeroPadding) {
+		m.Add(t, zeroPadding[:a.Length])
+	} else {
+		m.Add(t, make([]byte, a.Length))
+	}
+	return nil
+}
+
+func (a *attrPadding) GetFrom(m *stun.Message) error {
+	return a.getAs(m, attrTypePadding)
+}
+
+func (a *attrPadding) AddTo(m *stun.Message) error {
+	return a.addAs(m, attrTypePadding)
+}
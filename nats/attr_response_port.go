@@ -0,0 +1,78 @@
+package nats
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/pion/stun"
+)
+
+// attrResponsePort represents RESPONSE-PORT attribute.
+//
+// It asks the server to send the response to this port on the client's
+// IP address instead of the source port of the request.
+//
+// RFC 5780 Section 7.5
+type attrResponsePort struct {
+	Port int
+}
+
+func (a *attrResponsePort) String() string {
+	return fmt.Sprintf("responsePort=%d", a.Port)
+}
+
+func (a *attrResponsePort) getAs(m *stun.Message, t stun.AttrType) error {
+	v, err := m.Get(t)
+	if err != nil {
+		return err
+	}
+	if len(v) < 2 {
+		return io.ErrUnexpectedEOF
+	}
+	a.Port = int(binary.BigEndian.Uint16(v[0:2]))
+	return nil
+}
+
+func (a *attrResponsePort) addAs(m *stun.Message, t stun.AttrType) error {
+	if a.Port <= 0 || a.Port > 0xFFFF {
+		return fmt.Errorf("attrResponsePort: bad port %d", a.Port)
+	}
+	// 16-bit port followed by 16 bits of padding
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint16(v[0:2], uint16(a.Port))
+	m.Add(t, v)
+	return nil
+}
+
+var (
+	errResponsePortZero   = errors.New("RESPONSE-PORT 0")
+	errResponsePortPadded = errors.New("RESPONSE-PORT with PADDING")
+)
+
+// checkResponsePort rejects a RESPONSE-PORT of 0, and RESPONSE-PORT
+// combined with PADDING, which would let a spoofed request aim a
+// response of the size it chooses at any port of the victim (RFC 5780
+// Section 7.2).
+func checkResponsePort(m *stun.Message) error {
+	responsePort := attrResponsePort{}
+	if err := responsePort.GetFrom(m); err != nil {
+		return nil // absent, or malformed and ignored
+	}
+	if responsePort.Port == 0 {
+		return errResponsePortZero
+	}
+	if m.Contains(attrTypePadding) {
+		return errResponsePortPadded
+	}
+	return nil
+}
+
+func (a *attrResponsePort) GetFrom(m *stun.Message) error {
+	return a.getAs(m, attrTypeResponsePort)
+}
+
+func (a *attrResponsePort) AddTo(m *stun.Message) error {
+	return a.addAs(m, attrTypeResponsePort)
+}
@@ -0,0 +1,172 @@
+package nats
+
+import (
+	"io"
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// batchConn reads and writes several datagrams per system call
+// (recvmmsg/sendmmsg on Linux). ipv4.Message and ipv6.Message are the same
+// type, so both packages' PacketConns implement it.
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+func newBatchConn(conn net.PacketConn) batchConn {
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		return ipv6.NewPacketConn(conn)
+	}
+	return ipv4.NewPacketConn(conn)
+}
+
+// batched reports whether conn is served by readBatchLoop: batches are
+// configured, the OS supports them and conn is a real UDP socket.
+func (s *STUNServer) batched(conn net.PacketConn) bool {
+	_, ok := conn.(*net.UDPConn)
+	return ok && batchIO && s.batchSize > 1
+}
+
+// pendingResponse is a response queued until the end of its batch.
+type pendingResponse struct {
+	conn net.PacketConn
+	res  *response
+	to   net.Addr
+	sent bool
+}
+
+// batch holds the datagrams read from a listener in one call and the
+// responses to them, which are written in as few calls as possible, one
+// per responding socket.
+type batch struct {
+	conn    batchConn
+	packets []*packet
+	in      []ipv4.Message
+	pending []pendingResponse
+	out     []ipv4.Message
+	writers map[net.PacketConn]batchConn
+}
+
+func newBatch(conn net.PacketConn, size int) *batch {
+	b := &batch{
+		conn:    newBatchConn(conn),
+		packets: make([]*packet, size),
+		in:      make([]ipv4.Message, size),
+		pending: make([]pendingResponse, 0, size),
+		out:     make([]ipv4.Message, size),
+		writers: map[net.PacketConn]batchConn{},
+	}
+	for i := range b.packets {
+		b.packets[i] = &packet{buf: make([]byte, maxDatagramSize)}
+		b.in[i].Buffers = [][]byte{b.packets[i].buf}
+		b.out[i].Buffers = make([][]byte, 1)
+	}
+	return b
+}
+
+// read reads up to len(b.packets) datagrams and returns how many.
+func (b *batch) read() (int, error) {
+	n, err := b.conn.ReadBatch(b.in, 0)
+	for i := 0; i < n; i++ {
+		b.packets[i].from = net.UDPAddr{}
+		if addr, ok := b.in[i].Addr.(*net.UDPAddr); ok {
+			b.packets[i].from = *addr
+		}
+	}
+	return n, err
+}
+
+// truncated reports whether datagram i of the last read was longer than
+// its buffer. Where the OS does not say, a datagram filling the buffer
+// is taken as truncated.
+func (b *batch) truncated(i int) bool {
+	if msgTrunc != 0 {
+		return b.in[i].Flags&msgTrunc != 0
+	}
+	return b.in[i].N >= len(b.packets[i].buf)
+}
+
+// queue takes res, to be written from conn to to when the batch is
+// flushed.
+func (b *batch) queue(conn net.PacketConn, res *response, to net.Addr) {
+	b.pending = append(b.pending, pendingResponse{conn: conn, res: res, to: to})
+}
+
+// flush writes the queued responses, grouped by the socket they are sent
+// from, and recycles them. It returns the first error.
+func (b *batch) flush() error {
+	var err error
+	for i := range b.pending {
+		if b.pending[i].sent {
+			continue
+		}
+		conn := b.pending[i].conn
+		n := 0
+		for j := i; j < len(b.pending); j++ {
+			p := &b.pending[j]
+			if p.sent || p.conn != conn {
+				continue
+			}
+			b.out[n].Buffers[0] = p.res.Raw
+			b.out[n].Addr = p.to
+			n++
+			p.sent = true
+		}
+		if werr := b.write(conn, b.out[:n]); werr != nil && err == nil {
+			err = werr
+		}
+	}
+
+	for i := range b.pending {
+		responsePool.Put(b.pending[i].res)
+		b.pending[i] = pendingResponse{}
+	}
+	b.pending = b.pending[:0]
+	return err
+}
+
+// write sends ms from conn, retrying until all are sent.
+func (b *batch) write(conn net.PacketConn, ms []ipv4.Message) error {
+	w, ok := b.writers[conn]
+	if !ok {
+		w = newBatchConn(conn)
+		b.writers[conn] = w
+	}
+	for len(ms) > 0 {
+		n, err := w.WriteBatch(ms, 0)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		ms = ms[n:]
+	}
+	return nil
+}
+
+// readBatchLoop is readLoop reading and answering batches of datagrams.
+func (s *STUNServer) readBatchLoop(w *worker) {
+	b := newBatch(w.conn, s.batchSize)
+	for {
+		n, err := b.read()
+		if err != nil {
+			s.log.Errorf("readBatchLoop: %s", err.Error())
+			return
+		}
+		for i := 0; i < n; i++ {
+			if b.truncated(i) {
+				// oversized datagram, dropped like readLoop does
+				s.log.Debugf("readBatchLoop: dropping oversized datagram from %s", b.packets[i].from.String())
+				continue
+			}
+			s.handlePacket(w, b.packets[i], b.in[i].N, b)
+		}
+		if err = b.flush(); err != nil {
+			s.log.Warnf("readBatchLoop: %s", err.Error())
+		}
+	}
+}
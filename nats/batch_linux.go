@@ -0,0 +1,9 @@
+package nats
+
+import "golang.org/x/sys/unix"
+
+// batchIO is set where ReadBatch and WriteBatch use recvmmsg and sendmmsg.
+const batchIO = true
+
+// msgTrunc is the flag recvmmsg sets on a datagram longer than its buffer.
+const msgTrunc = unix.MSG_TRUNC
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package nats
+
+// batchIO is set where ReadBatch and WriteBatch use recvmmsg and sendmmsg;
+// elsewhere they handle one datagram per call, no better than ReadFrom.
+const batchIO = false
+
+// msgTrunc is not reported here; a datagram filling its buffer is taken
+// as truncated.
+const msgTrunc = 0
@@ -0,0 +1,178 @@
+package nats
+
+import (
+	"net"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatchOnLoopback(t *testing.T) {
+	primary, secondary := freeLoopbackAddr(t), freeLoopbackAddr(t)
+	s, addr := startLoopbackServer(t, &STUNServerConfig{
+		Topology: []Endpoint{
+			{Address: primary, ChangePort: secondary},
+			{Address: secondary, ChangePort: primary},
+		},
+		BatchSize: 8,
+	})
+	defer s.Close() // nolint:errcheck,gosec
+	assert.Equal(t, runtime.GOOS == "linux", s.batched(s.endpoints[0].conn), "should batch on Linux only")
+
+	conns := make([]net.PacketConn, 16)
+	for i := range conns {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer conn.Close() // nolint:errcheck,gosec
+		conns[i] = conn
+	}
+
+	// send all requests before reading, so that they are read in batches
+	to, err := net.ResolveUDPAddr("udp4", addr)
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	msgs := make([]*stun.Message, len(conns))
+	for i, conn := range conns {
+		setters := []stun.Setter{stun.TransactionID, stun.BindingRequest}
+		if i%2 == 1 {
+			setters = append(setters, &attrChangeRequest{ChangePort: true})
+		}
+		msgs[i] = stun.MustBuild(setters...)
+		_, err = conn.WriteTo(msgs[i].Raw, to)
+		assert.NoError(t, err, "should succeed")
+	}
+	for i, conn := range conns {
+		res, from, err := readResponse(conn, msgs[i].TransactionID, time.Second)
+		if !assert.NoError(t, err, "should respond") {
+			continue
+		}
+		want := primary
+		if i%2 == 1 {
+			want = secondary
+		}
+		assert.Equal(t, want, from.String(), "should answer from the requested endpoint")
+		var mapped stun.XORMappedAddress
+		if assert.NoError(t, mapped.GetFrom(res), "should succeed") {
+			assert.Equal(t, conn.LocalAddr().String(), mapped.String(), "should map to the client")
+		}
+	}
+}
+
+func TestBatchOnVNet(t *testing.T) {
+	v, err := buildVNetWithServer(&vnet.NATType{
+		MappingBehavior:   vnet.EndpointIndependent,
+		FilteringBehavior: vnet.EndpointIndependent,
+	}, &STUNServerConfig{BatchSize: 8})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer v.close()
+	assert.False(t, v.server.batched(v.server.endpoints[0].conn), "should fall back to ReadFrom")
+
+	conn, err := v.net0.ListenPacket("udp4", "0.0.0.0:0")
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer conn.Close() // nolint:errcheck,gosec
+	res, _ := exchange(t, conn, "1.2.3.4:3478", &attrChangeRequest{ChangeIP: true})
+	assert.NotNil(t, res, "should respond")
+
+	_, err = NewSTUNServer(&STUNServerConfig{PrimaryAddress: "1.2.3.4:3478", SecondaryAddress: "1.2.3.5:3479", BatchSize: -1})
+	assert.Error(t, err, "should reject a negative size")
+}
+
+func TestBatchTruncated(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer conn.Close() // nolint:errcheck,gosec
+	client, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer client.Close() // nolint:errcheck,gosec
+
+	msg := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+	for _, p := range [][]byte{make([]byte, 2000), msg.Raw} {
+		_, err = client.WriteTo(p, conn.LocalAddr())
+		assert.NoError(t, err, "should succeed")
+	}
+
+	// no UDP payload exceeds the server's buffers, so shrink them
+	b := newBatch(conn, 4)
+	for i, p := range b.packets {
+		p.buf = p.buf[:1500]
+		b.in[i].Buffers[0] = p.buf
+	}
+	var truncated []bool
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)), "should succeed")
+	for len(truncated) < 2 {
+		n, err := b.read()
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		for i := 0; i < n; i++ {
+			truncated = append(truncated, b.truncated(i))
+		}
+	}
+	assert.Equal(t, []bool{true, false}, truncated, "should flag the oversized datagram only")
+}
+
+// BenchmarkServerBatch measures binding requests per second on loopback
+// with batch sizes, each client keeping several requests in flight.
+func BenchmarkServerBatch(b *testing.B) {
+	const inFlight = 8
+	for _, size := range []int{1, 8, 32} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			s, addr := startLoopbackServer(b, &STUNServerConfig{BatchSize: size})
+			defer s.Close() // nolint:errcheck,gosec
+			to, err := net.ResolveUDPAddr("udp4", addr)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.SetParallelism(4)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				defer conn.Close() // nolint:errcheck,gosec
+				buf := make([]byte, maxDatagramSize)
+				for more := true; more; {
+					sent := 0
+					for ; sent < inFlight && pb.Next(); sent++ {
+						msg := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+						if _, err = conn.WriteTo(msg.Raw, to); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+					more = sent == inFlight
+					for ; sent > 0; sent-- {
+						// a lost datagram only costs the timeout
+						if err = conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+							b.Error(err)
+							return
+						}
+						if _, _, err = conn.ReadFrom(buf); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				}
+			})
+		})
+	}
+}
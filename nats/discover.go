@@ -5,25 +5,15 @@ import (
 	"log"
 	"net"
 	"strconv"
+	"time"
 
-	"github.com/pion/logging"
 	"github.com/pion/stun"
 	"github.com/pion/transport/vnet"
-	"github.com/pion/turn"
 )
 
 // EndpointDependencyType ...
 type EndpointDependencyType uint8
 
-const (
-	Blocked              = "Blocked"
-	OpenInternet         = "Open Internet"
-	FullCone             = "Full Cone"
-	SymmetricUDPFirewall = "Symmetric UDP Firewall"
-	RestricNAT           = "Restric NAT"
-	RestricPortNAT       = "Restric Port NAT"
-	SymmetricNAT         = "Symmetric NAT"
-)
 const (
 	// EndpointIndependent means the behavior is independent of the endpoint's address or port
 	EndpointIndependent EndpointDependencyType = iota
@@ -35,27 +25,23 @@ const (
 	EndpointUndefined
 )
 
-func (t EndpointDependencyType) String() string {
-	switch t {
-	case EndpointIndependent:
-		return "independent"
-	case EndpointAddrDependent:
-		return "address dependent"
-	case EndpointAddrPortDependent:
-		return "address-port dependent"
-	}
-	return "unspecified"
-}
-
 // DiscoverResult contains a set of results from Discover method.
 type DiscoverResult struct {
+	// Version is ResultVersion for results of this package.
+	Version           int                    `json:"version"`
 	IsNatted          bool                   `json:"isNatted"`
 	MappingBehavior   EndpointDependencyType `json:"mappingBehavior"`
 	FilteringBehavior EndpointDependencyType `json:"filteringBehavior"`
 	PortPreservation  bool                   `json:"portPreservation"`
-	NATType           string                 `json:"natType"`
+	Hairpinning       bool                   `json:"hairpinning"` // only tested with Config.Hairpinning
+	NATType           NATType                `json:"natType"`
 	ExternalIP        string                 `json:"externalIP"`
 	ExternalPort      string                 `json:"externalPort"`
+	// TURN is set when Config.TURNServer is.
+	TURN *TURNResult `json:"turn,omitempty"`
+	// Server is the alternate server the tests ran against when the
+	// configured one redirected them.
+	Server string `json:"server,omitempty"`
 }
 
 // Config has config parameters for NewNATS.
@@ -65,6 +51,26 @@ type Config struct {
 	MappingLocal   string
 	FilteringLocal string
 	Net            *vnet.Net
+	// Username and Password sign requests with MESSAGE-INTEGRITY. With
+	// LongTermAuth the realm and nonce are learnt from the server's
+	// challenge. UseSHA256 selects MESSAGE-INTEGRITY-SHA256 instead.
+	Username     string
+	Password     string
+	LongTermAuth bool
+	UseSHA256    bool
+	// TURNServer enables the TURN reachability check (CheckTURN) as part
+	// of Discover. TURNRealm is optional, it is learnt from the server.
+	TURNServer   string
+	TURNUsername string
+	TURNPassword string
+	TURNRealm    string
+	// MaxRedirects is the number of 300 (Try Alternate) redirects Discover
+	// follows, 3 if zero; negative does not follow them.
+	MaxRedirects int
+	// Hairpinning makes Discover test whether the NAT loops back
+	// datagrams sent to its own external address. It may add a few
+	// retransmission timeouts when the NAT does not.
+	Hairpinning bool
 }
 
 // NATS a class supports NAT type discovery feature.
@@ -75,6 +81,13 @@ type NATS struct {
 	dfErr              error  // filled by discoverFilteringBehavior
 	mappingLocalAddr   string // used for mapping behavior discovery
 	filteringLocalAddr string // used for filtering behavior discovery
+	auth               *clientAuth
+	turnServer         string
+	turnUsername       string
+	turnPassword       string
+	turnRealm          string
+	maxRedirects       int
+	hairpinning        bool
 }
 
 // NewNATS creats a new instance of NATS.
@@ -90,17 +103,39 @@ func NewNATS(config *Config) (*NATS, error) {
 		return nil, err
 	}
 
+	var turnServer string
+	if config.TURNServer != "" {
+		turnServer = formatHostPort(config.TURNServer, 3478)
+	}
+	maxRedirects := config.MaxRedirects
+	if maxRedirects == 0 {
+		maxRedirects = defaultMaxRedirects
+	}
+
 	return &NATS{
 		serverAddr:         serverAddr,
 		verbose:            config.Verbose,
 		net:                config.Net,
 		mappingLocalAddr:   config.MappingLocal,
 		filteringLocalAddr: config.FilteringLocal,
+		auth:               newClientAuth(config),
+		turnServer:         turnServer,
+		turnUsername:       config.TURNUsername,
+		turnPassword:       config.TURNPassword,
+		turnRealm:          config.TURNRealm,
+		maxRedirects:       maxRedirects,
+		hairpinning:        config.Hairpinning,
 	}, nil
 }
 
-// Discover performs NAT discovery process defined in RFC 5780.
+// Discover performs NAT discovery process defined in RFC 5780, following
+// the server's redirects.
 func (nats *NATS) Discover() (*DiscoverResult, error) {
+	return nats.followRedirects(nats.discoverOnce)
+}
+
+// discoverOnce is Discover against the current server.
+func (nats *NATS) discoverOnce() (*DiscoverResult, error) {
 	nats.dfErr = nil
 	localAddr := "0.0.0.0:0"
 	if nats.mappingLocalAddr != "" {
@@ -117,63 +152,81 @@ func (nats *NATS) Discover() (*DiscoverResult, error) {
 		log.Printf("Local port: %d", locAddr.Port)
 	}
 
-	c, err := turn.NewClient(&turn.ClientConfig{
-		STUNServerAddr: nats.serverAddr.String(),
-		Conn:           conn,
-		LoggerFactory:  logging.NewDefaultLoggerFactory(),
-		Net:            nats.net,
-	})
-	if err != nil {
-		return nil, err
+	if nats.verbose {
+		log.Printf("STUN server: %s", nats.serverAddr.String())
 	}
 
-	err = c.Listen()
+	res, err := nats.discover(ownConn(conn, 0), locAddr, nats.discoverFilteringBehavior)
 	if err != nil {
 		return nil, err
 	}
 
-	if nats.verbose {
-		log.Printf("STUN server: %s", c.STUNServerAddr().String())
+	if nats.turnServer != "" {
+		if res.TURN, err = nats.CheckTURN(); err != nil {
+			return nil, err
+		}
 	}
 
-	toAddrs := [4]*net.UDPAddr{c.STUNServerAddr().(*net.UDPAddr), nil, nil, nil}
-	mappedAddrs := [4]*net.UDPAddr{nil, nil, nil, nil}
-
-	res := &DiscoverResult{}
+	return res, nil
+}
 
-	// Run filtering behavior disocvery in parallel
-	filterDiscovDone, err := nats.discoverFilteringBehavior()
-	if err != nil {
-		return nil, err
+// DiscoverOn performs NAT discovery over sockets the application keeps
+// using, so the result holds for exactly those sockets. The mapping tests
+// run on mappingConn; the filtering tests need a second socket and are
+// skipped (FilteringBehavior is EndpointUndefined) when filteringConn is nil.
+//
+// The application must keep reading from the SharedConns while discovery
+// runs, since that is what delivers the responses.
+func (nats *NATS) DiscoverOn(mappingConn, filteringConn *SharedConn) (*DiscoverResult, error) {
+	locAddr, ok := mappingConn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return nil, fmt.Errorf("not a UDP socket: %s", mappingConn.LocalAddr().String())
 	}
+	return nats.followRedirects(func() (*DiscoverResult, error) {
+		nats.dfErr = nil
+		var startFiltering func() (<-chan EndpointDependencyType, error)
+		if filteringConn != nil {
+			startFiltering = func() (<-chan EndpointDependencyType, error) {
+				return nats.filteringBehaviorWith(filteringConn, nil), nil
+			}
+		}
+		return nats.discover(mappingConn, locAddr, startFiltering)
+	})
+}
+
+// discover runs the mapping tests through t, whose socket is bound to
+// locAddr, and combines them with the result of the filtering tests, run in
+// parallel by startFiltering (nil if they do not run).
+func (nats *NATS) discover(t transactor, locAddr *net.UDPAddr, startFiltering func() (<-chan EndpointDependencyType, error)) (*DiscoverResult, error) {
+	var filterDone <-chan EndpointDependencyType
+	toAddrs := [4]*net.UDPAddr{nats.serverAddr.(*net.UDPAddr), nil, nil, nil}
+	mappedAddrs := [4]*net.UDPAddr{nil, nil, nil, nil}
+
+	res := &DiscoverResult{Version: ResultVersion}
 
 	// Mapping behavior desicovery
 
 	for i := 0; i < len(toAddrs); i++ {
 		to := toAddrs[i]
-		attrs := []stun.Setter{
+		resMsg, _, err := nats.performTransaction(t, to,
 			stun.TransactionID,
 			stun.BindingRequest,
+		)
+		if i == 0 && err == errTransactionTimeout {
+			// No response at all: UDP is blocked
+			res.MappingBehavior = EndpointUndefined
+			res.FilteringBehavior = EndpointUndefined
+			res.NATType = Blocked
+			return res, nil
 		}
-
-		msg, err := stun.Build(attrs...)
 		if err != nil {
 			return nil, err
 		}
 
-		trRes, err := c.PerformTransaction(msg, to, false)
-		if err != nil {
+		if mappedAddrs[i], err = getMappedAddress(resMsg); err != nil {
 			return nil, err
 		}
 
-		var maddr stun.XORMappedAddress
-		if err = maddr.GetFrom(trRes.Msg); err != nil {
-			if err != nil {
-				return nil, fmt.Errorf("XOR-MAPPED-ADDRESS not found")
-			}
-		}
-		mappedAddrs[i] = &net.UDPAddr{IP: maddr.IP, Port: maddr.Port}
-
 		if nats.verbose {
 			log.Printf("MAPPED-ADDRESS [%d]: %s", i, mappedAddrs[i].String())
 		}
@@ -184,11 +237,9 @@ func (nats *NATS) Discover() (*DiscoverResult, error) {
 			res.ExternalIP = mappedAddrs[0].IP.String()
 			res.ExternalPort = strconv.Itoa(mappedAddrs[0].Port)
 
-			var caddr attrAddress
-			if err = caddr.getAs(trRes.Msg, attrTypeChangedAddress); err != nil {
-				if err != nil {
-					return nil, fmt.Errorf("CHANGED-ADDRESS not found")
-				}
+			caddr, err := getChangedAddress(resMsg)
+			if err != nil {
+				return nil, err
 			}
 
 			if nats.verbose {
@@ -199,6 +250,14 @@ func (nats *NATS) Discover() (*DiscoverResult, error) {
 			toAddrs[2] = &net.UDPAddr{IP: caddr.IP, Port: toAddrs[0].Port}
 			toAddrs[3] = &net.UDPAddr{IP: caddr.IP, Port: caddr.Port}
 
+			// Only start the filtering tests once the server answered
+			// rather than redirected
+			if startFiltering != nil {
+				if filterDone, err = startFiltering(); err != nil {
+					return nil, err
+				}
+			}
+
 			continue
 		}
 	}
@@ -215,10 +274,29 @@ func (nats *NATS) Discover() (*DiscoverResult, error) {
 		}
 	}
 
+	// Hairpinning only matters behind a NAT
+	var hairpinDone chan error
+	if res.IsNatted && nats.hairpinning {
+		hairpinDone = make(chan error, 1)
+		go func() {
+			var err error
+			res.Hairpinning, err = nats.discoverHairpinning()
+			hairpinDone <- err
+		}()
+	}
+
 	// Wait for filtering behavior disocvery to complete
-	res.FilteringBehavior = <-filterDiscovDone
-	if nats.dfErr != nil {
-		return nil, nats.dfErr
+	res.FilteringBehavior = EndpointUndefined
+	if filterDone != nil {
+		res.FilteringBehavior = <-filterDone
+		if nats.dfErr != nil {
+			return nil, nats.dfErr
+		}
+	}
+	if hairpinDone != nil {
+		if err := <-hairpinDone; err != nil {
+			return nil, err
+		}
 	}
 
 	// Determine the NAT type
@@ -232,16 +310,19 @@ func (nats *NATS) Discover() (*DiscoverResult, error) {
 			case EndpointAddrPortDependent:
 				res.NATType = RestricPortNAT
 			default:
-				res.NATType = "undefined"
+				res.NATType = NATTypeUndefined
 			}
 		} else {
 			res.NATType = SymmetricNAT
 		}
 	} else {
-		if res.FilteringBehavior == EndpointIndependent {
+		switch res.FilteringBehavior {
+		case EndpointIndependent:
 			res.NATType = OpenInternet
-		} else {
-			res.NATType = Blocked
+		case EndpointUndefined:
+			res.NATType = NATTypeUndefined
+		default:
+			res.NATType = SymmetricUDPFirewall
 		}
 	}
 
@@ -259,6 +340,44 @@ func (nats *NATS) findIsLocalIP(ip net.IP) bool {
 	return true
 }
 
+// discoverHairpinning reports whether the NAT loops back a datagram sent to
+// a socket's own external address.
+//
+// RFC 5780 Section 4.5
+func (nats *NATS) discoverHairpinning() (bool, error) {
+	conn, err := nats.net.ListenPacket("udp4", "0.0.0.0:0")
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	mapped, err := nats.reflexiveAddr(conn, nats.serverAddr, true)
+	if err != nil {
+		return false, err
+	}
+
+	msg, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+	if err != nil {
+		return false, err
+	}
+	for i := 0; i < probeAttempts; i++ {
+		if _, err = conn.WriteTo(msg.Raw, mapped); err != nil {
+			return false, err
+		}
+		looped, _, err := readResponse(conn, msg.TransactionID, probeTimeout)
+		if err != nil {
+			return false, err
+		}
+		if looped != nil {
+			if nats.verbose {
+				log.Printf("hairpinning via %s", mapped.String())
+			}
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func (nats *NATS) discoverFilteringBehavior() (<-chan EndpointDependencyType, error) {
 	localAddr := "0.0.0.0:0"
 	if nats.filteringLocalAddr != "" {
@@ -274,32 +393,27 @@ func (nats *NATS) discoverFilteringBehavior() (<-chan EndpointDependencyType, er
 		log.Printf("Local port: %d (for filtering discovery)", locAddr.Port)
 	}
 
-	c, err := turn.NewClient(&turn.ClientConfig{
-		STUNServerAddr: nats.serverAddr.String(),
-		Conn:           conn,
-		LoggerFactory:  logging.NewDefaultLoggerFactory(),
-	})
-	if err != nil {
-		return nil, err
-	}
-
-	err = c.Listen()
-	if err != nil {
-		return nil, err
-	}
+	return nats.filteringBehaviorWith(ownConn(conn, 0), func() {
+		conn.Close() // nolint:errcheck,gosec
+	}), nil
+}
 
-	done := make(chan EndpointDependencyType)
+// filteringBehaviorWith runs the filtering tests through t in the background
+// and calls cleanup (if not nil) when they are done.
+func (nats *NATS) filteringBehaviorWith(t transactor, cleanup func()) <-chan EndpointDependencyType {
+	done := make(chan EndpointDependencyType, 1)
 
 	go func() {
-		defer c.Close()
-		defer conn.Close()
+		if cleanup != nil {
+			defer cleanup()
+		}
 
-		received1Ch, err2 := nats.performTransactionWith(c, true, false)
+		received1Ch, err2 := nats.performTransactionWith(t, transactionOptions{changeIP: true})
 		if err2 != nil {
 			done <- EndpointUndefined
 			return
 		}
-		received2Ch, err2 := nats.performTransactionWith(c, false, true)
+		received2Ch, err2 := nats.performTransactionWith(t, transactionOptions{changePort: true})
 		if err2 != nil {
 			done <- EndpointUndefined
 			return
@@ -322,49 +436,75 @@ func (nats *NATS) discoverFilteringBehavior() (<-chan EndpointDependencyType, er
 		}
 	}()
 
-	return done, nil
+	return done
+}
+
+// transactor sends STUN requests over a client socket and waits for their
+// responses.
+type transactor interface {
+	transact(msg *stun.Message, to net.Addr) (*stun.Message, net.Addr, error)
+	WriteTo(p []byte, addr net.Addr) (int, error)
 }
 
-func (nats *NATS) performTransactionWith(c *turn.Client, changeIP, changePort bool) (<-chan bool, error) {
+// transactionOptions are the optional attributes of a binding request sent
+// by performTransactionWith.
+type transactionOptions struct {
+	changeIP   bool
+	changePort bool
+	// responsePort asks the server to reply to another local port
+	// (RESPONSE-PORT). The response is then read from recvConn, the socket
+	// bound to that port, instead of through the client.
+	responsePort int
+	recvConn     net.PacketConn
+}
+
+func (nats *NATS) performTransactionWith(t transactor, opts transactionOptions) (<-chan bool, error) {
 	attrs := []stun.Setter{
 		stun.TransactionID,
 		stun.BindingRequest,
+		&attrChangeRequest{
+			ChangeIP:   opts.changeIP,
+			ChangePort: opts.changePort,
+		},
 	}
 
-	msg, err := stun.Build(attrs...)
-	if err != nil {
-		return nil, err
-	}
-
-	err = (&attrChangeRequest{
-		ChangeIP:   changeIP,
-		ChangePort: changePort,
-	}).addAs(msg, attrTypeChangeRequest)
-	if err != nil {
-		return nil, err
+	if opts.responsePort != 0 {
+		if opts.recvConn == nil {
+			return nil, fmt.Errorf("RESPONSE-PORT requires a receiving socket")
+		}
+		attrs = append(attrs, &attrResponsePort{Port: opts.responsePort})
 	}
 
 	receivedCh := make(chan bool)
 
 	go func() {
-		res, err := c.PerformTransaction(msg, c.STUNServerAddr(), false)
-		if err != nil {
+		var resFrom net.Addr
+		var err error
+		if opts.responsePort != 0 {
+			_, resFrom, err = nats.sendAndReceive(t, opts.recvConn, attrs...)
+		} else {
+			_, resFrom, err = nats.performTransaction(t, nats.serverAddr, attrs...)
+		}
+		if err != nil || resFrom == nil {
 			receivedCh <- false
 			return
 		}
+		from := resFrom.(*net.UDPAddr)
 
 		// Check if CHANGE-REQUEST was servered by the server
-		from := res.From.(*net.UDPAddr)
-		if changeIP {
-			if from.IP.Equal(c.STUNServerAddr().(*net.UDPAddr).IP) {
+		serverAddr := nats.serverAddr.(*net.UDPAddr)
+		if opts.changeIP {
+			if from.IP.Equal(serverAddr.IP) {
 				nats.dfErr = fmt.Errorf("CHANGE-REQUEST ignored (IP)")
 				receivedCh <- false
+				return
 			}
 		}
-		if changePort {
-			if from.Port == c.STUNServerAddr().(*net.UDPAddr).Port {
+		if opts.changePort {
+			if from.Port == serverAddr.Port {
 				nats.dfErr = fmt.Errorf("CHANGE-REQUEST ignored (Port)")
 				receivedCh <- false
+				return
 			}
 		}
 
@@ -374,6 +514,64 @@ func (nats *NATS) performTransactionWith(c *turn.Client, changeIP, changePort bo
 	return receivedCh, nil
 }
 
+// sendAndReceive builds a request from attrs, sends it through t and waits
+// for its response on recvConn, retransmitting a few times. A nil message
+// means no response came back.
+func (nats *NATS) sendAndReceive(t transactor, recvConn net.PacketConn, attrs ...stun.Setter) (*stun.Message, net.Addr, error) {
+	msg, err := nats.buildRequest(attrs...)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := 0; i < probeAttempts; i++ {
+		if _, err = t.WriteTo(msg.Raw, nats.serverAddr); err != nil {
+			return nil, nil, err
+		}
+		res, from, err := readResponse(recvConn, msg.TransactionID, probeTimeout)
+		if err != nil {
+			return nil, nil, err
+		}
+		if res == nil {
+			continue
+		}
+		retry, err := nats.checkResponse(msg, res)
+		if err != nil {
+			return nil, nil, err
+		}
+		if retry {
+			if msg, err = nats.buildRequest(attrs...); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		return res, from, nil
+	}
+	return nil, nil, nil
+}
+
+// readResponse reads from conn until the response to transactionID arrives
+// or timeout elapses, in which case it returns a nil message. Unrelated
+// datagrams are discarded.
+func readResponse(conn net.PacketConn, transactionID [stun.TransactionIDSize]byte, timeout time.Duration) (*stun.Message, net.Addr, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, nil, err
+	}
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				return nil, nil, nil
+			}
+			return nil, nil, err
+		}
+		res := &stun.Message{Raw: append([]byte{}, buf[:n]...)}
+		if res.Decode() != nil || res.TransactionID != transactionID {
+			continue // stale or foreign datagram
+		}
+		return res, from, nil
+	}
+}
+
 // Appends default port number if the given host name does not have it.
 func formatHostPort(host string, defaultPort int) string {
 	_, _, err := net.SplitHostPort(host)
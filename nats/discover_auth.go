@@ -0,0 +1,182 @@
+package nats
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/pion/stun"
+)
+
+// clientAuth signs requests with the credentials from Config.
+type clientAuth struct {
+	username  string
+	password  string
+	longTerm  bool
+	useSHA256 bool
+
+	mutex sync.Mutex
+	realm stun.Realm // learnt from 401/438, long-term only
+	nonce stun.Nonce // learnt from 401/438, long-term only
+}
+
+func newClientAuth(config *Config) *clientAuth {
+	if config.Username == "" {
+		return nil
+	}
+	return &clientAuth{
+		username:  config.Username,
+		password:  config.Password,
+		longTerm:  config.LongTermAuth,
+		useSHA256: config.UseSHA256,
+	}
+}
+
+// key returns the integrity setter for the current realm.
+func (a *clientAuth) key() stun.Setter {
+	a.mutex.Lock()
+	realm := a.realm.String()
+	a.mutex.Unlock()
+
+	switch {
+	case a.longTerm && a.useSHA256:
+		return newLongTermIntegritySHA256(a.username, realm, a.password)
+	case a.longTerm:
+		return stun.NewLongTermIntegrity(a.username, realm, a.password)
+	case a.useSHA256:
+		return messageIntegritySHA256(a.password)
+	}
+	return stun.NewShortTermIntegrity(a.password)
+}
+
+// sign adds USERNAME, REALM and NONCE (if known) and the integrity attribute
+// to msg. For long-term credentials without a nonce yet, msg is left unsigned
+// so the server answers with a challenge.
+func (a *clientAuth) sign(msg *stun.Message) error {
+	a.mutex.Lock()
+	realm, nonce := a.realm, a.nonce
+	a.mutex.Unlock()
+
+	if a.longTerm && len(nonce) == 0 {
+		return nil
+	}
+	setters := []stun.Setter{stun.NewUsername(a.username)}
+	if a.longTerm {
+		setters = append(setters, realm, nonce)
+	}
+	setters = append(setters, a.key())
+	for _, s := range setters {
+		if err := s.AddTo(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateChallenge records the REALM and NONCE of a 401 or 438 response to req
+// and reports whether the request is worth retrying.
+func (a *clientAuth) updateChallenge(req, res *stun.Message) bool {
+	if !a.longTerm {
+		return false
+	}
+	var code stun.ErrorCodeAttribute
+	if err := code.GetFrom(res); err != nil {
+		return false
+	}
+	if code.Code != stun.CodeUnauthorized && code.Code != stun.CodeStaleNonce {
+		return false
+	}
+	var realm stun.Realm
+	var nonce stun.Nonce
+	if realm.GetFrom(res) != nil || nonce.GetFrom(res) != nil {
+		return false
+	}
+
+	// A 401 although req carried the nonce means the password is wrong.
+	var used stun.Nonce
+	if code.Code == stun.CodeUnauthorized && used.GetFrom(req) == nil {
+		return false
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.realm = append(stun.Realm{}, realm...)
+	a.nonce = append(stun.Nonce{}, nonce...)
+	return true
+}
+
+// verify checks the integrity of a success response.
+func (a *clientAuth) verify(res *stun.Message) error {
+	if !res.Contains(stun.AttrMessageIntegrity) && !res.Contains(attrTypeMessageIntegritySHA256) {
+		return errors.New("response is not signed")
+	}
+	return a.key().(integrityChecker).Check(res)
+}
+
+// buildRequest builds a binding request from attrs, signed when credentials
+// are configured. attrs should start with stun.TransactionID so every call
+// gets a fresh transaction.
+func (nats *NATS) buildRequest(attrs ...stun.Setter) (*stun.Message, error) {
+	msg, err := stun.Build(attrs...)
+	if err != nil {
+		return nil, err
+	}
+	if nats.auth != nil {
+		if err = nats.auth.sign(msg); err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+// checkResponse turns an error response to req into an error and verifies
+// the integrity of a success response. retry is true when the request should
+// be rebuilt and sent again after an authentication challenge.
+func (nats *NATS) checkResponse(req, res *stun.Message) (retry bool, err error) {
+	if res.Type.Class == stun.ClassErrorResponse {
+		if nats.auth != nil && nats.auth.updateChallenge(req, res) {
+			return true, nil
+		}
+		if err = nats.checkRedirect(req, res); err != nil {
+			return false, err
+		}
+		var code stun.ErrorCodeAttribute
+		if err = code.GetFrom(res); err == nil {
+			return false, fmt.Errorf("%s (error %s)", res.Type, code)
+		}
+		return false, fmt.Errorf("%s", res.Type)
+	}
+	if nats.auth != nil {
+		if err = nats.auth.verify(res); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// performTransaction builds a binding request from attrs and performs it
+// through t, answering authentication challenges if needed.
+func (nats *NATS) performTransaction(t transactor, to net.Addr, attrs ...stun.Setter) (*stun.Message, net.Addr, error) {
+	for attempt := 0; ; attempt++ {
+		msg, err := nats.buildRequest(attrs...)
+		if err != nil {
+			return nil, nil, err
+		}
+		resMsg, from, err := t.transact(msg, to)
+		if err != nil {
+			return nil, nil, err
+		}
+		retry, err := nats.checkResponse(msg, resMsg)
+		if err != nil {
+			return nil, nil, err
+		}
+		if retry && attempt < 2 {
+			continue
+		}
+		if retry {
+			return nil, nil, errors.New("authentication failed")
+		}
+		return resMsg, from, nil
+	}
+}
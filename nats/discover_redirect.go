@@ -0,0 +1,80 @@
+package nats
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/pion/stun"
+)
+
+// defaultMaxRedirects is the number of redirects Discover follows when
+// Config.MaxRedirects is zero.
+const defaultMaxRedirects = 3
+
+// RedirectError is returned when the server answers with 300 (Try
+// Alternate). Discover follows it; the other tests return it.
+type RedirectError struct {
+	// Alternate is the ALTERNATE-SERVER of the response.
+	Alternate *net.UDPAddr
+}
+
+func (e *RedirectError) Error() string {
+	return "redirected to " + e.Alternate.String()
+}
+
+// checkRedirect returns a RedirectError if res redirects req, nil if it
+// is not a redirect. A redirect of a signed request must be signed too.
+//
+// RFC 5389 Section 11
+func (nats *NATS) checkRedirect(req, res *stun.Message) error {
+	var code stun.ErrorCodeAttribute
+	if err := code.GetFrom(res); err != nil || code.Code != stun.CodeTryAlternate {
+		return nil
+	}
+	var alternate stun.AlternateServer
+	if err := alternate.GetFrom(res); err != nil {
+		return fmt.Errorf("%s without ALTERNATE-SERVER", code)
+	}
+	signed := req.Contains(stun.AttrMessageIntegrity) || req.Contains(attrTypeMessageIntegritySHA256)
+	if nats.auth != nil && signed {
+		if err := nats.auth.verify(res); err != nil {
+			return fmt.Errorf("redirect: %s", err.Error())
+		}
+	}
+	return &RedirectError{Alternate: &net.UDPAddr{IP: alternate.IP, Port: alternate.Port}}
+}
+
+// followRedirects runs discover against the server, and again against
+// each alternate it is redirected to, up to maxRedirects times. A server
+// redirecting back to one already tried is a loop and fails the discovery.
+// The configured server is used again by the next call.
+func (nats *NATS) followRedirects(discover func() (*DiscoverResult, error)) (*DiscoverResult, error) {
+	server := nats.serverAddr
+	defer func() { nats.serverAddr = server }()
+
+	visited := map[string]bool{server.String(): true}
+	for redirects := 0; ; redirects++ {
+		res, err := discover()
+		var redirect *RedirectError
+		if !errors.As(err, &redirect) || nats.maxRedirects < 0 {
+			if err == nil && redirects > 0 {
+				res.Server = nats.serverAddr.String()
+			}
+			return res, err
+		}
+		if redirects >= nats.maxRedirects {
+			return nil, fmt.Errorf("too many redirects, last to %s", redirect.Alternate.String())
+		}
+		if visited[redirect.Alternate.String()] {
+			return nil, fmt.Errorf("redirect loop: %s sent us back to %s",
+				nats.serverAddr.String(), redirect.Alternate.String())
+		}
+		visited[redirect.Alternate.String()] = true
+		if nats.verbose {
+			log.Printf("%s redirects to %s", nats.serverAddr.String(), redirect.Alternate.String())
+		}
+		nats.serverAddr = redirect.Alternate
+	}
+}
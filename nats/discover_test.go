@@ -1,295 +1,499 @@
 package nats
 
 import (
-	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/pion/logging"
+	"github.com/pion/stun"
 	"github.com/pion/transport/vnet"
 	"github.com/stretchr/testify/assert"
 )
 
 type virtualNet struct {
-	wan    *vnet.Router
-	net0   *vnet.Net
-	server *STUNServer
+	wan     *vnet.Router
+	net0    *vnet.Net
+	nets    []*vnet.Net // one per LAN, nets[0] == net0
+	server  *STUNServer
+	cleanup []func()
 }
 
 func (v *virtualNet) close() {
 	v.server.Close() // nolint:errcheck,gosec
-	v.wan.Stop()     // nolint:errcheck,gosec
+	for _, f := range v.cleanup {
+		f()
+	}
+	v.wan.Stop() // nolint:errcheck,gosec
 }
 
 func buildVNet(natType *vnet.NATType) (*virtualNet, error) {
-	loggerFactory := logging.NewDefaultLoggerFactory()
-
-	// WAN
-	wan, err := vnet.NewRouter(&vnet.RouterConfig{
-		CIDR:          "0.0.0.0/0",
-		LoggerFactory: loggerFactory,
-	})
-	if err != nil {
-		return nil, err
-	}
+	return buildVNetWithServer(natType, &STUNServerConfig{})
+}
 
-	wanNet := vnet.NewNet(&vnet.NetConfig{
-		StaticIPs: []string{"1.2.3.4", "1.2.3.5"},
-	})
+// buildVNetWithServer is buildVNet with extra server settings; addresses,
+// role and network are filled in.
+func buildVNetWithServer(natType *vnet.NATType, config *STUNServerConfig) (*virtualNet, error) {
+	return buildVNetLANs(config, natType)
+}
 
-	err = wan.AddNet(wanNet)
+// buildVNetLANs builds one LAN per NAT type; LAN i is 192.168.i.0/24 behind
+// the router at 27.1.1.(i+1), or a public host at 27.1.1.(i+1) if its NAT
+// type is nil.
+func buildVNetLANs(config *STUNServerConfig, natTypes ...*vnet.NATType) (*virtualNet, error) {
+	v, serverNets, err := buildTopology([][]string{{"1.2.3.4", "1.2.3.5"}}, natTypes...)
 	if err != nil {
 		return nil, err
 	}
 
-	err = wan.AddHost("stun.pion.net", "1.2.3.4")
+	// Run STUN server
+	config.PrimaryAddress = "1.2.3.4:3478"
+	config.SecondaryAddress = "1.2.3.5:3479"
+	config.Net = serverNets[0]
+	config.Role = "both"
+	v.server, err = NewSTUNServer(config)
 	if err != nil {
 		return nil, err
 	}
 
-	// LAN 0
-	lan0, err := vnet.NewRouter(&vnet.RouterConfig{
-		StaticIP:      "27.1.1.1", // this router's external IP on eth0
-		CIDR:          "192.168.0.0/24",
-		NATType:       natType,
-		LoggerFactory: loggerFactory,
-	})
+	err = v.server.Start()
 	if err != nil {
 		return nil, err
 	}
 
-	net0 := vnet.NewNet(&vnet.NetConfig{})
-	err = lan0.AddNet(net0)
+	return v, nil
+}
+
+// buildVNetSplitRole is buildVNet with the primary and secondary addresses
+// on separate hosts, running as "pri" and "sec" servers linked by the HTTP
+// relay.
+func buildVNetSplitRole(natType *vnet.NATType) (*virtualNet, error) {
+	return buildVNetSplitRoleWith(natType, &STUNServerConfig{})
+}
+
+// buildVNetSplitRoleWith is buildVNetSplitRole with extra settings for
+// both servers; addresses, roles and networks are filled in.
+func buildVNetSplitRoleWith(natType *vnet.NATType, config *STUNServerConfig) (*virtualNet, error) {
+	v, serverNets, err := buildTopology([][]string{{"1.2.3.4"}, {"1.2.3.5"}}, natType)
 	if err != nil {
 		return nil, err
 	}
 
-	err = wan.AddRouter(lan0)
+	secConfig := *config
+	secConfig.PrimaryAddress = "1.2.3.4:3478"
+	secConfig.SecondaryAddress = "1.2.3.5:3479"
+	secConfig.Net = serverNets[1]
+	secConfig.Role = "sec"
+	sec, err := NewSTUNServer(&secConfig)
 	if err != nil {
 		return nil, err
 	}
-
-	// Start routers
-	err = wan.Start()
-	if err != nil {
+	if err = sec.Start(); err != nil {
 		return nil, err
 	}
-
-	// Run STUN server
-	server, err := NewSTUNServer(&STUNServerConfig{
-		PrimaryAddress:   "1.2.3.4:3478",
-		SecondaryAddress: "1.2.3.5:3479",
-		Net:              wanNet,
+	relay := httptest.NewServer(http.HandlerFunc(sec.priToSecHandler))
+	v.cleanup = append(v.cleanup, relay.Close, func() {
+		sec.Close() // nolint:errcheck,gosec
 	})
+
+	priConfig := *config
+	priConfig.PrimaryAddress = "1.2.3.4:3478"
+	priConfig.SecondaryAddress = "1.2.3.5:3479"
+	priConfig.Net = serverNets[0]
+	priConfig.Role = "pri"
+	priConfig.Pri2SecHost = relay.Listener.Addr().String()
+	v.server, err = NewSTUNServer(&priConfig)
 	if err != nil {
 		return nil, err
 	}
-
-	err = server.Start()
-	if err != nil {
+	if err = v.server.Start(); err != nil {
 		return nil, err
 	}
 
-	return &virtualNet{
-		wan:    wan,
-		net0:   net0,
-		server: server,
-	}, nil
+	return v, nil
 }
 
-func TestDiscoverOnVNet(t *testing.T) {
+// buildTopology starts a WAN with one server host per entry of serverIPs
+// and the LANs of buildVNetLANs. "stun.pion.net" resolves to 1.2.3.4.
+func buildTopology(serverIPs [][]string, natTypes ...*vnet.NATType) (*virtualNet, []*vnet.Net, error) {
 	loggerFactory := logging.NewDefaultLoggerFactory()
-	log := loggerFactory.NewLogger("test")
 
-	/*
-		t.Run("stun.sipgate.net", func(t *testing.T) {
-			res, err := Discover("stun.sipgate.net:3478", true)
-			assert.NoError(t, err, "should succeed")
-			assert.NotNil(t, res, "should not be nil")
-		})
-	*/
+	// WAN
+	wan, err := vnet.NewRouter(&vnet.RouterConfig{
+		CIDR:          "0.0.0.0/0",
+		LoggerFactory: loggerFactory,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
 
-	t.Run("Full cone NAT", func(t *testing.T) {
-		v, err := buildVNet(&vnet.NATType{
-			MappingBehavior:   vnet.EndpointIndependent,
-			FilteringBehavior: vnet.EndpointIndependent,
+	var serverNets []*vnet.Net
+	for _, ips := range serverIPs {
+		serverNet := vnet.NewNet(&vnet.NetConfig{
+			StaticIPs: ips,
 		})
-		if !assert.NoError(t, err, "should succeed") {
-			return
+		if err = wan.AddNet(serverNet); err != nil {
+			return nil, nil, err
 		}
-		defer v.close()
+		serverNets = append(serverNets, serverNet)
+	}
 
-		nats, err := NewNATS(&Config{
-			Server:  "stun.pion.net:3478",
-			Verbose: true,
-			Net:     v.net0,
-		})
-		assert.NoError(t, err, "should succeed")
-
-		res, err := nats.Discover()
-		assert.NoError(t, err, "should succeed")
-		assert.NotNil(t, res, "should not be nil")
-
-		bytes, err := json.MarshalIndent(res, "", "  ")
-		assert.NoError(t, err, "should succeed")
-		log.Debug(string(bytes))
-
-		assert.True(t, res.IsNatted, "should be natted")
-		assert.Equal(t, EndpointIndependent, res.MappingBehavior, "should match")
-		assert.Equal(t, EndpointIndependent, res.FilteringBehavior, "should match")
-		assert.False(t, res.PortPreservation, "should not be port preserved")
-		assert.Equal(t, "Full cone NAT", res.NATType, "should match")
-		assert.Equal(t, "27.1.1.1", res.ExternalIP, "should match")
-	})
+	err = wan.AddHost("stun.pion.net", "1.2.3.4")
+	if err != nil {
+		return nil, nil, err
+	}
 
-	t.Run("Restricted cone NAT", func(t *testing.T) {
-		v, err := buildVNet(&vnet.NATType{
-			MappingBehavior:   vnet.EndpointIndependent,
-			FilteringBehavior: vnet.EndpointAddrDependent,
-		})
-		if !assert.NoError(t, err, "should succeed") {
-			return
+	var nets []*vnet.Net
+	for i, natType := range natTypes {
+		externalIP := fmt.Sprintf("27.1.1.%d", i+1)
+		if natType == nil {
+			hostNet := vnet.NewNet(&vnet.NetConfig{
+				StaticIPs: []string{externalIP},
+			})
+			if err = wan.AddNet(hostNet); err != nil {
+				return nil, nil, err
+			}
+			nets = append(nets, hostNet)
+			continue
 		}
-		defer v.close()
 
-		nats, err := NewNATS(&Config{
-			Server:  "stun.pion.net:3478",
-			Verbose: true,
-			Net:     v.net0,
+		lan, err := vnet.NewRouter(&vnet.RouterConfig{
+			StaticIP:      externalIP, // this router's external IP on eth0
+			CIDR:          fmt.Sprintf("192.168.%d.0/24", i),
+			NATType:       natType,
+			LoggerFactory: loggerFactory,
 		})
-		if !assert.NoError(t, err, "should succeed") {
-			return
+		if err != nil {
+			return nil, nil, err
 		}
 
-		res, err := nats.Discover()
-		if !assert.NoError(t, err, "should succeed") {
-			return
+		lanNet := vnet.NewNet(&vnet.NetConfig{})
+		err = lan.AddNet(lanNet)
+		if err != nil {
+			return nil, nil, err
 		}
-		assert.NotNil(t, res, "should not be nil")
-
-		bytes, err := json.MarshalIndent(res, "", "  ")
-		assert.NoError(t, err, "should succeed")
-		log.Debug(string(bytes))
-
-		log.Debugf("%+v", res)
-		assert.True(t, res.IsNatted, "should be natted")
-		assert.Equal(t, EndpointIndependent, res.MappingBehavior, "should match")
-		assert.Equal(t, EndpointAddrDependent, res.FilteringBehavior, "should match")
-		assert.False(t, res.PortPreservation, "should not be port preserved")
-		assert.Equal(t, "Address-restricted cone NAT", res.NATType, "should match")
-		assert.Equal(t, "27.1.1.1", res.ExternalIP, "should match")
-	})
 
-	t.Run("Port-restricted cone NAT", func(t *testing.T) {
-		v, err := buildVNet(&vnet.NATType{
-			MappingBehavior:   vnet.EndpointIndependent,
-			FilteringBehavior: vnet.EndpointAddrPortDependent,
-		})
-		if !assert.NoError(t, err, "should succeed") {
-			return
+		err = wan.AddRouter(lan)
+		if err != nil {
+			return nil, nil, err
 		}
-		defer v.close()
+		nets = append(nets, lanNet)
+	}
 
-		nats, err := NewNATS(&Config{
-			Server:  "stun.pion.net:3478",
-			Verbose: true,
-			Net:     v.net0,
-		})
-		if !assert.NoError(t, err, "should succeed") {
-			return
-		}
+	// Start routers
+	err = wan.Start()
+	if err != nil {
+		return nil, nil, err
+	}
 
-		res, err := nats.Discover()
-		if !assert.NoError(t, err, "should succeed") {
-			return
-		}
-		assert.NotNil(t, res, "should not be nil")
-
-		bytes, err := json.MarshalIndent(res, "", "  ")
-		assert.NoError(t, err, "should succeed")
-		log.Debug(string(bytes))
-
-		log.Debugf("%+v", res)
-		assert.True(t, res.IsNatted, "should be natted")
-		assert.Equal(t, EndpointIndependent, res.MappingBehavior, "should match")
-		assert.Equal(t, EndpointAddrPortDependent, res.FilteringBehavior, "should match")
-		assert.False(t, res.PortPreservation, "should not be port preserved")
-		assert.Equal(t, "Port-restricted cone NAT", res.NATType, "should match")
-		assert.Equal(t, "27.1.1.1", res.ExternalIP, "should match")
-	})
+	return &virtualNet{
+		wan:  wan,
+		net0: nets[0],
+		nets: nets,
+	}, serverNets, nil
+}
 
-	t.Run("Symmetric NAT", func(t *testing.T) {
-		v, err := buildVNet(&vnet.NATType{
-			MappingBehavior:   vnet.EndpointAddrPortDependent,
-			FilteringBehavior: vnet.EndpointAddrPortDependent,
-		})
-		if !assert.NoError(t, err, "should succeed") {
-			return
-		}
-		defer v.close()
+func TestDiscoverOnVNet(t *testing.T) {
+	behaviors := []struct {
+		vnet vnet.EndpointDependencyType
+		nats EndpointDependencyType
+	}{
+		{vnet.EndpointIndependent, EndpointIndependent},
+		{vnet.EndpointAddrDependent, EndpointAddrDependent},
+		{vnet.EndpointAddrPortDependent, EndpointAddrPortDependent},
+	}
+	coneTypes := map[EndpointDependencyType]NATType{
+		EndpointIndependent:       FullCone,
+		EndpointAddrDependent:     RestricNAT,
+		EndpointAddrPortDependent: RestricPortNAT,
+	}
 
-		nats, err := NewNATS(&Config{
-			Server:  "stun.pion.net:3478",
-			Verbose: true,
-			Net:     v.net0,
-		})
-		if !assert.NoError(t, err, "should succeed") {
-			return
+	type discoverTest struct {
+		name     string
+		natType  *vnet.NATType // nil: public host
+		blocked  bool
+		firewall bool // the public host sits behind a stateful firewall
+		split    bool // primary and secondary run as separate servers
+		hairpin  bool // Config.Hairpinning
+
+		isNatted         bool
+		mapping          EndpointDependencyType
+		filtering        EndpointDependencyType
+		wantType         NATType
+		externalIP       string
+		portPreservation bool
+		hairpinning      bool
+	}
+
+	var tests []discoverTest
+	for _, split := range []bool{false, true} {
+		for _, m := range behaviors {
+			for _, f := range behaviors {
+				test := discoverTest{
+					name: fmt.Sprintf("mapping %s, filtering %s", m.nats, f.nats),
+					natType: &vnet.NATType{
+						MappingBehavior:   m.vnet,
+						FilteringBehavior: f.vnet,
+					},
+					split:      split,
+					isNatted:   true,
+					mapping:    m.nats,
+					filtering:  f.nats,
+					wantType:   SymmetricNAT,
+					externalIP: "27.1.1.1",
+				}
+				if m.nats == EndpointIndependent {
+					test.wantType = coneTypes[f.nats]
+				}
+				if split {
+					test.name = "split role, " + test.name
+				}
+				tests = append(tests, test)
+			}
 		}
+	}
+	tests = append(tests,
+		discoverTest{
+			name:             "no NAT",
+			mapping:          EndpointIndependent,
+			filtering:        EndpointIndependent,
+			wantType:         OpenInternet,
+			externalIP:       "27.1.1.1",
+			portPreservation: true,
+		},
+		discoverTest{
+			name:             "symmetric UDP firewall",
+			firewall:         true,
+			mapping:          EndpointIndependent,
+			filtering:        EndpointAddrPortDependent,
+			wantType:         SymmetricUDPFirewall,
+			externalIP:       "27.1.1.1",
+			portPreservation: true,
+		},
+		discoverTest{
+			name: "blocked",
+			natType: &vnet.NATType{
+				MappingBehavior:   vnet.EndpointIndependent,
+				FilteringBehavior: vnet.EndpointIndependent,
+			},
+			blocked:   true,
+			mapping:   EndpointUndefined,
+			filtering: EndpointUndefined,
+			wantType:  Blocked,
+		},
+		// vnet routes a datagram to the NAT's external address back in
+		// through the WAN: it reaches the same mapping unless the mapping
+		// is symmetric, whose new port the filter drops.
+		discoverTest{
+			name: "hairpinning",
+			natType: &vnet.NATType{
+				MappingBehavior:   vnet.EndpointIndependent,
+				FilteringBehavior: vnet.EndpointAddrPortDependent,
+			},
+			hairpin:     true,
+			isNatted:    true,
+			mapping:     EndpointIndependent,
+			filtering:   EndpointAddrPortDependent,
+			wantType:    RestricPortNAT,
+			externalIP:  "27.1.1.1",
+			hairpinning: true,
+		},
+		discoverTest{
+			name: "no hairpinning",
+			natType: &vnet.NATType{
+				MappingBehavior:   vnet.EndpointAddrPortDependent,
+				FilteringBehavior: vnet.EndpointAddrPortDependent,
+			},
+			hairpin:    true,
+			isNatted:   true,
+			mapping:    EndpointAddrPortDependent,
+			filtering:  EndpointAddrPortDependent,
+			wantType:   SymmetricNAT,
+			externalIP: "27.1.1.1",
+		},
+	)
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			var v *virtualNet
+			var err error
+			if test.split {
+				v, err = buildVNetSplitRole(test.natType)
+			} else {
+				v, err = buildVNetLANs(&STUNServerConfig{}, test.natType)
+			}
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+			defer v.close()
+			if test.blocked {
+				v.wan.AddChunkFilter(func(vnet.Chunk) bool { return false })
+			}
+			if test.firewall {
+				v.wan.AddChunkFilter(statefulFirewall("27.1.1.1"))
+			}
+
+			nats, err := NewNATS(&Config{
+				Server:      "stun.pion.net:3478",
+				Verbose:     true,
+				Net:         v.net0,
+				Hairpinning: test.hairpin,
+			})
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+
+			res, err := nats.Discover()
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+
+			assert.Equal(t, test.isNatted, res.IsNatted, "should match")
+			assert.Equal(t, test.mapping, res.MappingBehavior, "should match")
+			assert.Equal(t, test.filtering, res.FilteringBehavior, "should match")
+			assert.Equal(t, test.wantType, res.NATType, "should match")
+			assert.Equal(t, test.externalIP, res.ExternalIP, "should match")
+			if test.externalIP != "" {
+				assert.NotEmpty(t, res.ExternalPort, "should be set")
+			}
+			assert.Equal(t, test.portPreservation, res.PortPreservation, "should match")
+			assert.Equal(t, test.hairpinning, res.Hairpinning, "should match")
+		})
+	}
+}
 
-		res, err := nats.Discover()
-		if !assert.NoError(t, err, "should succeed") {
-			return
+// statefulFirewall returns a chunk filter that lets in datagrams to ip
+// only from the addresses ip has sent to from the same port.
+func statefulFirewall(ip string) func(vnet.Chunk) bool {
+	var mutex sync.Mutex
+	sent := map[string]bool{}
+	return func(c vnet.Chunk) bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		src, dst := c.SourceAddr().String(), c.DestinationAddr().String()
+		srcIP, _, _ := net.SplitHostPort(src)
+		dstIP, _, _ := net.SplitHostPort(dst)
+		switch ip {
+		case srcIP:
+			sent[src+"->"+dst] = true
+			return true
+		case dstIP:
+			return sent[dst+"->"+src]
 		}
-		assert.NotNil(t, res, "should not be nil")
-
-		bytes, err := json.MarshalIndent(res, "", "  ")
-		assert.NoError(t, err, "should succeed")
-		log.Debug(string(bytes))
-
-		log.Debugf("%+v", res)
-		assert.True(t, res.IsNatted, "should be natted")
-		assert.Equal(t, EndpointAddrPortDependent, res.MappingBehavior, "should match")
-		assert.Equal(t, EndpointAddrPortDependent, res.FilteringBehavior, "should match")
-		assert.False(t, res.PortPreservation, "should not be port preserved")
-		assert.Equal(t, "Symmetric NAT", res.NATType, "should match")
-		assert.Equal(t, "27.1.1.1", res.ExternalIP, "should match")
+		return true
+	}
+}
+
+func TestResponsePortOnVNet(t *testing.T) {
+	v, err := buildVNet(&vnet.NATType{
+		MappingBehavior:   vnet.EndpointIndependent,
+		FilteringBehavior: vnet.EndpointAddrPortDependent,
 	})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer v.close()
 
-	t.Run("Symmetric NAT 2", func(t *testing.T) {
-		v, err := buildVNet(&vnet.NATType{
-			MappingBehavior:   vnet.EndpointAddrDependent,
-			FilteringBehavior: vnet.EndpointAddrPortDependent,
+	nats, err := NewNATS(&Config{
+		Server:  "stun.pion.net:3478",
+		Verbose: true,
+		Net:     v.net0,
+	})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+
+	sendConn, err := v.net0.ListenPacket("udp4", "0.0.0.0:0")
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer sendConn.Close() // nolint:errcheck,gosec
+	recvConn, err := v.net0.ListenPacket("udp4", "0.0.0.0:0")
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer recvConn.Close() // nolint:errcheck,gosec
+
+	// Learn the external port of recvConn; this also opens its pinhole
+	// towards the primary address.
+	msg, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	_, err = recvConn.WriteTo(msg.Raw, nats.serverAddr)
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	res, _, err := readResponse(recvConn, msg.TransactionID, time.Second)
+	if !assert.NoError(t, err, "should succeed") || !assert.NotNil(t, res, "should respond") {
+		return
+	}
+	var mapped stun.XORMappedAddress
+	if !assert.NoError(t, mapped.GetFrom(res), "should succeed") {
+		return
+	}
+
+	c := ownConn(sendConn, 0)
+
+	t.Run("response to open pinhole", func(t *testing.T) {
+		receivedCh, err := nats.performTransactionWith(c, transactionOptions{
+			responsePort: mapped.Port,
+			recvConn:     recvConn,
 		})
 		if !assert.NoError(t, err, "should succeed") {
 			return
 		}
-		defer v.close()
+		assert.True(t, <-receivedCh, "should be received on the response port")
+	})
 
-		nats, err := NewNATS(&Config{
-			Server:  "stun.pion.net:3478",
-			Verbose: true,
-			Net:     v.net0,
+	t.Run("response from changed port is filtered", func(t *testing.T) {
+		receivedCh, err := nats.performTransactionWith(c, transactionOptions{
+			changePort:   true,
+			responsePort: mapped.Port,
+			recvConn:     recvConn,
 		})
 		if !assert.NoError(t, err, "should succeed") {
 			return
 		}
+		assert.False(t, <-receivedCh, "should be filtered by the NAT")
+	})
 
-		res, err := nats.Discover()
-		if !assert.NoError(t, err, "should succeed") {
-			return
-		}
-		assert.NotNil(t, res, "should not be nil")
-
-		bytes, err := json.MarshalIndent(res, "", "  ")
-		assert.NoError(t, err, "should succeed")
-		log.Debug(string(bytes))
-
-		log.Debugf("%+v", res)
-		assert.True(t, res.IsNatted, "should be natted")
-		assert.Equal(t, EndpointAddrDependent, res.MappingBehavior, "should match")
-		assert.Equal(t, EndpointAddrPortDependent, res.FilteringBehavior, "should match")
-		assert.False(t, res.PortPreservation, "should not be port preserved")
-		assert.Equal(t, "Symmetric NAT", res.NATType, "should match")
-		assert.Equal(t, "27.1.1.1", res.ExternalIP, "should match")
+	t.Run("missing receiving socket", func(t *testing.T) {
+		_, err := nats.performTransactionWith(c, transactionOptions{
+			responsePort: mapped.Port,
+		})
+		assert.Error(t, err, "should fail")
 	})
+
+	for name, setters := range map[string][]stun.Setter{
+		"port 0": {stun.RawAttribute{Type: attrTypeResponsePort, Value: []byte{0, 0, 0, 0}}},
+		"with PADDING": {
+			&attrResponsePort{Port: mapped.Port},
+			&attrPadding{Length: 1000},
+		},
+	} {
+		setters := setters
+		t.Run(name, func(t *testing.T) {
+			conn, err := v.net0.ListenPacket("udp4", "0.0.0.0:0")
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+			defer conn.Close() // nolint:errcheck,gosec
+			res, _ := exchange(t, conn, nats.serverAddr.String(), setters...)
+			if !assert.NotNil(t, res, "should respond") {
+				return
+			}
+			var code stun.ErrorCodeAttribute
+			if assert.NoError(t, code.GetFrom(res), "should be an error") {
+				assert.Equal(t, stun.CodeBadRequest, code.Code, "should match")
+			}
+		})
+	}
 }
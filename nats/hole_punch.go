@@ -0,0 +1,154 @@
+package nats
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+const (
+	rendezvousInterval = 200 * time.Millisecond
+	punchInterval      = 100 * time.Millisecond
+	// keep answering after success so the peer sees our ACK too
+	punchLinger = time.Second
+)
+
+var (
+	punchMagic = []byte("go-nat-discovery punch ")
+	ackMagic   = []byte("go-nat-discovery ack ")
+)
+
+// PunchResult contains the outcome of HolePunch.
+type PunchResult struct {
+	// Established is true when datagrams went both ways directly between
+	// the peers.
+	Established bool `json:"established"`
+	// PeerAddress is the peer's mapped address, as seen by the server.
+	PeerAddress string `json:"peerAddress,omitempty"`
+	// RemoteAddress is where the peer's datagrams actually came from; it
+	// differs from PeerAddress when the peer's NAT maps per destination.
+	RemoteAddress string        `json:"remoteAddress,omitempty"`
+	Elapsed       time.Duration `json:"elapsed"`
+}
+
+// HolePunch meets the peer that uses the same session ID at the server's
+// rendezvous service, then both sides send to each other at the same time
+// until a datagram goes both ways or timeout elapses.
+func (nats *NATS) HolePunch(sessionID string, timeout time.Duration) (*PunchResult, error) {
+	localAddr := "0.0.0.0:0"
+	if nats.mappingLocalAddr != "" {
+		localAddr = nats.mappingLocalAddr
+	}
+	conn, err := nats.net.ListenPacket("udp4", localAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	deadline := start.Add(timeout)
+
+	peer, err := nats.meetPeer(conn, sessionID, deadline)
+	if err != nil {
+		return nil, err
+	}
+	if nats.verbose {
+		log.Printf("rendezvous peer: %s", peer.String())
+	}
+
+	res := &PunchResult{PeerAddress: peer.String()}
+	punch := append(append([]byte{}, punchMagic...), sessionID...)
+	ack := append(append([]byte{}, ackMagic...), sessionID...)
+
+	target := net.Addr(peer)
+	var lingerUntil time.Time
+	buf := make([]byte, 1500)
+	for {
+		now := time.Now()
+		if !res.Established && now.After(deadline) {
+			break
+		}
+		if res.Established && now.After(lingerUntil) {
+			break
+		}
+		if !res.Established {
+			if _, err = conn.WriteTo(punch, target); err != nil {
+				return nil, err
+			}
+		}
+		if err = conn.SetReadDeadline(now.Add(punchInterval)); err != nil {
+			return nil, err
+		}
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				break // next round
+			}
+			fromUDP, ok := from.(*net.UDPAddr)
+			if !ok || !fromUDP.IP.Equal(peer.IP) {
+				continue // late STUN responses and the like
+			}
+			switch {
+			case bytes.Equal(buf[:n], punch):
+				// the peer's NAT may have picked another port for us
+				target = from
+				if _, err = conn.WriteTo(ack, from); err != nil {
+					return nil, err
+				}
+			case bytes.Equal(buf[:n], ack) && !res.Established:
+				res.Established = true
+				res.RemoteAddress = from.String()
+				res.Elapsed = time.Since(start)
+				lingerUntil = time.Now().Add(punchLinger)
+				if nats.verbose {
+					log.Printf("direct path to %s after %s", from.String(), res.Elapsed)
+				}
+			}
+		}
+	}
+	if !res.Established {
+		res.Elapsed = time.Since(start)
+	}
+	return res, nil
+}
+
+// meetPeer registers conn under sessionID until the server returns the
+// peer's mapped address.
+func (nats *NATS) meetPeer(conn net.PacketConn, sessionID string, deadline time.Time) (*net.UDPAddr, error) {
+	attrs := []stun.Setter{stun.TransactionID, stun.BindingRequest, &attrSession{ID: sessionID}}
+	for time.Now().Before(deadline) {
+		msg, err := nats.buildRequest(attrs...)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = conn.WriteTo(msg.Raw, nats.serverAddr); err != nil {
+			return nil, err
+		}
+		res, _, err := readResponse(conn, msg.TransactionID, rendezvousInterval)
+		if err != nil {
+			return nil, err
+		}
+		if res == nil {
+			continue
+		}
+		retry, err := nats.checkResponse(msg, res)
+		if err != nil {
+			return nil, err
+		}
+		if retry {
+			continue
+		}
+		var peer attrPeerAddress
+		if err = peer.GetFrom(res); err != nil {
+			// registered, the peer is not there yet
+			time.Sleep(rendezvousInterval)
+			continue
+		}
+		return &net.UDPAddr{IP: peer.IP, Port: peer.Port}, nil
+	}
+	return nil, errors.New("rendezvous: peer did not show up")
+}
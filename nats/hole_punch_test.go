@@ -0,0 +1,281 @@
+package nats
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHolePunchOnVNet(t *testing.T) {
+	behaviors := map[string]vnet.EndpointDependencyType{
+		"EI":  vnet.EndpointIndependent,
+		"AD":  vnet.EndpointAddrDependent,
+		"APD": vnet.EndpointAddrPortDependent,
+	}
+	// natType parses "<mapping>M+<filtering>F" in the terms of RFC 4787,
+	// "public" is a host without NAT.
+	natType := func(name string) *vnet.NATType {
+		if name == "public" {
+			return nil
+		}
+		parts := strings.Split(strings.TrimSuffix(name, "F"), "M+")
+		return &vnet.NATType{
+			MappingBehavior:   behaviors[parts[0]],
+			FilteringBehavior: behaviors[parts[1]],
+		}
+	}
+
+	// A punch gets through when the receiving mapping accepts the source
+	// the sender's NAT picked for it, and the answer gets back through the
+	// sender's mapping in turn; each side aims at where the other's
+	// datagrams come from once it has seen one.
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"public", "public", true},
+		{"public", "EIM+EIF", true},
+		{"public", "EIM+ADF", true},
+		{"public", "EIM+APDF", true},
+		{"public", "ADM+EIF", true},
+		{"public", "ADM+ADF", true},
+		{"public", "ADM+APDF", true},
+		{"public", "APDM+EIF", true},
+		{"public", "APDM+ADF", true},
+		{"public", "APDM+APDF", true},
+
+		{"EIM+EIF", "EIM+EIF", true},
+		{"EIM+EIF", "EIM+ADF", true},
+		{"EIM+EIF", "EIM+APDF", true},
+		{"EIM+EIF", "ADM+EIF", true},
+		{"EIM+EIF", "ADM+ADF", true},
+		{"EIM+EIF", "ADM+APDF", true},
+		{"EIM+EIF", "APDM+EIF", true},
+		{"EIM+EIF", "APDM+ADF", true},
+		{"EIM+EIF", "APDM+APDF", true},
+
+		{"EIM+ADF", "EIM+ADF", true},
+		{"EIM+ADF", "EIM+APDF", true},
+		{"EIM+ADF", "ADM+EIF", true},
+		{"EIM+ADF", "ADM+ADF", true},
+		{"EIM+ADF", "ADM+APDF", true},
+		{"EIM+ADF", "APDM+EIF", true},
+		{"EIM+ADF", "APDM+ADF", true},
+		{"EIM+ADF", "APDM+APDF", true},
+
+		// only accepts the peer's server-mapped address
+		{"EIM+APDF", "EIM+APDF", true},
+		{"EIM+APDF", "ADM+EIF", false},
+		{"EIM+APDF", "ADM+ADF", false},
+		{"EIM+APDF", "ADM+APDF", false},
+		{"EIM+APDF", "APDM+EIF", false},
+		{"EIM+APDF", "APDM+ADF", false},
+		{"EIM+APDF", "APDM+APDF", false},
+
+		{"ADM+EIF", "ADM+EIF", true},
+		{"ADM+EIF", "ADM+ADF", true},
+		{"ADM+EIF", "ADM+APDF", false},
+		{"ADM+EIF", "APDM+EIF", true},
+		{"ADM+EIF", "APDM+ADF", true},
+		{"ADM+EIF", "APDM+APDF", false},
+
+		// the server-mapped address only accepts the server
+		{"ADM+ADF", "ADM+ADF", false},
+		{"ADM+ADF", "ADM+APDF", false},
+		{"ADM+ADF", "APDM+EIF", true},
+		{"ADM+ADF", "APDM+ADF", false},
+		{"ADM+ADF", "APDM+APDF", false},
+
+		{"ADM+APDF", "ADM+APDF", false},
+		{"ADM+APDF", "APDM+EIF", false},
+		{"ADM+APDF", "APDM+ADF", false},
+		{"ADM+APDF", "APDM+APDF", false},
+
+		{"APDM+EIF", "APDM+EIF", true},
+		{"APDM+EIF", "APDM+ADF", true},
+		{"APDM+EIF", "APDM+APDF", false},
+
+		{"APDM+ADF", "APDM+ADF", false},
+		{"APDM+ADF", "APDM+APDF", false},
+
+		{"APDM+APDF", "APDM+APDF", false},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.a+" to "+test.b, func(t *testing.T) {
+			t.Parallel()
+
+			v, err := buildVNetLANs(&STUNServerConfig{Rendezvous: &RendezvousConfig{}},
+				natType(test.a), natType(test.b))
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+			defer v.close()
+
+			results := make(chan *PunchResult, 2)
+			for _, n := range v.nets {
+				nats, err := NewNATS(&Config{
+					Server:  "stun.pion.net:3478",
+					Verbose: true,
+					Net:     n,
+				})
+				if !assert.NoError(t, err, "should succeed") {
+					return
+				}
+				go func() {
+					res, err := nats.HolePunch("test-session-1234", 2*time.Second)
+					assert.NoError(t, err, "should succeed")
+					results <- res
+				}()
+			}
+
+			for range v.nets {
+				res := <-results
+				if !assert.NotNil(t, res, "should not be nil") {
+					continue
+				}
+				assert.Equal(t, test.want, res.Established, "should match")
+			}
+		})
+	}
+}
+
+func TestHolePunchAuthOnVNet(t *testing.T) {
+	v, err := buildVNetLANs(&STUNServerConfig{
+		Rendezvous: &RendezvousConfig{},
+		Auth: &AuthConfig{Handler: func(username, realm string, srcAddr net.Addr) (string, bool) {
+			return "secret", username == "alice"
+		}},
+	}, nil, nil)
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer v.close()
+
+	punch := func(username string) []*PunchResult {
+		results := make(chan *PunchResult, 2)
+		for _, n := range v.nets {
+			nats, err := NewNATS(&Config{
+				Server:   "stun.pion.net:3478",
+				Net:      n,
+				Username: username,
+				Password: "secret",
+			})
+			if !assert.NoError(t, err, "should succeed") {
+				return nil
+			}
+			go func() {
+				res, err := nats.HolePunch("auth-"+username, 2*time.Second)
+				if err != nil {
+					res = nil
+				}
+				results <- res
+			}()
+		}
+		return []*PunchResult{<-results, <-results}
+	}
+
+	for _, res := range punch("mallory") {
+		assert.Nil(t, res, "should not meet without valid credentials")
+	}
+	assert.Empty(t, v.server.rendezvous.sessions, "should not have registered")
+
+	for _, res := range punch("alice") {
+		if assert.NotNil(t, res, "should meet") {
+			assert.True(t, res.Established, "should be established")
+		}
+	}
+	assert.Contains(t, v.server.rendezvous.sessions, sessionKey{owner: "alice", id: "auth-alice"},
+		"should belong to the authenticated user")
+}
+
+func TestRendezvousSessionIDOnVNet(t *testing.T) {
+	v, err := buildVNetLANs(&STUNServerConfig{Rendezvous: &RendezvousConfig{}}, nil)
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer v.close()
+	conn, err := v.net0.ListenPacket("udp4", "0.0.0.0:0")
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer conn.Close() // nolint:errcheck,gosec
+
+	res, _ := exchange(t, conn, "1.2.3.4:3478", &attrSession{ID: "guessable"})
+	var code stun.ErrorCodeAttribute
+	if assert.NotNil(t, res, "should respond") && assert.NoError(t, code.GetFrom(res), "should be an error") {
+		assert.Equal(t, stun.CodeBadRequest, code.Code, "should reject short IDs without authentication")
+	}
+	assert.Empty(t, v.server.rendezvous.sessions, "should not have registered")
+
+	res, _ = exchange(t, conn, "1.2.3.4:3478", &attrSession{ID: "0123456789abcdef"})
+	if assert.NotNil(t, res, "should respond") {
+		assert.Equal(t, stun.BindingSuccess, res.Type, "should register")
+	}
+}
+
+func TestRendezvousRegister(t *testing.T) {
+	r := newRendezvous(&RendezvousConfig{SessionTTL: time.Minute})
+	now := time.Now()
+	a := &net.UDPAddr{IP: net.IPv4(27, 1, 1, 1), Port: 5000}
+	b := &net.UDPAddr{IP: net.IPv4(27, 1, 1, 2), Port: 6000}
+	c := &net.UDPAddr{IP: net.IPv4(27, 1, 1, 3), Port: 7000}
+
+	peer, err := r.register(sessionKey{id: "s"}, a, now)
+	assert.NoError(t, err, "should succeed")
+	assert.Nil(t, peer, "should wait for the peer")
+
+	peer, err = r.register(sessionKey{id: "s"}, b, now)
+	assert.NoError(t, err, "should succeed")
+	assert.Equal(t, a.String(), peer.String(), "should match")
+
+	peer, err = r.register(sessionKey{id: "s"}, a, now)
+	assert.NoError(t, err, "should succeed")
+	assert.Equal(t, b.String(), peer.String(), "should match")
+
+	_, err = r.register(sessionKey{id: "s"}, c, now)
+	assert.Equal(t, errSessionFull, err, "should be full")
+
+	// sessions of other users are apart
+	peer, err = r.register(sessionKey{owner: "mallory", id: "s"}, c, now)
+	assert.NoError(t, err, "should succeed")
+	assert.Nil(t, peer, "should not join the session of another user")
+
+	// expired sessions start over
+	peer, err = r.register(sessionKey{id: "s"}, c, now.Add(2*time.Minute))
+	assert.NoError(t, err, "should succeed")
+	assert.Nil(t, peer, "should wait for the peer")
+}
+
+func TestRendezvousMaxSessions(t *testing.T) {
+	r := newRendezvous(&RendezvousConfig{SessionTTL: time.Minute, MaxSessions: 2})
+	now := time.Now()
+	a := &net.UDPAddr{IP: net.IPv4(27, 1, 1, 1), Port: 5000}
+	b := &net.UDPAddr{IP: net.IPv4(27, 1, 1, 2), Port: 6000}
+
+	_, err := r.register(sessionKey{id: "s1"}, a, now)
+	assert.NoError(t, err, "should succeed")
+	_, err = r.register(sessionKey{id: "s2"}, a, now.Add(30*time.Second))
+	assert.NoError(t, err, "should succeed")
+	_, err = r.register(sessionKey{id: "s3"}, a, now.Add(30*time.Second))
+	assert.Equal(t, errTooManySessions, err, "should be capped")
+
+	// joining an open session is not capped
+	peer, err := r.register(sessionKey{id: "s2"}, b, now.Add(30*time.Second))
+	assert.NoError(t, err, "should succeed")
+	assert.Equal(t, a.String(), peer.String(), "should match")
+
+	// inserting evicts the expired s1
+	_, err = r.register(sessionKey{id: "s3"}, a, now.Add(61*time.Second))
+	assert.NoError(t, err, "should succeed")
+	assert.Len(t, r.sessions, 2, "should have evicted s1")
+	assert.NotContains(t, r.sessions, sessionKey{id: "s1"}, "should have evicted s1")
+	assert.Len(t, r.order, 2, "should have evicted s1")
+
+}
@@ -0,0 +1,267 @@
+package nats
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pion/transport/vnet"
+)
+
+// LoadMix weights the kinds of binding requests sent by RunLoad.
+type LoadMix struct {
+	Plain      int
+	ChangePort int
+	ChangeIP   int
+	ChangeBoth int
+}
+
+// LoadConfig has config parameters for RunLoad.
+type LoadConfig struct {
+	Server string
+	// Rate is the number of requests per second, spread over Sockets
+	// source ports.
+	Rate     int
+	Duration time.Duration
+	Sockets  int
+	Mix      LoadMix
+	// Timeout is how long responses are waited for after the last
+	// request, 1s if zero.
+	Timeout time.Duration
+	Net     *vnet.Net
+}
+
+// LoadVariant is the outcome of one kind of request in a LoadReport.
+type LoadVariant struct {
+	Name     string `json:"name"`
+	Sent     int    `json:"sent"`
+	Received int    `json:"received"`
+	// Misrouted responses came from the wrong server address, i.e. the
+	// server did not honour the CHANGE-REQUEST.
+	Misrouted int `json:"misrouted"`
+	Errors    int `json:"errors"`
+}
+
+// LoadReport contains the outcome of RunLoad.
+type LoadReport struct {
+	Sent       int           `json:"sent"`
+	Received   int           `json:"received"`
+	Errors     int           `json:"errors"`
+	Loss       float64       `json:"loss"`       // fraction of requests without any response
+	Elapsed    time.Duration `json:"elapsed"`    // time spent sending
+	Throughput float64       `json:"throughput"` // responses per second
+	LatencyP50 time.Duration `json:"latencyP50"`
+	LatencyP90 time.Duration `json:"latencyP90"`
+	LatencyP99 time.Duration `json:"latencyP99"`
+	LatencyMax time.Duration `json:"latencyMax"`
+	// RelayFailures counts change-IP requests, the ones answered by the
+	// secondary (through the relay in split deployments), that were lost
+	// or misrouted.
+	RelayFailures int           `json:"relayFailures"`
+	Variants      []LoadVariant `json:"variants"`
+}
+
+type loadRequest struct {
+	variant int
+	sent    time.Time
+}
+
+type loadRun struct {
+	server   *net.UDPAddr
+	mutex    sync.Mutex
+	pending  map[[stun.TransactionIDSize]byte]loadRequest
+	variants []LoadVariant
+	latency  []time.Duration
+	errors   int
+}
+
+var loadVariants = []struct {
+	name       string
+	changeIP   bool
+	changePort bool
+}{
+	{"plain", false, false},
+	{"change port", false, true},
+	{"change IP", true, false},
+	{"change IP and port", true, true},
+}
+
+// RunLoad drives the server with binding requests at config.Rate for
+// config.Duration, mixing plain and CHANGE-REQUEST variants, and reports
+// throughput, loss and latency.
+func RunLoad(config *LoadConfig) (*LoadReport, error) {
+	if config.Rate <= 0 || config.Duration <= 0 || config.Sockets <= 0 {
+		return nil, errors.New("load: rate, duration and sockets must be positive")
+	}
+	weights := []int{config.Mix.Plain, config.Mix.ChangePort, config.Mix.ChangeIP, config.Mix.ChangeBoth}
+	var schedule []int
+	for v, w := range weights {
+		if w < 0 {
+			return nil, errors.New("load: negative mix weight")
+		}
+		for i := 0; i < w; i++ {
+			schedule = append(schedule, v)
+		}
+	}
+	if len(schedule) == 0 {
+		return nil, errors.New("load: empty request mix")
+	}
+	timeout := config.Timeout
+	if timeout == 0 {
+		timeout = time.Second
+	}
+	if config.Net == nil {
+		config.Net = vnet.NewNet(nil)
+	}
+	server, err := config.Net.ResolveUDPAddr("udp4", formatHostPort(config.Server, 3478))
+	if err != nil {
+		return nil, err
+	}
+
+	run := &loadRun{
+		server:  server,
+		pending: map[[stun.TransactionIDSize]byte]loadRequest{},
+	}
+	for _, v := range loadVariants {
+		run.variants = append(run.variants, LoadVariant{Name: v.name})
+	}
+
+	var conns []net.PacketConn
+	var wg sync.WaitGroup
+	defer func() {
+		for _, conn := range conns {
+			conn.Close() // nolint:errcheck,gosec
+		}
+		wg.Wait()
+	}()
+	for i := 0; i < config.Sockets; i++ {
+		conn, err := config.Net.ListenPacket("udp4", "0.0.0.0:0")
+		if err != nil {
+			return nil, err
+		}
+		conns = append(conns, conn)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			run.readLoop(conn)
+		}()
+	}
+
+	// Pace requests against the start time so slow sends do not lower
+	// the rate.
+	total := int(int64(config.Rate) * int64(config.Duration) / int64(time.Second))
+	interval := time.Second / time.Duration(config.Rate)
+	start := time.Now()
+	for i := 0; i < total; i++ {
+		if d := time.Until(start.Add(time.Duration(i) * interval)); d > 0 {
+			time.Sleep(d)
+		}
+		if err = run.send(conns[i%len(conns)], schedule[i%len(schedule)]); err != nil {
+			return nil, err
+		}
+	}
+	elapsed := time.Since(start)
+	time.Sleep(timeout)
+
+	return run.report(elapsed), nil
+}
+
+func (r *loadRun) send(conn net.PacketConn, variant int) error {
+	v := loadVariants[variant]
+	attrs := []stun.Setter{stun.TransactionID, stun.BindingRequest}
+	if v.changeIP || v.changePort {
+		attrs = append(attrs, &attrChangeRequest{ChangeIP: v.changeIP, ChangePort: v.changePort})
+	}
+	msg, err := stun.Build(attrs...)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	r.pending[msg.TransactionID] = loadRequest{variant: variant, sent: time.Now()}
+	r.variants[variant].Sent++
+	r.mutex.Unlock()
+
+	_, err = conn.WriteTo(msg.Raw, r.server)
+	return err
+}
+
+func (r *loadRun) readLoop(conn net.PacketConn) {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		now := time.Now()
+		res := &stun.Message{Raw: buf[:n]}
+		if res.Decode() != nil {
+			continue
+		}
+
+		r.mutex.Lock()
+		req, ok := r.pending[res.TransactionID]
+		if ok {
+			delete(r.pending, res.TransactionID)
+			r.record(req, res, from.(*net.UDPAddr), now)
+		}
+		r.mutex.Unlock()
+	}
+}
+
+// record accounts for the response to req; the caller holds the mutex.
+func (r *loadRun) record(req loadRequest, res *stun.Message, from *net.UDPAddr, now time.Time) {
+	stats := &r.variants[req.variant]
+	if res.Type.Class == stun.ClassErrorResponse {
+		stats.Errors++
+		r.errors++
+		return
+	}
+	r.latency = append(r.latency, now.Sub(req.sent))
+	stats.Received++
+
+	v := loadVariants[req.variant]
+	if from.IP.Equal(r.server.IP) == v.changeIP || (from.Port == r.server.Port) == v.changePort {
+		stats.Misrouted++
+	}
+}
+
+func (r *loadRun) report(elapsed time.Duration) *LoadReport {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	rep := &LoadReport{
+		Errors:   r.errors,
+		Elapsed:  elapsed,
+		Variants: append([]LoadVariant{}, r.variants...),
+	}
+	for _, v := range rep.Variants {
+		rep.Sent += v.Sent
+		rep.Received += v.Received
+	}
+	for _, v := range rep.Variants[2:] { // the change-IP variants
+		rep.RelayFailures += v.Sent - v.Received - v.Errors + v.Misrouted
+	}
+	if rep.Sent > 0 {
+		rep.Loss = float64(rep.Sent-rep.Received-rep.Errors) / float64(rep.Sent)
+	}
+	if elapsed > 0 {
+		rep.Throughput = float64(rep.Received) / elapsed.Seconds()
+	}
+
+	sort.Slice(r.latency, func(i, j int) bool { return r.latency[i] < r.latency[j] })
+	percentile := func(p int) time.Duration {
+		if len(r.latency) == 0 {
+			return 0
+		}
+		return r.latency[(len(r.latency)-1)*p/100]
+	}
+	rep.LatencyP50 = percentile(50)
+	rep.LatencyP90 = percentile(90)
+	rep.LatencyP99 = percentile(99)
+	rep.LatencyMax = percentile(100)
+	return rep
+}
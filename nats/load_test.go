@@ -0,0 +1,72 @@
+package nats
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunLoadOnVNet(t *testing.T) {
+	natType := &vnet.NATType{
+		MappingBehavior:   vnet.EndpointIndependent,
+		FilteringBehavior: vnet.EndpointIndependent,
+	}
+	config := func(v *virtualNet) *LoadConfig {
+		return &LoadConfig{
+			Server:   "stun.pion.net:3478",
+			Rate:     200,
+			Duration: time.Second,
+			Sockets:  4,
+			Mix:      LoadMix{Plain: 1, ChangePort: 1, ChangeIP: 1, ChangeBoth: 1},
+			Timeout:  500 * time.Millisecond,
+			Net:      v.net0,
+		}
+	}
+
+	t.Run("healthy", func(t *testing.T) {
+		v, err := buildVNetSplitRole(natType)
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer v.close()
+
+		rep, err := RunLoad(config(v))
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		assert.Equal(t, 200, rep.Sent, "should match")
+		assert.Equal(t, 200, rep.Received, "should match")
+		assert.Equal(t, 0.0, rep.Loss, "should match")
+		assert.Equal(t, 0, rep.RelayFailures, "should match")
+		assert.True(t, rep.Throughput > 0, "should be set")
+		assert.True(t, rep.LatencyP50 <= rep.LatencyP99 && rep.LatencyP99 <= rep.LatencyMax, "should be ordered")
+		for _, variant := range rep.Variants {
+			assert.Equal(t, 50, variant.Sent, "should match")
+			assert.Equal(t, 0, variant.Misrouted, "should match")
+		}
+	})
+
+	t.Run("secondary down", func(t *testing.T) {
+		v, err := buildVNetSplitRole(natType)
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer v.close()
+		v.cleanup[0]() // stop the relay to the secondary
+
+		rep, err := RunLoad(config(v))
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		assert.Equal(t, 100, rep.Received, "should match")
+		assert.Equal(t, 0.5, rep.Loss, "should match")
+		assert.Equal(t, 100, rep.RelayFailures, "should match")
+	})
+
+	t.Run("bad config", func(t *testing.T) {
+		_, err := RunLoad(&LoadConfig{Rate: 1, Duration: time.Second, Sockets: 1})
+		assert.Error(t, err, "should fail")
+	})
+}
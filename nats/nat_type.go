@@ -0,0 +1,165 @@
+package nats
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ResultVersion is the schema version of the DiscoverResult JSON encoding.
+// Version 1 results (no "version" field) encode behaviours as integers and
+// the NAT type as its display string; they are still accepted when
+// decoding.
+const ResultVersion = 2
+
+// UnmarshalJSON decodes a result of version ResultVersion or older.
+func (r *DiscoverResult) UnmarshalJSON(data []byte) error {
+	var version struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &version); err != nil {
+		return err
+	}
+	if version.Version > ResultVersion {
+		return fmt.Errorf("result version %d is newer than %d", version.Version, ResultVersion)
+	}
+	type plain DiscoverResult // without this method
+	return json.Unmarshal(data, (*plain)(r))
+}
+
+// NATType is the classic (RFC 3489) NAT type derived from the mapping and
+// filtering behaviours.
+type NATType uint8
+
+const (
+	// NATTypeUndefined means the tests did not determine the type, e.g.
+	// the filtering tests were skipped.
+	NATTypeUndefined NATType = iota
+	Blocked
+	OpenInternet
+	FullCone
+	SymmetricUDPFirewall
+	RestricNAT
+	RestricPortNAT
+	SymmetricNAT
+)
+
+var natTypeNames = []struct {
+	name    string // stable, used in JSON and text
+	display string
+}{
+	NATTypeUndefined:     {"undefined", "undefined"},
+	Blocked:              {"blocked", "Blocked"},
+	OpenInternet:         {"open-internet", "Open Internet"},
+	FullCone:             {"full-cone", "Full Cone"},
+	SymmetricUDPFirewall: {"symmetric-udp-firewall", "Symmetric UDP Firewall"},
+	RestricNAT:           {"restricted-cone", "Restric NAT"},
+	RestricPortNAT:       {"port-restricted-cone", "Restric Port NAT"},
+	SymmetricNAT:         {"symmetric", "Symmetric NAT"},
+}
+
+// String returns the display name of the NAT type.
+func (t NATType) String() string {
+	if int(t) < len(natTypeNames) {
+		return natTypeNames[t].display
+	}
+	return fmt.Sprintf("NATType(%d)", uint8(t))
+}
+
+// MarshalText implements encoding.TextMarshaler with the stable name.
+func (t NATType) MarshalText() ([]byte, error) {
+	if int(t) >= len(natTypeNames) {
+		return nil, fmt.Errorf("invalid NAT type %d", uint8(t))
+	}
+	return []byte(natTypeNames[t].name), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler. Display names are
+// accepted too.
+func (t *NATType) UnmarshalText(text []byte) error {
+	for i, n := range natTypeNames {
+		if string(text) == n.name || string(text) == n.display {
+			*t = NATType(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown NAT type %q", string(text))
+}
+
+// MarshalJSON encodes the NAT type as its stable name.
+func (t NATType) MarshalJSON() ([]byte, error) {
+	text, err := t.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(string(text))
+}
+
+// UnmarshalJSON decodes a stable or display name.
+func (t *NATType) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	return t.UnmarshalText([]byte(s))
+}
+
+// endpointDependencyNames are used in JSON, text and for display alike.
+var endpointDependencyNames = []string{
+	EndpointIndependent:       "independent",
+	EndpointAddrDependent:     "address-dependent",
+	EndpointAddrPortDependent: "address-port-dependent",
+	EndpointUndefined:         "undefined",
+}
+
+func (t EndpointDependencyType) String() string {
+	if int(t) < len(endpointDependencyNames) {
+		return endpointDependencyNames[t]
+	}
+	return fmt.Sprintf("EndpointDependencyType(%d)", uint8(t))
+}
+
+// MarshalText implements encoding.TextMarshaler with a stable name.
+func (t EndpointDependencyType) MarshalText() ([]byte, error) {
+	if int(t) >= len(endpointDependencyNames) {
+		return nil, fmt.Errorf("invalid endpoint dependency %d", uint8(t))
+	}
+	return []byte(endpointDependencyNames[t]), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (t *EndpointDependencyType) UnmarshalText(text []byte) error {
+	for i, name := range endpointDependencyNames {
+		if string(text) == name {
+			*t = EndpointDependencyType(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown endpoint dependency %q", string(text))
+}
+
+// MarshalJSON encodes the behaviour as its stable name.
+func (t EndpointDependencyType) MarshalJSON() ([]byte, error) {
+	text, err := t.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(string(text))
+}
+
+// UnmarshalJSON decodes a stable name, or the integer used by version 1
+// results.
+func (t *EndpointDependencyType) UnmarshalJSON(data []byte) error {
+	var n uint8
+	if err := json.Unmarshal(data, &n); err == nil {
+		if int(n) >= len(endpointDependencyNames) {
+			return fmt.Errorf("invalid endpoint dependency %d", n)
+		}
+		*t = EndpointDependencyType(n)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	return t.UnmarshalText([]byte(s))
+}
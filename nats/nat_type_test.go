@@ -0,0 +1,88 @@
+package nats
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNATTypeText(t *testing.T) {
+	for i := range natTypeNames {
+		natType := NATType(i)
+		text, err := natType.MarshalText()
+		if !assert.NoError(t, err, "should succeed") {
+			continue
+		}
+		var decoded NATType
+		assert.NoError(t, decoded.UnmarshalText(text), "should succeed")
+		assert.Equal(t, natType, decoded, "should match")
+
+		assert.NoError(t, decoded.UnmarshalText([]byte(natType.String())), "should accept display names")
+		assert.Equal(t, natType, decoded, "should match")
+	}
+	for i := range endpointDependencyNames {
+		behavior := EndpointDependencyType(i)
+		text, err := behavior.MarshalText()
+		if assert.NoError(t, err, "should succeed") {
+			assert.Equal(t, behavior.String(), string(text), "should display the JSON name")
+		}
+	}
+
+	_, err := NATType(200).MarshalText()
+	assert.Error(t, err, "should fail")
+	var decoded NATType
+	assert.Error(t, decoded.UnmarshalText([]byte("Full cone NAT")), "should fail")
+}
+
+func TestDiscoverResultJSON(t *testing.T) {
+	res := &DiscoverResult{
+		Version:           ResultVersion,
+		IsNatted:          true,
+		MappingBehavior:   EndpointIndependent,
+		FilteringBehavior: EndpointAddrPortDependent,
+		NATType:           RestricPortNAT,
+		ExternalIP:        "27.1.1.1",
+		ExternalPort:      "5000",
+	}
+	data, err := json.Marshal(res)
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	var fields map[string]interface{}
+	if !assert.NoError(t, json.Unmarshal(data, &fields), "should succeed") {
+		return
+	}
+	assert.Equal(t, float64(ResultVersion), fields["version"], "should match")
+	assert.Equal(t, "independent", fields["mappingBehavior"], "should match")
+	assert.Equal(t, "address-port-dependent", fields["filteringBehavior"], "should match")
+	assert.Equal(t, "port-restricted-cone", fields["natType"], "should match")
+
+	decoded := &DiscoverResult{}
+	assert.NoError(t, json.Unmarshal(data, decoded), "should succeed")
+	assert.Equal(t, res, decoded, "should match")
+
+	t.Run("version 1", func(t *testing.T) {
+		legacy := `{"isNatted":true,"mappingBehavior":0,"filteringBehavior":2,` +
+			`"natType":"Restric Port NAT","externalIP":"27.1.1.1","externalPort":"5000"}`
+		decoded := &DiscoverResult{}
+		if !assert.NoError(t, json.Unmarshal([]byte(legacy), decoded), "should succeed") {
+			return
+		}
+		assert.Equal(t, 0, decoded.Version, "should match")
+		assert.Equal(t, EndpointIndependent, decoded.MappingBehavior, "should match")
+		assert.Equal(t, EndpointAddrPortDependent, decoded.FilteringBehavior, "should match")
+		assert.Equal(t, RestricPortNAT, decoded.NATType, "should match")
+	})
+
+	t.Run("future version", func(t *testing.T) {
+		decoded := &DiscoverResult{}
+		assert.Error(t, json.Unmarshal([]byte(`{"version":3,"natType":"full-cone"}`), decoded), "should fail")
+	})
+
+	t.Run("bad behaviour", func(t *testing.T) {
+		decoded := &DiscoverResult{}
+		assert.Error(t, json.Unmarshal([]byte(`{"mappingBehavior":7}`), decoded), "should fail")
+		assert.Error(t, json.Unmarshal([]byte(`{"mappingBehavior":"sometimes"}`), decoded), "should fail")
+	})
+}
@@ -0,0 +1,133 @@
+package nats
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+
+	"github.com/pion/stun"
+)
+
+const (
+	// maxDatagramSize is the largest request the server reads, the
+	// largest STUN message, so that PADDING probes measure the path
+	// rather than the server's buffers.
+	maxDatagramSize = maxMessageSize
+
+	magicCookie = 0x2112A442
+)
+
+// packet is a datagram read by the server and the request decoded from it.
+// Packets are recycled through packetPool, so that the request path does
+// not allocate once the pool is warm.
+type packet struct {
+	buf  []byte
+	m    stun.Message // m.Raw is a slice of buf
+	from net.UDPAddr  // from.IP is a slice of ip
+	ip   [net.IPv6len]byte
+}
+
+var packetPool = sync.Pool{
+	New: func() interface{} {
+		return &packet{buf: make([]byte, maxDatagramSize)}
+	},
+}
+
+// read reads the next datagram on conn into p and returns its length.
+func (p *packet) read(conn net.PacketConn) (int, error) {
+	if c, ok := conn.(*net.UDPConn); ok {
+		// unlike ReadFrom, this does not allocate the source address
+		n, addrPort, err := c.ReadFromUDPAddrPort(p.buf)
+		addr := addrPort.Addr().Unmap()
+		if addr.Is4() {
+			ip := addr.As4()
+			p.setFrom(ip[:], int(addrPort.Port()), "")
+		} else {
+			ip := addr.As16()
+			p.setFrom(ip[:], int(addrPort.Port()), addr.Zone())
+		}
+		return n, err
+	}
+	// Other conns, e.g. vnet's, may keep the address of a response after
+	// WriteTo returns, so p.ip cannot back it
+	n, from, err := conn.ReadFrom(p.buf)
+	p.from = net.UDPAddr{}
+	if udpAddr, ok := from.(*net.UDPAddr); ok {
+		p.from = *udpAddr
+	}
+	return n, err
+}
+
+func (p *packet) setFrom(ip net.IP, port int, zone string) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	p.from.IP = p.ip[:copy(p.ip[:], ip)]
+	p.from.Port = port
+	p.from.Zone = zone
+}
+
+// decode decodes the first n bytes of the datagram into p.m. A message
+// without the magic cookie, from an RFC 3489 client, is decoded as if it
+// had one, and keeps the start of its transaction ID in p.m.Raw.
+func (p *packet) decode(n int) error {
+	p.m.Raw = p.buf[:n]
+	if n < 8 || p.buf[0]&0xc0 != 0 || binary.BigEndian.Uint32(p.buf[4:8]) == magicCookie {
+		return p.m.Decode()
+	}
+	var classic [4]byte
+	copy(classic[:], p.buf[4:8])
+	binary.BigEndian.PutUint32(p.buf[4:8], magicCookie)
+	err := p.m.Decode()
+	copy(p.buf[4:8], classic[:])
+	return err
+}
+
+// response is a reusable binding response under construction, recycled
+// through responsePool.
+type response struct {
+	stun.Message
+	value [4 + net.IPv6len]byte // address attribute being encoded
+	to    net.UDPAddr
+}
+
+var responsePool = sync.Pool{
+	New: func() interface{} {
+		return &response{}
+	},
+}
+
+// reset starts a new response of type t to the request transactionID.
+func (r *response) reset(transactionID [stun.TransactionIDSize]byte, t stun.MessageType) {
+	r.Reset()
+	r.TransactionID = transactionID
+	r.Type = t
+	r.WriteHeader()
+}
+
+// addAddress adds an address attribute of type t, obfuscated as in
+// XOR-MAPPED-ADDRESS if xor is set.
+func (r *response) addAddress(t stun.AttrType, ip net.IP, port int, xor bool) {
+	family := familyIPv4
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else {
+		family = familyIPv6
+	}
+	v := r.value[:4+len(ip)]
+	binary.BigEndian.PutUint16(v[0:2], family)
+	binary.BigEndian.PutUint16(v[2:4], uint16(port))
+	copy(v[4:], ip)
+	if xor {
+		// RFC 5389 Section 15.2: the port and the first 4 bytes of the
+		// address with the magic cookie, the rest with the transaction ID
+		binary.BigEndian.PutUint16(v[2:4], uint16(port)^uint16(magicCookie>>16))
+		var key [4 + stun.TransactionIDSize]byte
+		binary.BigEndian.PutUint32(key[0:4], magicCookie)
+		copy(key[4:], r.TransactionID[:])
+		for i := range v[4:] {
+			v[4+i] ^= key[i]
+		}
+	}
+	r.Add(t, v)
+}
@@ -0,0 +1,117 @@
+package nats
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+var raceEnabled = false
+
+// discardConn is a listener that drops what the server writes.
+type discardConn struct {
+	addr *net.UDPAddr
+}
+
+func (c *discardConn) ReadFrom(p []byte) (int, net.Addr, error) { select {} }
+func (c *discardConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return len(p), nil
+}
+func (c *discardConn) Close() error                       { return nil }
+func (c *discardConn) LocalAddr() net.Addr                { return c.addr }
+func (c *discardConn) SetDeadline(t time.Time) error      { return nil }
+func (c *discardConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *discardConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// newDiscardServer returns a server with the default topology whose
+// endpoints write to discardConns, for driving handlePacket directly, and
+// a worker of its primary address.
+func newDiscardServer(tb testing.TB) (*STUNServer, *worker) {
+	s, err := NewSTUNServer(&STUNServerConfig{
+		PrimaryAddress:   "1.2.3.4:3478",
+		SecondaryAddress: "1.2.3.5:3479",
+		Net:              vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{"1.2.3.4", "1.2.3.5"}}),
+		Role:             "both",
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for _, e := range s.endpoints {
+		e.conn = &discardConn{addr: e.addr}
+		e.conns = []net.PacketConn{e.conn}
+	}
+	return s, &worker{conn: s.endpoints[0].conn, e: s.endpoints[0], generation: s.generation}
+}
+
+// handleRaw runs raw through handlePacket as a datagram from 27.1.1.1:5000
+// read by w.
+func handleRaw(s *STUNServer, w *worker, raw []byte) {
+	p := packetPool.Get().(*packet)
+	n := copy(p.buf, raw)
+	p.setFrom(net.IPv4(27, 1, 1, 1), 5000, "")
+	s.handlePacket(w, p, n, nil)
+	packetPool.Put(p)
+}
+
+func TestHandlePacketAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool is not deterministic under the race detector")
+	}
+	s, w := newDiscardServer(t)
+	for _, setters := range [][]stun.Setter{
+		{stun.TransactionID, stun.BindingRequest},
+		{stun.TransactionID, stun.BindingRequest, &attrChangeRequest{ChangePort: true}},
+		{stun.TransactionID, stun.BindingRequest, &attrPadding{Length: 64}},
+	} {
+		raw := stun.MustBuild(setters...).Raw
+		allocs := testing.AllocsPerRun(100, func() {
+			handleRaw(s, w, raw)
+		})
+		assert.Zero(t, allocs, "should not allocate")
+	}
+}
+
+func TestResponseAddress(t *testing.T) {
+	res := &response{}
+	res.reset(stun.NewTransactionID(), stun.BindingSuccess)
+	v4 := &net.UDPAddr{IP: net.IPv4(27, 1, 1, 1), Port: 5000}
+	v6 := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5001}
+	res.addAddress(stun.AttrMappedAddress, v4.IP, v4.Port, false)
+	res.addAddress(stun.AttrXORMappedAddress, v6.IP, v6.Port, true)
+
+	decoded := &stun.Message{Raw: append([]byte{}, res.Raw...)}
+	if !assert.NoError(t, decoded.Decode(), "should succeed") {
+		return
+	}
+	var mapped stun.MappedAddress
+	if assert.NoError(t, mapped.GetFrom(decoded), "should succeed") {
+		assert.Equal(t, v4.String(), mapped.String(), "should match")
+	}
+	var xorMapped stun.XORMappedAddress
+	if assert.NoError(t, xorMapped.GetFrom(decoded), "should succeed") {
+		assert.Equal(t, v6.String(), xorMapped.String(), "should match")
+	}
+}
+
+func BenchmarkHandlePacket(b *testing.B) {
+	s, w := newDiscardServer(b)
+	for _, test := range []struct {
+		name    string
+		setters []stun.Setter
+	}{
+		{"plain", []stun.Setter{stun.TransactionID, stun.BindingRequest}},
+		{"change-port", []stun.Setter{stun.TransactionID, stun.BindingRequest, &attrChangeRequest{ChangePort: true}}},
+	} {
+		raw := stun.MustBuild(test.setters...).Raw
+		b.Run(test.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				handleRaw(s, w, raw)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package nats
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Strategy is the way two peers can reach each other.
+type Strategy string
+
+const (
+	// StrategyDirect means one peer can simply send to the other's
+	// external address.
+	StrategyDirect Strategy = "direct"
+	// StrategyHolePunch means both peers must send to each other's
+	// external address at about the same time.
+	StrategyHolePunch Strategy = "hole punch"
+	// StrategyPortPrediction means hole punching towards a guessed port,
+	// because one side's mapping changes per destination.
+	StrategyPortPrediction Strategy = "port prediction"
+	// StrategyRelay means traffic has to go through a relay such as TURN.
+	StrategyRelay Strategy = "relay"
+)
+
+// Connectivity is the outcome of PredictConnectivity.
+type Connectivity struct {
+	Strategy  Strategy `json:"strategy"`
+	Rationale string   `json:"rationale"`
+}
+
+// PredictConnectivity tells whether the peers that produced a and b can
+// connect directly over UDP, and how, based on their mapping and filtering
+// behaviors, port preservation and hairpinning.
+func PredictConnectivity(a, b *DiscoverResult) (*Connectivity, error) {
+	if a == nil || b == nil {
+		return nil, errors.New("need two discover results")
+	}
+	result := func(s Strategy, format string, args ...interface{}) (*Connectivity, error) {
+		return &Connectivity{Strategy: s, Rationale: fmt.Sprintf(format, args...)}, nil
+	}
+
+	// Same NAT: the external addresses only work if the NAT hairpins.
+	if a.IsNatted && b.IsNatted && a.ExternalIP != "" && a.ExternalIP == b.ExternalIP {
+		if a.Hairpinning {
+			return result(StrategyDirect,
+				"both peers are behind the NAT at %s, which supports hairpinning", a.ExternalIP)
+		}
+		return result(StrategyRelay,
+			"both peers are behind the NAT at %s, which does not hairpin; use local addresses if they share a LAN", a.ExternalIP)
+	}
+
+	if acceptsUnsolicited(a) {
+		return result(StrategyDirect, "peer A accepts unsolicited traffic (%s)", a.NATType)
+	}
+	if acceptsUnsolicited(b) {
+		return result(StrategyDirect, "peer B accepts unsolicited traffic (%s)", b.NATType)
+	}
+
+	// A peer without a NAT keeps its address for every destination.
+	aStable := !a.IsNatted || a.MappingBehavior == EndpointIndependent
+	bStable := !b.IsNatted || b.MappingBehavior == EndpointIndependent
+
+	switch {
+	case aStable && bStable:
+		return result(StrategyHolePunch,
+			"both peers keep their external address for every destination, so simultaneous sends open both filters")
+	case aStable || bStable:
+		stable, other, stableName, otherName := a, b, "A", "B"
+		if bStable {
+			stable, other, stableName, otherName = b, a, "B", "A"
+		}
+		if filtering(stable) != EndpointAddrPortDependent {
+			return result(StrategyHolePunch,
+				"peer %s filtering is %s, so it accepts peer %s from any port",
+				stableName, filtering(stable), otherName)
+		}
+		if other.PortPreservation {
+			return result(StrategyPortPrediction,
+				"peer %s filters by address and port and peer %s maps per destination, but preserves ports",
+				stableName, otherName)
+		}
+		return result(StrategyRelay,
+			"peer %s filters by address and port and peer %s maps to unpredictable ports",
+			stableName, otherName)
+	}
+
+	if a.PortPreservation && b.PortPreservation {
+		return result(StrategyPortPrediction,
+			"both peers map per destination but preserve ports")
+	}
+	return result(StrategyRelay, "both peers map per destination to unpredictable ports")
+}
+
+// acceptsUnsolicited reports whether anyone can reach r's external address.
+func acceptsUnsolicited(r *DiscoverResult) bool {
+	if !r.IsNatted {
+		return r.FilteringBehavior == EndpointIndependent
+	}
+	return r.MappingBehavior == EndpointIndependent && r.FilteringBehavior == EndpointIndependent
+}
+
+// filtering treats an unknown filtering behavior as the strictest one.
+func filtering(r *DiscoverResult) EndpointDependencyType {
+	if r.FilteringBehavior == EndpointUndefined {
+		return EndpointAddrPortDependent
+	}
+	return r.FilteringBehavior
+}
@@ -0,0 +1,67 @@
+package nats
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPredictConnectivity(t *testing.T) {
+	natted := func(ip string, mapping, filtering EndpointDependencyType, portPreservation bool) *DiscoverResult {
+		return &DiscoverResult{
+			IsNatted:          true,
+			MappingBehavior:   mapping,
+			FilteringBehavior: filtering,
+			PortPreservation:  portPreservation,
+			ExternalIP:        ip,
+		}
+	}
+	open := &DiscoverResult{FilteringBehavior: EndpointIndependent, ExternalIP: "1.1.1.1"}
+	firewall := &DiscoverResult{FilteringBehavior: EndpointAddrPortDependent, ExternalIP: "1.1.1.2"}
+	fullCone := natted("2.2.2.2", EndpointIndependent, EndpointIndependent, false)
+	restricted := natted("3.3.3.3", EndpointIndependent, EndpointAddrDependent, false)
+	portRestricted := natted("4.4.4.4", EndpointIndependent, EndpointAddrPortDependent, false)
+	symmetric := natted("5.5.5.5", EndpointAddrPortDependent, EndpointAddrPortDependent, false)
+	symmetricPP := natted("6.6.6.6", EndpointAddrPortDependent, EndpointAddrPortDependent, true)
+	symmetricPP2 := natted("7.7.7.7", EndpointAddrDependent, EndpointAddrPortDependent, true)
+	undefined := natted("8.8.8.8", EndpointIndependent, EndpointUndefined, false)
+
+	sameNAT := natted("9.9.9.9", EndpointIndependent, EndpointAddrPortDependent, false)
+	sameNATHairpin := natted("9.9.9.9", EndpointIndependent, EndpointAddrPortDependent, false)
+	sameNATHairpin.Hairpinning = true
+
+	for _, tc := range []struct {
+		name     string
+		a, b     *DiscoverResult
+		strategy Strategy
+	}{
+		{"open internet", open, symmetric, StrategyDirect},
+		{"full cone", symmetric, fullCone, StrategyDirect},
+		{"cones", restricted, portRestricted, StrategyHolePunch},
+		{"firewall and cone", firewall, portRestricted, StrategyHolePunch},
+		{"symmetric and restricted", symmetric, restricted, StrategyHolePunch},
+		{"symmetric and port-restricted", symmetric, portRestricted, StrategyRelay},
+		{"port-preserving symmetric and port-restricted", portRestricted, symmetricPP, StrategyPortPrediction},
+		{"symmetric and undefined filtering", symmetric, undefined, StrategyRelay},
+		{"symmetric", symmetric, symmetricPP, StrategyRelay},
+		{"port-preserving symmetric", symmetricPP, symmetricPP2, StrategyPortPrediction},
+		{"same NAT", sameNAT, sameNAT, StrategyRelay},
+		{"same NAT with hairpinning", sameNATHairpin, sameNATHairpin, StrategyDirect},
+	} {
+		c, err := PredictConnectivity(tc.a, tc.b)
+		if !assert.NoError(t, err, tc.name) {
+			continue
+		}
+		assert.Equal(t, tc.strategy, c.Strategy, "%s: %s", tc.name, c.Rationale)
+		assert.NotEmpty(t, c.Rationale, tc.name)
+
+		// the prediction must not depend on the order of the peers
+		c, err = PredictConnectivity(tc.b, tc.a)
+		if assert.NoError(t, err, tc.name) {
+			assert.Equal(t, tc.strategy, c.Strategy, "%s (swapped): %s", tc.name, c.Rationale)
+		}
+	}
+
+	_, err := PredictConnectivity(open, nil)
+	assert.Error(t, err, "should fail")
+}
@@ -0,0 +1,135 @@
+package nats
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+const (
+	// STUN header (20) + PADDING attribute header (4)
+	minProbeSize = 20 + 4
+
+	probeTimeout  = 500 * time.Millisecond
+	probeAttempts = 3
+
+	// large enough for any padded response
+	maxMessageSize = 65535
+)
+
+// MTUResult contains the outcome of ProbeMTU.
+type MTUResult struct {
+	// MaxSize is the largest request size (in bytes, STUN message only)
+	// whose response, padded to the same size, came back.
+	MaxSize int `json:"maxSize"`
+	Probes  int `json:"probes"`
+}
+
+// ProbeMTU binary-searches the largest binding request (and response) size
+// that survives the path to the server, using the PADDING attribute defined
+// in RFC 5780. Sizes are STUN message sizes, excluding IP and UDP headers.
+func (nats *NATS) ProbeMTU(minSize, maxSize int) (*MTUResult, error) {
+	if minSize < minProbeSize {
+		minSize = minProbeSize
+	}
+	minSize &^= 3
+	maxSize &^= 3
+	if maxSize < minSize {
+		return nil, fmt.Errorf("invalid probe range [%d, %d]", minSize, maxSize)
+	}
+
+	localAddr := "0.0.0.0:0"
+	if nats.mappingLocalAddr != "" {
+		localAddr = nats.mappingLocalAddr
+	}
+	conn, err := nats.net.ListenPacket("udp4", localAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	res := &MTUResult{}
+	probe := func(size int) (bool, error) {
+		res.Probes++
+		ok, err := nats.probeSize(conn, size)
+		if nats.verbose {
+			log.Printf("PADDING probe size=%d ok=%v", size, ok)
+		}
+		return ok, err
+	}
+
+	ok, err := probe(minSize)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("no response to the smallest probe")
+	}
+
+	// Invariant: lo round-trips, hi+4 does not (or is out of range).
+	lo, hi := minSize, maxSize
+	for lo < hi {
+		mid := (lo + hi + 4) / 2 &^ 3
+		ok, err = probe(mid)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			lo = mid
+		} else {
+			hi = mid - 4
+		}
+	}
+	res.MaxSize = lo
+	return res, nil
+}
+
+// probeSize sends a binding request padded to size bytes and reports whether
+// a padded response came back.
+func (nats *NATS) probeSize(conn net.PacketConn, size int) (bool, error) {
+	build := func() (*stun.Message, error) {
+		// Credentials add to the size, so measure them first.
+		msg, err := nats.buildRequest(stun.TransactionID, stun.BindingRequest, &attrPadding{})
+		if err != nil {
+			return nil, err
+		}
+		padding := size - len(msg.Raw)
+		if padding < 0 {
+			padding = 0
+		}
+		return nats.buildRequest(stun.TransactionID, stun.BindingRequest, &attrPadding{Length: padding})
+	}
+	msg, err := build()
+	if err != nil {
+		return false, err
+	}
+
+	for i := 0; i < probeAttempts; i++ {
+		if _, err = conn.WriteTo(msg.Raw, nats.serverAddr); err != nil {
+			return false, err
+		}
+		res, _, err := readResponse(conn, msg.TransactionID, probeTimeout)
+		if err != nil {
+			return false, err
+		}
+		if res == nil {
+			continue
+		}
+		retry, err := nats.checkResponse(msg, res)
+		if err != nil {
+			return false, err
+		}
+		if retry {
+			if msg, err = build(); err != nil {
+				return false, err
+			}
+			continue
+		}
+		return true, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,56 @@
+package nats
+
+import (
+	"testing"
+
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbeMTUOnVNet(t *testing.T) {
+	v, err := buildVNet(&vnet.NATType{
+		MappingBehavior:   vnet.EndpointIndependent,
+		FilteringBehavior: vnet.EndpointIndependent,
+	})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer v.close()
+
+	nats, err := NewNATS(&Config{
+		Server:  "stun.pion.net:3478",
+		Verbose: true,
+		Net:     v.net0,
+	})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+
+	// the path to the server drops datagrams carrying more than 4000
+	// bytes; responses are a little larger than the requests
+	v.wan.AddChunkFilter(func(c vnet.Chunk) bool {
+		return c.DestinationAddr().String() != nats.serverAddr.String() ||
+			len(c.UserData()) <= 4000
+	})
+
+	t.Run("limited by path", func(t *testing.T) {
+		res, err := nats.ProbeMTU(100, 9000)
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		assert.Equal(t, 4000, res.MaxSize, "should match")
+	})
+
+	t.Run("limited by range", func(t *testing.T) {
+		res, err := nats.ProbeMTU(100, 1203)
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		assert.Equal(t, 1200, res.MaxSize, "should match")
+	})
+
+	t.Run("invalid range", func(t *testing.T) {
+		_, err := nats.ProbeMTU(1000, 100)
+		assert.Error(t, err, "should fail")
+	})
+}
@@ -0,0 +1,246 @@
+package nats
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+const (
+	defaultSessionTTL  = 30 * time.Second
+	defaultMaxSessions = 10000
+)
+
+// RendezvousConfig enables the rendezvous service: two clients register the
+// same session ID in binding requests and each learns the other's mapped
+// address, so they can punch a hole towards each other (see HolePunch).
+// With authentication, sessions belong to the USERNAME that opened them and
+// only requests authenticated as that user join them. Without, anyone
+// knowing an ID can take the second place of its session, so IDs must be
+// unguessable, e.g. random, and are at least minSessionIDLen bytes long.
+type RendezvousConfig struct {
+	// SessionTTL is how long a session waits for its second peer,
+	// defaults to 30 seconds.
+	SessionTTL time.Duration
+	// MaxSessions caps the open sessions, defaults to 10000. Registering
+	// a new session beyond it fails with 508 (Insufficient Capacity).
+	MaxSessions int
+}
+
+// attrSession represents RENDEZVOUS-SESSION, a private attribute carrying
+// the session ID both peers agreed on out of band.
+type attrSession struct {
+	ID string
+}
+
+const (
+	minSessionIDLen = 16 // without authentication
+	maxSessionIDLen = 128
+)
+
+var errSessionIDTooShort = fmt.Errorf("rendezvous: session id shorter than %d bytes without authentication", minSessionIDLen)
+
+func (a *attrSession) GetFrom(m *stun.Message) error {
+	v, err := m.Get(attrTypeRendezvousSession)
+	if err != nil {
+		return err
+	}
+	if len(v) == 0 || len(v) > maxSessionIDLen {
+		return fmt.Errorf("rendezvous: bad session id length %d", len(v))
+	}
+	a.ID = string(v)
+	return nil
+}
+
+func (a *attrSession) AddTo(m *stun.Message) error {
+	if len(a.ID) == 0 || len(a.ID) > maxSessionIDLen {
+		return fmt.Errorf("rendezvous: bad session id length %d", len(a.ID))
+	}
+	m.Add(attrTypeRendezvousSession, []byte(a.ID))
+	return nil
+}
+
+// attrPeerAddress represents PEER-ADDRESS, a private attribute carrying the
+// mapped address of the other peer of a rendezvous session.
+type attrPeerAddress struct {
+	attrAddress
+}
+
+func (a *attrPeerAddress) GetFrom(m *stun.Message) error {
+	return a.getAs(m, attrTypePeerAddress)
+}
+
+func (a *attrPeerAddress) AddTo(m *stun.Message) error {
+	return a.addAs(m, attrTypePeerAddress)
+}
+
+type rendezvousSession struct {
+	peers []*net.UDPAddr
+}
+
+// sessionKey identifies a session by the user who opened it, empty without
+// authentication, and its ID.
+type sessionKey struct {
+	owner string
+	id    string
+}
+
+// sessionEntry records when session key was created, in creation order.
+type sessionEntry struct {
+	key     sessionKey
+	created time.Time
+}
+
+type rendezvous struct {
+	ttl         time.Duration
+	maxSessions int
+	mutex       sync.Mutex
+	sessions    map[sessionKey]*rendezvousSession
+	order       []sessionEntry // oldest first
+}
+
+func newRendezvous(config *RendezvousConfig) *rendezvous {
+	r := &rendezvous{sessions: map[sessionKey]*rendezvousSession{}}
+	r.configure(config)
+	return r
+}
+
+// configure changes the session TTL and cap, keeping the open sessions.
+func (r *rendezvous) configure(config *RendezvousConfig) {
+	ttl := config.SessionTTL
+	if ttl <= 0 {
+		ttl = defaultSessionTTL
+	}
+	maxSessions := config.MaxSessions
+	if maxSessions <= 0 {
+		maxSessions = defaultMaxSessions
+	}
+	r.mutex.Lock()
+	r.ttl = ttl
+	r.maxSessions = maxSessions
+	r.mutex.Unlock()
+}
+
+var (
+	errSessionFull     = errors.New("rendezvous: session already has two peers")
+	errTooManySessions = errors.New("rendezvous: too many open sessions")
+)
+
+// evict drops the sessions expired at now. The caller must hold the mutex.
+func (r *rendezvous) evict(now time.Time) {
+	n := 0
+	for ; n < len(r.order); n++ {
+		if now.Sub(r.order[n].created) <= r.ttl {
+			break
+		}
+		delete(r.sessions, r.order[n].key)
+	}
+	r.order = r.order[n:]
+}
+
+// register adds from to session key and returns the other peer, or nil
+// while it has not registered yet.
+func (r *rendezvous) register(key sessionKey, from *net.UDPAddr, now time.Time) (*net.UDPAddr, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.evict(now)
+
+	s, ok := r.sessions[key]
+	if !ok {
+		if len(r.sessions) >= r.maxSessions {
+			return nil, errTooManySessions
+		}
+		s = &rendezvousSession{}
+		r.sessions[key] = s
+		r.order = append(r.order, sessionEntry{key: key, created: now})
+	}
+
+	self := -1
+	for i, p := range s.peers {
+		if p.String() == from.String() {
+			self = i
+		}
+	}
+	if self < 0 {
+		if len(s.peers) == 2 {
+			return nil, errSessionFull
+		}
+		s.peers = append(s.peers, from)
+		self = len(s.peers) - 1
+	}
+	if len(s.peers) < 2 {
+		return nil, nil
+	}
+	return s.peers[1-self], nil
+}
+
+// handleRendezvous answers a binding request carrying RENDEZVOUS-SESSION on
+// the listener it arrived on, registering it with the rendezvous of st in
+// the session of its USERNAME if st authenticates, adding PEER-ADDRESS once
+// both peers are known and signing the response with key if not nil. Like
+// handleBindingRequest, the response is built in a pooled message.
+func (s *STUNServer) handleRendezvous(st *snapshot, conn net.PacketConn, from net.Addr, m *stun.Message, key stun.Setter) error {
+	session := attrSession{}
+	if err := session.GetFrom(m); err != nil {
+		return s.sendError(conn, from, m, stun.CodeBadRequest)
+	}
+	id := sessionKey{id: session.ID}
+	if st.auth != nil {
+		var username stun.Username
+		if err := username.GetFrom(m); err != nil {
+			return s.sendError(conn, from, m, stun.CodeBadRequest)
+		}
+		id.owner = username.String()
+	} else if len(session.ID) < minSessionIDLen {
+		if st.debug {
+			s.log.Debugf("%s from %s", errSessionIDTooShort.Error(), from.String())
+		}
+		return s.sendError(conn, from, m, stun.CodeBadRequest)
+	}
+
+	// from belongs to a pooled packet, the session keeps a copy
+	udpAddr := from.(*net.UDPAddr)
+	peer, err := st.rendezvous.register(id, &net.UDPAddr{
+		IP:   append(net.IP(nil), udpAddr.IP...),
+		Port: udpAddr.Port,
+		Zone: udpAddr.Zone,
+	}, time.Now())
+	if err != nil {
+		if st.debug {
+			s.log.Debugf("rendezvous %q: %s", session.ID, err.Error())
+		}
+		if err == errTooManySessions {
+			return s.sendError(conn, from, m, stun.CodeInsufficientCapacity)
+		}
+		return s.sendError(conn, from, m, stun.CodeForbidden)
+	}
+
+	res := responsePool.Get().(*response)
+	defer responsePool.Put(res)
+	res.reset(m.TransactionID, stun.BindingSuccess)
+	res.addAddress(stun.AttrXORMappedAddress, udpAddr.IP, udpAddr.Port, true)
+	if peer != nil {
+		if st.debug {
+			s.log.Debugf("rendezvous %q: %s <-> %s", session.ID, from.String(), peer.String())
+		}
+		res.addAddress(attrTypePeerAddress, peer.IP, peer.Port, false)
+	}
+	if len(st.software) > 0 {
+		res.Add(stun.AttrSoftware, st.software)
+	}
+	if key != nil {
+		if err = key.AddTo(&res.Message); err != nil {
+			return err
+		}
+	}
+	if err = stun.Fingerprint.AddTo(&res.Message); err != nil {
+		return err
+	}
+	_, err = conn.WriteTo(res.Raw, from)
+	return err
+}
@@ -0,0 +1,76 @@
+package nats
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/pion/stun"
+)
+
+// ResponseProfile selects the attributes of binding success responses.
+// SOFTWARE is only sent when STUNServerConfig.Software is set, and
+// MESSAGE-INTEGRITY and PADDING whenever the request calls for them.
+type ResponseProfile string
+
+const (
+	// ProfileDefault sends XOR-MAPPED-ADDRESS, CHANGED-ADDRESS, SOFTWARE
+	// and FINGERPRINT.
+	ProfileDefault ResponseProfile = ""
+	// ProfileRFC3489 sends MAPPED-ADDRESS, SOURCE-ADDRESS and
+	// CHANGED-ADDRESS. Requests without the magic cookie, from RFC 3489
+	// clients, are answered with it whatever the profile.
+	ProfileRFC3489 ResponseProfile = "rfc3489"
+	// ProfileRFC5389 sends XOR-MAPPED-ADDRESS, SOFTWARE and FINGERPRINT.
+	// Without an alternate address, clients cannot run the NAT tests.
+	ProfileRFC5389 ResponseProfile = "rfc5389"
+	// ProfileRFC5780 sends XOR-MAPPED-ADDRESS, OTHER-ADDRESS,
+	// RESPONSE-ORIGIN, SOFTWARE and FINGERPRINT.
+	ProfileRFC5780 ResponseProfile = "rfc5780"
+	// ProfileMinimal sends XOR-MAPPED-ADDRESS only.
+	ProfileMinimal ResponseProfile = "minimal"
+)
+
+// responseAttrs is a set of optional response attributes.
+type responseAttrs uint8
+
+const (
+	respMappedAddress responseAttrs = 1 << iota
+	respXORMappedAddress
+	respSourceAddress
+	respChangedAddress
+	respOtherAddress
+	respResponseOrigin
+	respSoftware
+	respFingerprint
+)
+
+var responseProfiles = map[ResponseProfile]responseAttrs{
+	ProfileDefault: respXORMappedAddress | respChangedAddress | respSoftware | respFingerprint,
+	ProfileRFC3489: respMappedAddress | respSourceAddress | respChangedAddress,
+	ProfileRFC5389: respXORMappedAddress | respSoftware | respFingerprint,
+	ProfileRFC5780: respXORMappedAddress | respOtherAddress | respResponseOrigin | respSoftware | respFingerprint,
+	ProfileMinimal: respXORMappedAddress,
+}
+
+// attrs returns the attributes sent with profile p.
+func (p ResponseProfile) attrs() (responseAttrs, error) {
+	attrs, ok := responseProfiles[p]
+	if !ok {
+		return 0, fmt.Errorf("unknown response profile %q", string(p))
+	}
+	return attrs, nil
+}
+
+func (a responseAttrs) has(attr responseAttrs) bool {
+	return a&attr != 0
+}
+
+// classicID returns the first 4 bytes of the 16-byte transaction ID of m
+// if it comes from an RFC 3489 client, where RFC 5389 puts the magic
+// cookie; nil otherwise.
+func classicID(m *stun.Message) []byte {
+	if len(m.Raw) < 8 || binary.BigEndian.Uint32(m.Raw[4:8]) == magicCookie {
+		return nil
+	}
+	return m.Raw[4:8]
+}
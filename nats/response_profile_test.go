@@ -0,0 +1,223 @@
+package nats
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResponseProfilesOnVNet(t *testing.T) {
+	fullCone := &vnet.NATType{
+		MappingBehavior:   vnet.EndpointIndependent,
+		FilteringBehavior: vnet.EndpointIndependent,
+	}
+	all := []stun.AttrType{
+		stun.AttrMappedAddress,
+		stun.AttrXORMappedAddress,
+		attrTypeSourceAddress,
+		attrTypeChangedAddress,
+		attrTypeOtherAddress,
+		attrTypeResponseOrigin,
+		stun.AttrSoftware,
+		stun.AttrFingerprint,
+	}
+
+	for _, test := range []struct {
+		profile  ResponseProfile
+		want     []stun.AttrType
+		discover bool
+	}{
+		{ProfileDefault, []stun.AttrType{stun.AttrXORMappedAddress, attrTypeChangedAddress, stun.AttrSoftware, stun.AttrFingerprint}, true},
+		{ProfileRFC3489, []stun.AttrType{stun.AttrMappedAddress, attrTypeSourceAddress, attrTypeChangedAddress}, true},
+		{ProfileRFC5389, []stun.AttrType{stun.AttrXORMappedAddress, stun.AttrSoftware, stun.AttrFingerprint}, false},
+		{ProfileRFC5780, []stun.AttrType{stun.AttrXORMappedAddress, attrTypeOtherAddress, attrTypeResponseOrigin, stun.AttrSoftware, stun.AttrFingerprint}, true},
+		{ProfileMinimal, []stun.AttrType{stun.AttrXORMappedAddress}, false},
+	} {
+		test := test
+		t.Run(string(test.profile), func(t *testing.T) {
+			v, err := buildVNetWithServer(fullCone, &STUNServerConfig{Software: "nat_discover", ResponseProfile: test.profile})
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+			defer v.close()
+			conn, err := v.net0.ListenPacket("udp4", "0.0.0.0:0")
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+			defer conn.Close() // nolint:errcheck,gosec
+
+			res, _ := exchange(t, conn, "1.2.3.4:3478", &attrChangeRequest{ChangePort: true})
+			if !assert.NotNil(t, res, "should respond") {
+				return
+			}
+			var got []stun.AttrType
+			for _, attr := range all {
+				if res.Contains(attr) {
+					got = append(got, attr)
+				}
+			}
+			assert.Equal(t, test.want, got, "should send the profile's attributes")
+			assert.Len(t, res.Attributes, len(got), "should not repeat attributes")
+			for _, attr := range []stun.AttrType{attrTypeResponseOrigin, attrTypeSourceAddress} {
+				if res.Contains(attr) {
+					var origin attrAddress
+					if assert.NoError(t, origin.getAs(res, attr), "should succeed") {
+						assert.Equal(t, "1.2.3.4:3479", origin.String(), "should be the responding endpoint")
+					}
+				}
+			}
+			if res.Contains(stun.AttrSoftware) {
+				var software stun.Software
+				if assert.NoError(t, software.GetFrom(res), "should succeed") {
+					assert.Equal(t, "nat_discover", software.String(), "should match")
+				}
+			}
+
+			if !test.discover {
+				return
+			}
+			nats, err := NewNATS(&Config{Server: "stun.pion.net:3478", Net: v.net0})
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+			result, err := nats.Discover()
+			if assert.NoError(t, err, "clients should understand the profile") {
+				assert.Equal(t, FullCone, result.NATType, "should match")
+			}
+		})
+	}
+
+	_, err := NewSTUNServer(&STUNServerConfig{PrimaryAddress: "1.2.3.4:3478", SecondaryAddress: "1.2.3.5:3479", ResponseProfile: "bogus"})
+	assert.Error(t, err, "should reject unknown profiles")
+}
+
+func TestClassicRequestOnVNet(t *testing.T) {
+	v, err := buildVNetWithServer(&vnet.NATType{
+		MappingBehavior:   vnet.EndpointIndependent,
+		FilteringBehavior: vnet.EndpointIndependent,
+	}, &STUNServerConfig{Software: "nat_discover"})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer v.close()
+	conn, err := v.net0.ListenPacket("udp4", "0.0.0.0:0")
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer conn.Close() // nolint:errcheck,gosec
+
+	// an RFC 3489 binding request: a 16-byte transaction ID and no magic
+	// cookie, asking for a change of port
+	request := []byte{
+		0x00, 0x01, 0x00, 0x08,
+		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+		0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10,
+		0x00, 0x03, 0x00, 0x04, 0x00, 0x00, 0x00, 0x02,
+	}
+	classicExchange := func() ([]byte, net.Addr) {
+		if _, err := conn.WriteTo(request, &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 3478}); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1500)
+		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond)) // nolint:errcheck,gosec
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return nil, nil
+		}
+		return buf[:n], from
+	}
+
+	t.Run("answered", func(t *testing.T) {
+		raw, from := classicExchange()
+		if !assert.NotNil(t, raw, "should respond") {
+			return
+		}
+		assert.Equal(t, "1.2.3.4:3479", from.String(), "should change the port")
+		assert.Equal(t, []byte{0x01, 0x01}, raw[0:2], "should be a binding response")
+		assert.Equal(t, request[4:20], raw[4:20], "should echo the transaction ID")
+
+		// decode the attributes as if the response had the magic cookie
+		res := &stun.Message{Raw: append([]byte{}, raw...)}
+		binary.BigEndian.PutUint32(res.Raw[4:8], magicCookie)
+		if !assert.NoError(t, res.Decode(), "should decode") {
+			return
+		}
+		var types []stun.AttrType
+		for _, attr := range res.Attributes {
+			types = append(types, attr.Type)
+		}
+		assert.Equal(t, []stun.AttrType{stun.AttrMappedAddress, attrTypeSourceAddress, attrTypeChangedAddress}, types,
+			"should send the RFC 3489 attributes only")
+		for attr, want := range map[stun.AttrType]string{
+			stun.AttrMappedAddress: "27.1.1.1",
+			attrTypeSourceAddress:  "1.2.3.4:3479",
+			attrTypeChangedAddress: "1.2.3.5:3479",
+		} {
+			var addr attrAddress
+			if assert.NoError(t, addr.getAs(res, attr), "should succeed") {
+				if attr == stun.AttrMappedAddress {
+					assert.Equal(t, want, addr.IP.String(), "should match")
+				} else {
+					assert.Equal(t, want, addr.String(), "should match")
+				}
+			}
+		}
+	})
+
+	t.Run("auth", func(t *testing.T) {
+		err := v.server.Reload(&STUNServerConfig{
+			PrimaryAddress:   "1.2.3.4:3478",
+			SecondaryAddress: "1.2.3.5:3479",
+			Role:             "both",
+			Auth: &AuthConfig{Handler: func(username, realm string, srcAddr net.Addr) (string, bool) {
+				return "secret", true
+			}},
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		raw, _ := classicExchange()
+		assert.Nil(t, raw, "should drop requests that cannot authenticate")
+	})
+}
+
+func TestClassicRequestRelayedOnVNet(t *testing.T) {
+	v, err := buildVNetSplitRole(&vnet.NATType{
+		MappingBehavior:   vnet.EndpointIndependent,
+		FilteringBehavior: vnet.EndpointIndependent,
+	})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer v.close()
+	conn, err := v.net0.ListenPacket("udp4", "0.0.0.0:0")
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer conn.Close() // nolint:errcheck,gosec
+
+	// asking for a change of IP, answered by the secondary
+	request := []byte{
+		0x00, 0x01, 0x00, 0x08,
+		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+		0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10,
+		0x00, 0x03, 0x00, 0x04, 0x00, 0x00, 0x00, 0x04,
+	}
+	if _, err = conn.WriteTo(request, &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 3478}); !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second)) // nolint:errcheck,gosec
+	n, from, err := conn.ReadFrom(buf)
+	if !assert.NoError(t, err, "should respond") {
+		return
+	}
+	assert.Equal(t, "1.2.3.5:3478", from.String(), "should change the IP")
+	assert.Equal(t, request[4:20], buf[4:20], "should echo the transaction ID")
+	assert.Equal(t, 20+3*12, n, "should send the three RFC 3489 attributes only")
+}
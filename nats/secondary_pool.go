@@ -0,0 +1,355 @@
+package nats
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	secHeartbeatUri string = "/v1/gostun/heartbeat"
+)
+
+var errSecondaryPoolRole = errors.New("secondary pool: only a primary (role \"pri\") has one")
+
+// SecondaryPoolConfig lets a primary (role "pri") relay to several
+// secondaries instead of the single Pri2SecHost. Every secondary runs the
+// same "sec" endpoints on its own IP. The primary sends each of them a
+// heartbeat and relays to the first healthy one, in the listed order;
+// while a secondary is active its IP replaces the IP of the topology's
+// "sec" endpoints, so CHANGED-ADDRESS points at it. Without a healthy
+// secondary the "sec" endpoints are dropped, and a CHANGE-REQUEST needing
+// one is answered with 420 (Unknown Attribute) rather than left
+// unanswered.
+type SecondaryPoolConfig struct {
+	// Secondaries in order of preference.
+	Secondaries []Secondary
+	// Interval between two heartbeats to each secondary, 5 seconds by
+	// default.
+	Interval time.Duration
+	// Timeout of a heartbeat, 1 second by default.
+	Timeout time.Duration
+	// Failures is the number of missed heartbeats in a row taking a
+	// secondary out of the pool, 3 by default. One answered heartbeat
+	// brings it back.
+	Failures int
+}
+
+// Secondary is one member of a SecondaryPoolConfig.
+type Secondary struct {
+	// Host is the relay listener of the secondary, its Pri2SecHost.
+	Host string `json:"host"`
+	// IP is the secondary's address, shared by all its endpoints.
+	IP string `json:"ip"`
+}
+
+// SecondaryStatus is the health of a secondary of the pool.
+type SecondaryStatus struct {
+	Host    string `json:"host"`
+	IP      string `json:"ip"`
+	Healthy bool   `json:"healthy"`
+	// Active is set on the secondary the primary relays to.
+	Active bool `json:"active"`
+	// Failures counts the missed heartbeats since the last answered one.
+	Failures int       `json:"failures"`
+	Error    string    `json:"error,omitempty"`
+	Time     time.Time `json:"time,omitempty"`
+}
+
+type secondaryPool struct {
+	config SecondaryPoolConfig
+	client *http.Client
+	done   chan struct{}
+	stop   sync.Once
+
+	mutex  sync.Mutex
+	status []SecondaryStatus
+}
+
+// newSecondaryPool validates config. Secondaries of previous keep their
+// health; the others are healthy until they miss heartbeats.
+func newSecondaryPool(config *SecondaryPoolConfig, previous *secondaryPool) (*secondaryPool, error) {
+	if len(config.Secondaries) == 0 {
+		return nil, errors.New("secondary pool: no secondaries")
+	}
+	p := &secondaryPool{config: *config, done: make(chan struct{})}
+	if p.config.Interval <= 0 {
+		p.config.Interval = 5 * time.Second
+	}
+	if p.config.Timeout <= 0 {
+		p.config.Timeout = time.Second
+	}
+	if p.config.Failures <= 0 {
+		p.config.Failures = 3
+	}
+	p.client = &http.Client{Timeout: p.config.Timeout}
+
+	known := map[string]SecondaryStatus{}
+	if previous != nil {
+		for _, status := range previous.secondaries() {
+			known[status.Host] = status
+		}
+	}
+	for _, sec := range config.Secondaries {
+		if sec.Host == "" {
+			return nil, errors.New("secondary pool: missing host")
+		}
+		if net.ParseIP(sec.IP) == nil {
+			return nil, fmt.Errorf("secondary pool: %s: bad IP %q", sec.Host, sec.IP)
+		}
+		status, ok := known[sec.Host]
+		if !ok {
+			status = SecondaryStatus{Healthy: true}
+		}
+		status.Host, status.IP, status.Active = sec.Host, sec.IP, false
+		p.status = append(p.status, status)
+	}
+	p.activate(p.pick())
+	return p, nil
+}
+
+func (p *secondaryPool) close() {
+	p.stop.Do(func() { close(p.done) })
+}
+
+// pick returns the first healthy secondary, -1 if none.
+func (p *secondaryPool) pick() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for i, status := range p.status {
+		if status.Healthy {
+			return i
+		}
+	}
+	return -1
+}
+
+// activate marks secondary i, -1 for none, as the active one.
+func (p *secondaryPool) activate(i int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for j := range p.status {
+		p.status[j].Active = j == i
+	}
+}
+
+// secondary returns the config of secondary i, nil if i is -1.
+func (p *secondaryPool) secondary(i int) *Secondary {
+	if i < 0 {
+		return nil
+	}
+	return &p.config.Secondaries[i]
+}
+
+// active returns the index of the active secondary, -1 if none.
+func (p *secondaryPool) active() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for i, status := range p.status {
+		if status.Active {
+			return i
+		}
+	}
+	return -1
+}
+
+func (p *secondaryPool) secondaries() []SecondaryStatus {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]SecondaryStatus(nil), p.status...)
+}
+
+// heartbeat checks that sec is up and serving its endpoints on the IP the
+// primary advertises for it.
+func (p *secondaryPool) heartbeat(sec Secondary) error {
+	resp, err := p.client.Get("http://" + sec.Host + secHeartbeatUri + "?ip=" + url.QueryEscape(sec.IP))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("secondary answered %s", resp.Status)
+	}
+	return nil
+}
+
+// record updates the health of secondary i after a heartbeat and reports
+// whether it changed.
+func (p *secondaryPool) record(i int, err error) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	status := &p.status[i]
+	healthy := status.Healthy
+	status.Time = time.Now()
+	if err == nil {
+		status.Failures, status.Error, status.Healthy = 0, "", true
+	} else {
+		status.Failures++
+		status.Error = err.Error()
+		status.Healthy = status.Failures < p.config.Failures
+	}
+	return status.Healthy != healthy
+}
+
+// heartbeatLoop checks the secondaries of p right away and then every
+// interval, failing over when the active one changes, until p is closed.
+func (s *STUNServer) heartbeatLoop(p *secondaryPool) {
+	ticker := time.NewTicker(p.config.Interval)
+	defer ticker.Stop()
+	for {
+		s.checkSecondaries(p)
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkSecondaries sends a heartbeat to every secondary of p in parallel
+// and moves the relay to the first healthy one.
+func (s *STUNServer) checkSecondaries(p *secondaryPool) {
+	statuses := p.secondaries()
+	errs := make([]error, len(statuses))
+	wg := sync.WaitGroup{}
+	for i, status := range statuses {
+		wg.Add(1)
+		go func(i int, sec Secondary) {
+			defer wg.Done()
+			errs[i] = p.heartbeat(sec)
+		}(i, Secondary{Host: status.Host, IP: status.IP})
+	}
+	wg.Wait()
+
+	select {
+	case <-p.done:
+		return // closed or replaced during the round
+	default:
+	}
+	for i, err := range errs {
+		if !p.record(i, err) {
+			continue
+		}
+		if err == nil {
+			s.log.Infof("secondary %s is back", statuses[i].Host)
+		} else {
+			s.log.Warnf("secondary %s is down: %s", statuses[i].Host, err.Error())
+		}
+	}
+
+	if i := p.pick(); i != p.active() {
+		s.failover(p, i)
+	}
+}
+
+// failover makes secondary i of p, -1 for none, the active one and
+// rebuilds the endpoints around it.
+func (s *STUNServer) failover(p *secondaryPool, i int) {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.pool != p {
+		return
+	}
+	sec := p.secondary(i)
+	endpoints, err := newTopology(s.net, withSecondary(s.topology, sec))
+	if err == nil {
+		// only "pri" endpoints are listened on, and they did not move
+		_, _, err = s.bind(endpoints)
+	}
+	if err != nil {
+		s.log.Errorf("secondary pool: failover: %s", err.Error())
+		return
+	}
+	p.activate(i)
+	s.endpoints, s.byName = endpoints, map[string]*endpoint{}
+	s.generation++
+	for _, e := range endpoints {
+		s.byName[e.Name] = e
+	}
+	if sec == nil {
+		s.pri2SecHost = ""
+		s.log.Warnf("secondary pool: no healthy secondary, CHANGE-REQUESTs for the secondary IP are refused")
+		return
+	}
+	s.pri2SecHost = sec.Host
+	s.log.Infof("secondary pool: relaying to %s (%s)", sec.Host, sec.IP)
+}
+
+// withSecondary returns topology with the IP of sec on its "sec"
+// endpoints, or without them if sec is nil. Endpoints named after their
+// address are renamed, and the references to them follow.
+func withSecondary(topology []Endpoint, sec *Secondary) []Endpoint {
+	renamed := map[string]string{}
+	var endpoints []Endpoint
+	for _, e := range topology {
+		name := e.Name
+		if name == "" {
+			name = e.Address
+		}
+		if e.Host != "sec" {
+			endpoints = append(endpoints, e)
+			continue
+		}
+		if sec == nil {
+			renamed[name] = ""
+			continue
+		}
+		_, port, err := net.SplitHostPort(e.Address)
+		if err != nil {
+			// left for newTopology to report
+			endpoints = append(endpoints, e)
+			continue
+		}
+		e.Address = net.JoinHostPort(sec.IP, port)
+		if e.Name == "" {
+			renamed[name] = e.Address
+		}
+		endpoints = append(endpoints, e)
+	}
+
+	for i := range endpoints {
+		for _, partner := range []*string{&endpoints[i].ChangeIP, &endpoints[i].ChangePort, &endpoints[i].ChangeBoth} {
+			if name, ok := renamed[*partner]; ok {
+				*partner = name
+			}
+		}
+	}
+	return endpoints
+}
+
+// Secondaries returns the health of the secondary pool, nil without one.
+func (s *STUNServer) Secondaries() []SecondaryStatus {
+	s.mutex.RLock()
+	p := s.pool
+	s.mutex.RUnlock()
+	if p == nil {
+		return nil
+	}
+	return p.secondaries()
+}
+
+// heartbeatHandler answers the heartbeats of a primary's pool, with 503
+// unless this server listens on an endpoint with the IP the primary
+// advertises for it.
+func (s *STUNServer) heartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	ip := net.ParseIP(r.URL.Query().Get("ip"))
+	if ip == nil {
+		http.Error(w, "missing or bad ip", http.StatusBadRequest)
+		return
+	}
+	s.mutex.RLock()
+	listening := false
+	for _, e := range s.endpoints {
+		listening = listening || e.conn != nil && e.addr.IP.Equal(ip)
+	}
+	s.mutex.RUnlock()
+	if !listening {
+		http.Error(w, "not listening on "+ip.String(), http.StatusServiceUnavailable)
+	}
+}
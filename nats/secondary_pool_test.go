@@ -0,0 +1,242 @@
+package nats
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+// buildVNetPool runs a primary on 1.2.3.4 with a pool of secondaries on
+// 1.2.3.5 and 1.2.3.6, and returns the secondaries' relays.
+func buildVNetPool(natType *vnet.NATType) (*virtualNet, []*httptest.Server, error) {
+	v, serverNets, err := buildTopology([][]string{{"1.2.3.4"}, {"1.2.3.5"}, {"1.2.3.6"}}, natType)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var relays []*httptest.Server
+	var secondaries []Secondary
+	for i, ip := range []string{"1.2.3.5", "1.2.3.6"} {
+		sec, err := NewSTUNServer(&STUNServerConfig{
+			PrimaryAddress:   "1.2.3.4:3478",
+			SecondaryAddress: ip + ":3479",
+			Net:              serverNets[i+1],
+			Role:             "sec",
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		if err = sec.Start(); err != nil {
+			return nil, nil, err
+		}
+		relay := httptest.NewServer(sec.relayHandler())
+		v.cleanup = append(v.cleanup, relay.Close, func() {
+			sec.Close() // nolint:errcheck,gosec
+		})
+		relays = append(relays, relay)
+		secondaries = append(secondaries, Secondary{Host: relay.Listener.Addr().String(), IP: ip})
+	}
+
+	v.server, err = NewSTUNServer(&STUNServerConfig{
+		PrimaryAddress:   "1.2.3.4:3478",
+		SecondaryAddress: "1.2.3.5:3479",
+		Net:              serverNets[0],
+		Role:             "pri",
+		SecondaryPool: &SecondaryPoolConfig{
+			Secondaries: secondaries,
+			Interval:    20 * time.Millisecond,
+			Timeout:     100 * time.Millisecond,
+			Failures:    2,
+		},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = v.server.Start(); err != nil {
+		return nil, nil, err
+	}
+	return v, relays, nil
+}
+
+// activeSecondary returns the IP of the secondary s relays to, "" if none.
+func activeSecondary(s *STUNServer) string {
+	for _, sec := range s.Secondaries() {
+		if sec.Active {
+			return sec.IP
+		}
+	}
+	return ""
+}
+
+func TestSecondaryPoolOnVNet(t *testing.T) {
+	v, relays, err := buildVNetPool(&vnet.NATType{
+		MappingBehavior:   vnet.EndpointIndependent,
+		FilteringBehavior: vnet.EndpointIndependent,
+	})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer v.close()
+
+	conn, err := v.net0.ListenPacket("udp4", "0.0.0.0:0")
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer conn.Close() // nolint:errcheck,gosec
+
+	// check that the change of IP is answered by the secondary on ip, and
+	// advertised as such
+	checkActive := func(ip string) {
+		res, _ := exchange(t, conn, "1.2.3.4:3478")
+		if assert.NotNil(t, res, "should respond") {
+			changed, err := getChangedAddress(res)
+			if assert.NoError(t, err, "should succeed") {
+				assert.Equal(t, ip+":3479", changed.String(), "should advertise the active secondary")
+			}
+		}
+		res, from := exchange(t, conn, "1.2.3.4:3478", &attrChangeRequest{ChangeIP: true})
+		if assert.NotNil(t, res, "should respond") {
+			assert.Equal(t, ip+":3478", from.String(), "should answer from the active secondary")
+		}
+
+		n, err := NewNATS(&Config{Server: "1.2.3.4:3478", Net: v.net0})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		result, err := n.Discover()
+		if assert.NoError(t, err, "should succeed") {
+			assert.Equal(t, FullCone, result.NATType, "should match")
+		}
+	}
+
+	assert.Equal(t, "1.2.3.5", activeSecondary(v.server), "should prefer the first secondary")
+	checkActive("1.2.3.5")
+
+	relays[0].Close()
+	assert.Eventually(t, func() bool {
+		return activeSecondary(v.server) == "1.2.3.6"
+	}, 5*time.Second, 10*time.Millisecond, "should fail over")
+	checkActive("1.2.3.6")
+
+	// a reload keeps the health of the secondaries it keeps
+	var secondaries []Secondary
+	for _, sec := range v.server.Secondaries() {
+		secondaries = append(secondaries, Secondary{Host: sec.Host, IP: sec.IP})
+	}
+	err = v.server.Reload(&STUNServerConfig{
+		PrimaryAddress:   "1.2.3.4:3478",
+		SecondaryAddress: "1.2.3.5:3479",
+		Role:             "pri",
+		SecondaryPool: &SecondaryPoolConfig{
+			Secondaries: secondaries,
+			Interval:    20 * time.Millisecond,
+			Timeout:     100 * time.Millisecond,
+			Failures:    2,
+		},
+	})
+	if assert.NoError(t, err, "should succeed") {
+		assert.Equal(t, "1.2.3.6", activeSecondary(v.server), "should stay on the healthy secondary")
+		checkActive("1.2.3.6")
+	}
+
+	relays[1].Close()
+	assert.Eventually(t, func() bool {
+		return activeSecondary(v.server) == ""
+	}, 5*time.Second, 10*time.Millisecond, "should run out of secondaries")
+	res, _ := exchange(t, conn, "1.2.3.4:3478", &attrChangeRequest{ChangeIP: true})
+	if assert.NotNil(t, res, "should respond") {
+		var code stun.ErrorCodeAttribute
+		if assert.NoError(t, code.GetFrom(res), "should be an error") {
+			assert.Equal(t, stun.CodeUnknownAttribute, code.Code, "should refuse the change")
+		}
+	}
+	res, _ = exchange(t, conn, "1.2.3.4:3478")
+	if assert.NotNil(t, res, "should respond") {
+		assert.False(t, res.Contains(attrTypeChangedAddress), "should not advertise a secondary")
+	}
+
+	rec := httptest.NewRecorder()
+	v.server.SelfTestHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code, "should be unhealthy")
+	var report selfTestReport
+	if assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report), "should succeed") {
+		assert.Len(t, report.Secondaries, 2, "should report the pool")
+	}
+}
+
+func TestWithSecondary(t *testing.T) {
+	topology := []Endpoint{
+		{Address: "1.2.3.4:3478", ChangeIP: "1.2.3.5:3478", ChangeBoth: "far"},
+		{Address: "1.2.3.5:3478", Host: "sec", ChangeIP: "1.2.3.4:3478"},
+		{Name: "far", Address: "1.2.3.5:3479", Host: "sec"},
+	}
+
+	assert.Equal(t, []Endpoint{
+		{Address: "1.2.3.4:3478", ChangeIP: "1.2.3.6:3478", ChangeBoth: "far"},
+		{Address: "1.2.3.6:3478", Host: "sec", ChangeIP: "1.2.3.4:3478"},
+		{Name: "far", Address: "1.2.3.6:3479", Host: "sec"},
+	}, withSecondary(topology, &Secondary{IP: "1.2.3.6"}), "should move the secondary's endpoints")
+
+	assert.Equal(t, []Endpoint{
+		{Address: "1.2.3.4:3478"},
+	}, withSecondary(topology, nil), "should drop the secondary's endpoints")
+
+	_, err := NewSTUNServer(&STUNServerConfig{
+		PrimaryAddress:   "1.2.3.4:3478",
+		SecondaryAddress: "1.2.3.5:3479",
+		Role:             "pri",
+		SecondaryPool:    &SecondaryPoolConfig{Secondaries: []Secondary{{Host: "10.0.0.2:8080", IP: "x"}}},
+	})
+	assert.Error(t, err, "should reject a bad IP")
+
+	for _, role := range []string{"sec", "both"} {
+		_, err = NewSTUNServer(&STUNServerConfig{
+			PrimaryAddress:   "1.2.3.4:3478",
+			SecondaryAddress: "1.2.3.5:3479",
+			Role:             role,
+			SecondaryPool:    &SecondaryPoolConfig{Secondaries: []Secondary{{Host: "10.0.0.2:8080", IP: "1.2.3.5"}}},
+		})
+		assert.Equal(t, errSecondaryPoolRole, err, "should reject a pool on role %s", role)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	v, relays, err := buildVNetPool(&vnet.NATType{
+		MappingBehavior:   vnet.EndpointIndependent,
+		FilteringBehavior: vnet.EndpointIndependent,
+	})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer v.close()
+
+	for query, code := range map[string]int{
+		"?ip=1.2.3.5": http.StatusOK,
+		"?ip=1.2.3.6": http.StatusServiceUnavailable,
+		"":            http.StatusBadRequest,
+	} {
+		resp, err := http.Get(relays[0].URL + secHeartbeatUri + query)
+		if assert.NoError(t, err, "should succeed") {
+			resp.Body.Close() // nolint:errcheck,gosec
+			assert.Equal(t, code, resp.StatusCode, "should answer %q", query)
+		}
+	}
+
+	p, err := newSecondaryPool(&SecondaryPoolConfig{Secondaries: []Secondary{
+		{Host: relays[0].Listener.Addr().String(), IP: "1.2.3.5"},
+		{Host: relays[1].Listener.Addr().String(), IP: "1.2.3.5"},
+	}}, nil)
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	v.server.checkSecondaries(p)
+	statuses := p.secondaries()
+	assert.Zero(t, statuses[0].Failures, "should pass the heartbeat")
+	assert.Equal(t, 1, statuses[1].Failures, "should fail a secondary advertised on another IP")
+}
@@ -0,0 +1,262 @@
+package nats
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+// SelfTestConfig enables a background test of the server's own paths, run
+// by a primary (roles "pri" and "both"). Each round sends, from the
+// server's network, a plain binding request to every endpoint, and every
+// available CHANGE-REQUEST to the endpoints this server listens on, the
+// way a client's Discover does. The response must come from the expected
+// partner, so a broken secondary or relay shows up as failed paths. A
+// reload keeps the settings; the next round tests the new topology.
+type SelfTestConfig struct {
+	// Interval between two rounds, 30 seconds by default.
+	Interval time.Duration
+	// RTO is the retransmission timeout of the probes, 200ms by default.
+	// A path fails after 7 transmissions without response.
+	RTO time.Duration
+	// Username and Password sign the probes when the server has Auth.
+	// LongTermAuth selects long-term credentials.
+	Username     string
+	Password     string
+	LongTermAuth bool
+}
+
+// SelfTestResult is the outcome of one path in the last round.
+type SelfTestResult struct {
+	// Path is "<endpoint>/<change>", change being none, port, ip or both.
+	Path     string `json:"path"`
+	Endpoint string `json:"endpoint"`
+	Change   string `json:"change"`
+	// Want is the address the response must come from, From the one it
+	// came from.
+	Want  string    `json:"want"`
+	From  string    `json:"from,omitempty"`
+	OK    bool      `json:"ok"`
+	Error string    `json:"error,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// selfTestChanges are the CHANGE-REQUESTs of a round; "none" sends none.
+var selfTestChanges = []struct {
+	name                 string
+	changeIP, changePort bool
+}{
+	{"none", false, false},
+	{"port", false, true},
+	{"ip", true, false},
+	{"both", true, true},
+}
+
+type selfTest struct {
+	configured SelfTestConfig // as given, to detect changes on reload
+	config     SelfTestConfig // with defaults
+	auth       *clientAuth
+	done       chan struct{}
+	stop       sync.Once
+
+	mutex   sync.Mutex
+	results []SelfTestResult // nil until the first round completes
+}
+
+func newSelfTest(config *SelfTestConfig) *selfTest {
+	t := &selfTest{
+		configured: *config,
+		config:     *config,
+		auth: newClientAuth(&Config{
+			Username:     config.Username,
+			Password:     config.Password,
+			LongTermAuth: config.LongTermAuth,
+		}),
+		done: make(chan struct{}),
+	}
+	if t.config.Interval <= 0 {
+		t.config.Interval = 30 * time.Second
+	}
+	return t
+}
+
+func (t *selfTest) close() {
+	t.stop.Do(func() { close(t.done) })
+}
+
+// selfTestLoop runs a round right away and then every interval until the
+// server is closed.
+func (s *STUNServer) selfTestLoop(t *selfTest) {
+	ticker := time.NewTicker(t.config.Interval)
+	defer ticker.Stop()
+	for {
+		s.runSelfTest(t)
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runSelfTest probes every path of the current topology in parallel,
+// records the results and logs the paths that passed or failed since the
+// previous round.
+func (s *STUNServer) runSelfTest(t *selfTest) {
+	type path struct {
+		e, want              *endpoint
+		change               string
+		changeIP, changePort bool
+	}
+	var paths []path
+	s.mutex.RLock()
+	for _, e := range s.endpoints {
+		for _, c := range selfTestChanges {
+			// only the server receiving a request can hand it to a partner
+			if c.name != "none" && !s.listensOn(e) {
+				break
+			}
+			if want := e.partner(c.changeIP, c.changePort); want != nil {
+				paths = append(paths, path{e, want, c.name, c.changeIP, c.changePort})
+			}
+		}
+	}
+	s.mutex.RUnlock()
+
+	results := make([]SelfTestResult, len(paths))
+	wg := sync.WaitGroup{}
+	for i, p := range paths {
+		wg.Add(1)
+		go func(r *SelfTestResult, p path) {
+			defer wg.Done()
+			*r = SelfTestResult{
+				Path:     p.e.Name + "/" + p.change,
+				Endpoint: p.e.Name,
+				Change:   p.change,
+				Want:     p.want.addr.String(),
+			}
+			from, err := s.selfTestProbe(t, p.e, p.want, p.changeIP, p.changePort)
+			if from != nil {
+				r.From = from.String()
+			}
+			if err != nil {
+				r.Error = err.Error()
+			}
+			r.OK = err == nil
+			r.Time = time.Now()
+		}(&results[i], p)
+	}
+	wg.Wait()
+
+	select {
+	case <-t.done:
+		return // closed during the round, the failures are ours
+	default:
+	}
+
+	t.mutex.Lock()
+	previous := map[string]bool{}
+	for _, r := range t.results {
+		previous[r.Path] = r.OK
+	}
+	t.results = results
+	t.mutex.Unlock()
+
+	for _, r := range results {
+		if ok, known := previous[r.Path]; known && ok == r.OK {
+			continue
+		}
+		if r.OK {
+			s.log.Infof("self-test %s passed", r.Path)
+		} else {
+			s.log.Warnf("self-test %s failed: %s", r.Path, r.Error)
+		}
+	}
+}
+
+// selfTestProbe sends a binding request with the given CHANGE-REQUEST to
+// e from a new socket and checks that want answered it.
+func (s *STUNServer) selfTestProbe(t *selfTest, e, want *endpoint, changeIP, changePort bool) (net.Addr, error) {
+	network, local := "udp4", "0.0.0.0:0"
+	if e.addr.IP.To4() == nil {
+		network, local = "udp6", "[::]:0"
+	}
+	conn, err := s.net.ListenPacket(network, local)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close() // nolint:errcheck,gosec
+
+	client := &NATS{serverAddr: e.addr, net: s.net, auth: t.auth}
+	attrs := []stun.Setter{stun.TransactionID, stun.BindingRequest}
+	if changeIP || changePort {
+		attrs = append(attrs, &attrChangeRequest{ChangeIP: changeIP, ChangePort: changePort})
+	}
+	res, from, err := client.performTransaction(ownConn(conn, t.config.RTO), e.addr, attrs...)
+	if err == errTransactionTimeout {
+		return nil, errors.New("no response")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = getMappedAddress(res); err != nil {
+		return from, err
+	}
+	if from.String() != want.addr.String() {
+		return from, fmt.Errorf("answered from %s", from.String())
+	}
+	return from, nil
+}
+
+// SelfTestResults returns the results of the last self-test round, nil if
+// the self-test is disabled or has not completed a round yet.
+func (s *STUNServer) SelfTestResults() []SelfTestResult {
+	if s.selfTest == nil {
+		return nil
+	}
+	s.selfTest.mutex.Lock()
+	defer s.selfTest.mutex.Unlock()
+	return append([]SelfTestResult(nil), s.selfTest.results...)
+}
+
+// selfTestReport is the body served by SelfTestHandler.
+type selfTestReport struct {
+	Healthy     bool              `json:"healthy"`
+	Paths       []SelfTestResult  `json:"paths"`
+	Secondaries []SecondaryStatus `json:"secondaries,omitempty"`
+}
+
+// SelfTestHandler serves the last self-test round and the secondary pool
+// as JSON, with status 503 when a path failed, no round has completed yet
+// or no secondary of the pool is healthy.
+func (s *STUNServer) SelfTestHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		results := s.SelfTestResults()
+		report := selfTestReport{Healthy: len(results) > 0, Paths: results, Secondaries: s.Secondaries()}
+		for _, result := range results {
+			report.Healthy = report.Healthy && result.OK
+		}
+		if report.Secondaries != nil {
+			active := false
+			for _, sec := range report.Secondaries {
+				active = active || sec.Active
+			}
+			report.Healthy = report.Healthy && active
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if !report.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			s.log.Warnf("self-test report: %s", err.Error())
+		}
+	})
+}
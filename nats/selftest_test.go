@@ -0,0 +1,128 @@
+package nats
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+// selfTestPaths waits for a round where cond holds and returns its results
+// by path.
+func selfTestPaths(t *testing.T, s *STUNServer, cond func(map[string]SelfTestResult) bool) map[string]SelfTestResult {
+	paths := map[string]SelfTestResult{}
+	assert.Eventually(t, func() bool {
+		paths = map[string]SelfTestResult{}
+		for _, r := range s.SelfTestResults() {
+			paths[r.Path] = r
+		}
+		return len(paths) > 0 && cond(paths)
+	}, 10*time.Second, 50*time.Millisecond, "should complete a round")
+	return paths
+}
+
+func healthStatus(t *testing.T, s *STUNServer) (int, *selfTestReport) {
+	w := httptest.NewRecorder()
+	s.SelfTestHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	report := &selfTestReport{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), report), "should be JSON")
+	return w.Code, report
+}
+
+func TestSelfTestOnVNet(t *testing.T) {
+	v, err := buildVNetSplitRoleWith(&vnet.NATType{
+		MappingBehavior:   vnet.EndpointIndependent,
+		FilteringBehavior: vnet.EndpointIndependent,
+	}, &STUNServerConfig{SelfTest: &SelfTestConfig{Interval: 100 * time.Millisecond, RTO: 20 * time.Millisecond}})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer v.close()
+
+	t.Run("healthy", func(t *testing.T) {
+		paths := selfTestPaths(t, v.server, func(paths map[string]SelfTestResult) bool {
+			return paths["1.2.3.4:3478/ip"].OK
+		})
+		// the primary's endpoints with all changes, the secondary's plain
+		assert.Len(t, paths, 10, "should test every path")
+		for path, r := range paths {
+			assert.True(t, r.OK, "%s should pass: %s", path, r.Error)
+		}
+		assert.Equal(t, "1.2.3.5:3479", paths["1.2.3.4:3478/both"].From, "should be answered by the secondary")
+		assert.Contains(t, paths, "1.2.3.5:3478/none", "should test the secondary")
+		assert.NotContains(t, paths, "1.2.3.5:3478/ip", "should not ask the secondary to relay")
+
+		code, report := healthStatus(t, v.server)
+		assert.Equal(t, http.StatusOK, code, "should be healthy")
+		assert.True(t, report.Healthy, "should be healthy")
+	})
+
+	t.Run("relay down", func(t *testing.T) {
+		v.cleanup[0]() // close the relay
+		paths := selfTestPaths(t, v.server, func(paths map[string]SelfTestResult) bool {
+			return !paths["1.2.3.4:3478/ip"].OK
+		})
+		for _, path := range []string{"1.2.3.4:3478/ip", "1.2.3.4:3478/both", "1.2.3.4:3479/ip", "1.2.3.4:3479/both"} {
+			assert.False(t, paths[path].OK, "%s should fail", path)
+		}
+		for _, path := range []string{"1.2.3.4:3478/none", "1.2.3.4:3478/port", "1.2.3.5:3478/none"} {
+			assert.True(t, paths[path].OK, "%s should pass", path)
+		}
+
+		code, report := healthStatus(t, v.server)
+		assert.Equal(t, http.StatusServiceUnavailable, code, "should be unhealthy")
+		assert.False(t, report.Healthy, "should be unhealthy")
+	})
+}
+
+func TestSelfTestDisabled(t *testing.T) {
+	v, err := buildVNet(&vnet.NATType{
+		MappingBehavior:   vnet.EndpointIndependent,
+		FilteringBehavior: vnet.EndpointIndependent,
+	})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer v.close()
+
+	assert.Nil(t, v.server.SelfTestResults(), "should not run")
+	code, _ := healthStatus(t, v.server)
+	assert.Equal(t, http.StatusServiceUnavailable, code, "should not claim health")
+}
+
+func TestSelfTestWithRedirect(t *testing.T) {
+	v, err := buildVNetWithServer(&vnet.NATType{
+		MappingBehavior:   vnet.EndpointIndependent,
+		FilteringBehavior: vnet.EndpointIndependent,
+	}, &STUNServerConfig{
+		SelfTest: &SelfTestConfig{Interval: 100 * time.Millisecond, RTO: 20 * time.Millisecond},
+		Redirect: &RedirectConfig{Alternates: []Alternate{{Address: "1.2.4.4:3478", Weight: 1}}, MaxRate: 1},
+	})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer v.close()
+
+	// every round probes the primary from new ports, which would exhaust
+	// MaxRate and be redirected if the self-test were treated as a client
+	for round := 0; round < 3; round++ {
+		prev := v.server.SelfTestResults()
+		paths := selfTestPaths(t, v.server, func(map[string]SelfTestResult) bool {
+			results := v.server.SelfTestResults()
+			return len(prev) == 0 || len(results) > 0 && results[0].Time.After(prev[0].Time)
+		})
+		for path, r := range paths {
+			assert.True(t, r.OK, "%s should pass: %s", path, r.Error)
+		}
+	}
+	code, _ := healthStatus(t, v.server)
+	assert.Equal(t, http.StatusOK, code, "should be healthy")
+
+	v.server.redirect.mutex.Lock()
+	assert.Empty(t, v.server.redirect.clients, "should not charge the self-test")
+	v.server.redirect.mutex.Unlock()
+}
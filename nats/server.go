@@ -2,6 +2,7 @@ package nats
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,12 +10,15 @@ import (
 	"net"
 	"net/http"
 	"os"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/pion/logging"
 	"github.com/pion/stun"
 	"github.com/pion/transport/vnet"
+	turnv2 "github.com/pion/turn/v2"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -28,22 +32,92 @@ type STUNServerConfig struct {
 	Role             string
 	Pri2SecHost      string
 	LogLevel         logging.LogLevel
+	// Auth enables credential checks on binding requests, nil leaves the
+	// server open to anyone.
+	Auth *AuthConfig
+	// TURN runs a relay next to the binding service on the primary IP
+	// (roles "pri" and "both"), nil disables it.
+	TURN *TURNConfig
+	// Rendezvous enables the hole-punching rendezvous service, nil
+	// disables it.
+	Rendezvous *RendezvousConfig
+	// Topology lists the endpoints explicitly, replacing the four derived
+	// from PrimaryAddress and SecondaryAddress. The first one is the
+	// primary address, where TURN runs.
+	Topology []Endpoint
+	// AccessLog records every request as a JSON line, nil disables it.
+	AccessLog *AccessLogConfig
+	// TracerProvider receives a span per request, with the relay hop and
+	// the secondary's handling in the same trace. Nil disables tracing;
+	// pass otel.GetTracerProvider() to use the global provider.
+	TracerProvider trace.TracerProvider
+	// Propagator carries the trace context over the relay, defaulting to
+	// W3C Trace Context.
+	Propagator propagation.TextMapPropagator
+	// Software is sent in the SOFTWARE attribute, empty to omit it.
+	Software string
+	// ResponseProfile selects the attributes of binding responses.
+	ResponseProfile ResponseProfile
+	// Workers is the number of goroutines reading each endpoint, 1 by
+	// default. On Linux each has its own SO_REUSEPORT socket; elsewhere,
+	// and on a virtual network, they share one. It cannot change on reload.
+	Workers int
+	// BatchSize above 1 makes each worker read, and answer, up to that many
+	// datagrams per system call (recvmmsg/sendmmsg). It only applies on
+	// Linux and the real network; elsewhere datagrams are handled one by
+	// one. It cannot change on reload.
+	BatchSize int
+	// SelfTest periodically checks the server's paths as a client would,
+	// nil disables it.
+	SelfTest *SelfTestConfig
+	// SecondaryPool replaces Pri2SecHost of a primary (role "pri") with
+	// several secondaries and fails over between them, nil disables it.
+	// Other roles reject it.
+	SecondaryPool *SecondaryPoolConfig
+	// Redirect sends some clients to other servers with 300 (Try
+	// Alternate), nil answers them all.
+	Redirect *RedirectConfig
 }
+
+// priToSec relays a request received on endpoint Received to the
+// secondary, which answers it from endpoint Endpoint.
 type priToSec struct {
-	From  *net.UDPAddr  `json:"from"`
-	M     *stun.Message `json:"m"`
-	Index int           `json:"index"`
+	From     *net.UDPAddr  `json:"from"`
+	M        *stun.Message `json:"m"`
+	Received string        `json:"received"`
+	Endpoint string        `json:"endpoint"`
 }
 
 type STUNServer struct {
-	priAddrs    []*net.UDPAddr
-	secAddrs    []*net.UDPAddr
-	conns       []net.PacketConn
-	software    stun.Software
-	net         *vnet.Net
-	log         logging.LeveledLogger
+	net        *vnet.Net
+	log        logging.LeveledLogger
+	role       string
+	tracer     trace.Tracer
+	tracing    bool
+	propagator propagation.TextMapPropagator
+	selfTest   *selfTest
+	workers    int
+	batchSize  int
+
+	// reloadMutex serializes Reload and failover, which replace the fields
+	// below; mutex guards them
+	reloadMutex sync.Mutex
+	mutex       sync.RWMutex
+	topology    []Endpoint // as configured, before the pool's changes
+	endpoints   []*endpoint
+	generation  uint64 // bumped whenever endpoints is replaced
+	byName      map[string]*endpoint
+	pool        *secondaryPool
 	pri2SecHost string
-	role        string
+	auth        *serverAuth
+	logLevel    logging.LogLevel
+	turnConfig  *TURNConfig
+	turnServer  *turnv2.Server
+	rendezvous  *rendezvous
+	accessLog   *accessLog
+	redirect    *redirect
+	software    stun.Software
+	response    responseAttrs
 }
 
 // parseReq 解析http请求
@@ -61,29 +135,58 @@ func parseReq(req *http.Request, result interface{}) error {
 }
 
 func (s *STUNServer) priToSecHandler(w http.ResponseWriter, r *http.Request) {
+	// continue the trace of the primary
+	ctx := s.propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
 	pts := &priToSec{}
 	err := parseReq(r, pts)
 	if err != nil {
 		s.log.Errorf("parseReq err from pri %v", err)
+		_, span := s.startSpan(ctx, "stun.relayed", nil)
+		s.finish(nil, span, nil, nil, nil, relayFromPrimary, outcomeMalformed, err)
 		http.Error(w, "parseReq err from pri ", http.StatusBadRequest)
 		return
 	}
-	err = s.handleBindingRequest(pts.From, pts.M, s.conns[pts.Index-2])
+	_, span := s.startSpan(ctx, "stun.relayed", pts.From)
+
+	st := s.snapshot()
+	s.mutex.RLock()
+	received, respond := s.byName[pts.Received], s.byName[pts.Endpoint]
+	s.mutex.RUnlock()
+	if respond == nil || respond.conn == nil {
+		s.log.Errorf("no local endpoint %s", pts.Endpoint)
+		s.finish(&st, span, received, pts.From, pts.M, relayFromPrimary, outcomeFailed,
+			fmt.Errorf("no local endpoint %s", pts.Endpoint))
+		http.Error(w, "no local endpoint "+pts.Endpoint, http.StatusBadRequest)
+		return
+	}
+	span.SetAttributes(attrKeyResponder.String(respond.Name))
+	err = s.handleBindingRequest(&st, pts.From, pts.M, received, respond, nil,
+		s.responseIntegrity(st.auth, pts.From, pts.M))
 	if err != nil {
 		s.log.Errorf("handleBindingRequest err")
+		s.finish(&st, span, received, pts.From, pts.M, relayFromPrimary, outcomeFailed, err)
 		http.Error(w, "handleBindingRequest err", http.StatusInternalServerError)
 		return
 	}
+	s.finish(&st, span, received, pts.From, pts.M, relayFromPrimary, outcomeOK, nil)
 }
+
+// relayHandler serves the relay and the heartbeats of primaries.
+func (s *STUNServer) relayHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(priToSecUri, s.priToSecHandler)
+	mux.HandleFunc(secHeartbeatUri, s.heartbeatHandler)
+	return mux
+}
+
 func (s *STUNServer) StartListenServer() {
 	server := &http.Server{
 		Addr:         s.pri2SecHost,
 		ReadTimeout:  3 * time.Second,
 		WriteTimeout: 3 * time.Second,
 		IdleTimeout:  120 * time.Second,
-		Handler:      http.DefaultServeMux,
+		Handler:      s.relayHandler(),
 	}
-	http.HandleFunc(priToSecUri, s.priToSecHandler)
 	if err := server.ListenAndServe(); err != nil {
 		s.log.Errorf("HTTP server error: %s", err.Error())
 	}
@@ -95,236 +198,519 @@ func NewSTUNServer(config *STUNServerConfig) (*STUNServer, error) {
 	}
 	log := logging.NewDefaultLeveledLoggerForScope("", config.LogLevel, os.Stdout)
 
-	pri := strings.Split(config.PrimaryAddress, ":")
-	if len(pri) < 2 {
-		pri = append(pri, "3478")
-	}
-	sec := strings.Split(config.SecondaryAddress, ":")
-	if len(sec) < 2 {
-		sec = append(sec, "3478")
-	}
-
 	if config.Net == nil {
 		config.Net = vnet.NewNet(nil)
 	}
-	var priAddrs []*net.UDPAddr
-	var secAddrs []*net.UDPAddr
-
-	addr0, err := config.Net.ResolveUDPAddr(
-		"udp", fmt.Sprintf("%s:%s", pri[0], pri[1]))
-	if err != nil {
-		return nil, err
+	topology := config.Topology
+	if len(topology) == 0 {
+		topology = defaultTopology(config.PrimaryAddress, config.SecondaryAddress)
 	}
-	priAddrs = append(priAddrs, addr0)
-
-	addr1, err := config.Net.ResolveUDPAddr(
-		"udp", fmt.Sprintf("%s:%s", pri[0], sec[1]))
-	if err != nil {
-		return nil, err
+	pri2SecHost, serving := config.Pri2SecHost, topology
+	var pool *secondaryPool
+	if config.SecondaryPool != nil {
+		if config.Role != "pri" {
+			return nil, errSecondaryPoolRole
+		}
+		var err error
+		if pool, err = newSecondaryPool(config.SecondaryPool, nil); err != nil {
+			return nil, err
+		}
+		// all secondaries are healthy until they miss heartbeats
+		sec := pool.secondary(pool.active())
+		pri2SecHost, serving = sec.Host, withSecondary(topology, sec)
 	}
-	priAddrs = append(priAddrs, addr1)
-	addr2, err := config.Net.ResolveUDPAddr(
-		"udp", fmt.Sprintf("%s:%s", sec[0], pri[1]))
+	endpoints, err := newTopology(config.Net, serving)
 	if err != nil {
 		return nil, err
 	}
-	secAddrs = append(secAddrs, addr2)
+	byName := map[string]*endpoint{}
+	var bindings []*net.UDPAddr
+	for _, e := range endpoints {
+		byName[e.Name] = e
+		bindings = append(bindings, e.addr)
+	}
 
-	addr3, err := config.Net.ResolveUDPAddr(
-		"udp", fmt.Sprintf("%s:%s", sec[0], sec[1]))
+	response, err := config.ResponseProfile.attrs()
 	if err != nil {
 		return nil, err
 	}
-	secAddrs = append(secAddrs, addr3)
-	return &STUNServer{priAddrs: priAddrs, secAddrs: secAddrs, net: config.Net, log: log, role: config.Role, pri2SecHost: config.Pri2SecHost}, nil
+	if config.Workers < 0 {
+		return nil, errors.New("invalid number of workers")
+	}
+	if config.BatchSize < 0 {
+		return nil, errors.New("invalid batch size")
+	}
+	var auth *serverAuth
+	if config.Auth != nil {
+		auth, err = newServerAuth(config.Auth, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.TURN != nil {
+		if err = config.TURN.validate(bindings...); err != nil {
+			return nil, err
+		}
+	}
+	var rv *rendezvous
+	if config.Rendezvous != nil {
+		rv = newRendezvous(config.Rendezvous)
+	}
+	var rd *redirect
+	if config.Redirect != nil {
+		if rd, err = newRedirect(config.Net, config.Redirect); err != nil {
+			return nil, err
+		}
+	}
+	var al *accessLog
+	if config.AccessLog != nil {
+		if al, err = newAccessLog(config.AccessLog); err != nil {
+			return nil, err
+		}
+	}
+	tp := config.TracerProvider
+	if tp == nil {
+		tp = trace.NewNoopTracerProvider()
+	}
+	propagator := config.Propagator
+	if propagator == nil {
+		propagator = propagation.TraceContext{}
+	}
+	var st *selfTest
+	if config.SelfTest != nil && config.Role != "sec" {
+		st = newSelfTest(config.SelfTest)
+	}
+	return &STUNServer{topology: topology, endpoints: endpoints, byName: byName, pool: pool, net: config.Net, log: log, role: config.Role, pri2SecHost: pri2SecHost, auth: auth,
+		logLevel: config.LogLevel, turnConfig: config.TURN, rendezvous: rv, accessLog: al, redirect: rd,
+		software: newSoftware(config.Software), response: response,
+		tracer: tp.Tracer(tracerName), tracing: config.TracerProvider != nil, propagator: propagator, selfTest: st, workers: config.Workers,
+		batchSize: config.BatchSize}, nil
+}
+
+// Logger returns the server's logger, whose level follows reloads.
+func (s *STUNServer) Logger() logging.LeveledLogger {
+	return s.log
 }
 
 func (s *STUNServer) Start() error {
-	var index int
-	if s.role == "pri" || s.role == "both" {
-		s.log.Warnf("%+v", s.priAddrs)
-		for _, addr := range s.priAddrs {
-			var err error
-			s.log.Debugf("start listening on %s...", addr.String())
-			conn, err := s.net.ListenUDP("udp", addr)
-			s.conns = append(s.conns, conn)
-			if err != nil {
-				return err
-			}
-			go func(i int) {
-				s.readLoop(i)
-			}(index)
-			index++
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, e := range s.endpoints {
+		if !s.listensOn(e) {
+			continue
 		}
-	}
-	if s.role == "sec" || s.role == "both" {
-		s.log.Warnf("%+v", s.secAddrs)
-		for _, addr := range s.secAddrs {
-			var err error
-			s.log.Debugf("start listening on %s...", addr.String())
-			conn, err := s.net.ListenUDP("udp", addr)
-			s.conns = append(s.conns, conn)
-			if err != nil {
-				return err
-			}
-			go func(i int) {
-				s.readLoop(i)
-			}(index)
-			index++
+		conns, err := s.listen(e)
+		if err != nil {
+			return err
 		}
+		e.conn, e.conns = conns[0], conns
+		s.serve(e, s.generation)
+	}
+	turnServer, err := s.startTURN(s.turnConfig, s.endpoints[0].addr.IP)
+	if err != nil {
+		return err
+	}
+	s.turnServer = turnServer
+	if s.selfTest != nil {
+		go s.selfTestLoop(s.selfTest)
+	}
+	if s.pool != nil {
+		go s.heartbeatLoop(s.pool)
 	}
 
 	return nil
 }
 
-func (s *STUNServer) readLoop(index int) {
-	conn := s.conns[index]
+// snapshot is the configuration a request is handled with, read under a
+// single lock per packet.
+type snapshot struct {
+	endpoints  []*endpoint
+	generation uint64
+	auth       *serverAuth
+	rendezvous *rendezvous
+	redirect   *redirect
+	accessLog  *accessLog
+	response   responseAttrs
+	software   stun.Software
+	// debug is set if debug messages are logged, so that the request
+	// path does not format them for nothing
+	debug bool
+}
+
+func (s *STUNServer) snapshot() snapshot {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return snapshot{
+		endpoints:  s.endpoints,
+		generation: s.generation,
+		auth:       s.auth,
+		rendezvous: s.rendezvous,
+		redirect:   s.redirect,
+		accessLog:  s.accessLog,
+		response:   s.response,
+		software:   s.software,
+		debug:      s.logLevel >= logging.LogLevelDebug,
+	}
+}
+
+// listensOn reports whether endpoint e belongs to this server's role.
+func (s *STUNServer) listensOn(e *endpoint) bool {
+	return s.role == "both" || s.role == e.Host
+}
+
+func (s *STUNServer) readLoop(w *worker) {
 	for {
-		buf := make([]byte, 1500)
-		n, from, err := conn.ReadFrom(buf)
+		p := packetPool.Get().(*packet)
+		n, err := p.read(w.conn)
+		if err == io.ErrShortBuffer {
+			// datagram longer than the buffer
+			s.log.Debugf("readLoop: dropping oversized datagram from %s", p.from.String())
+			packetPool.Put(p)
+			continue
+		}
 		if err != nil {
 			s.log.Errorf("readLoop: %s", err.Error())
+			packetPool.Put(p)
 			return
 		}
+		s.handlePacket(w, p, n, nil)
+		packetPool.Put(p)
+	}
+}
 
+// handlePacket handles the datagram of n bytes read into p by worker w.
+// The binding response is queued in out if not nil, otherwise written
+// right away. Without authentication, access log or tracing, an unrelayed
+// binding request is answered without allocating.
+func (s *STUNServer) handlePacket(w *worker, p *packet, n int, out *batch) {
+	st := s.snapshot()
+	conn := w.conn
+	var from net.Addr = &p.from
+	if st.debug {
 		s.log.Debugf("received %d bytes from %s", n, from.String())
+	}
 
-		m := &stun.Message{Raw: append([]byte{}, buf[:n]...)}
-		if err = m.Decode(); err != nil {
-			s.log.Warnf("failed to decode: %s", err.Error())
-			continue
-		}
+	e := w.endpoint(&st)
+	if e == nil {
+		s.log.Debugf("readLoop: %s was removed. dropping...", conn.LocalAddr().String())
+		return
+	}
+	ctx, span := s.startSpan(context.Background(), "stun.request", from)
 
-		if m.Type.Class != stun.ClassRequest {
-			s.log.Warn("not a request. dropping...")
-			continue
-		}
+	m := &p.m
+	if err := p.decode(n); err != nil {
+		s.log.Warnf("failed to decode: %s", err.Error())
+		s.finish(&st, span, e, from, nil, relayNone, outcomeMalformed, err)
+		return
+	}
 
-		if m.Type.Method != stun.MethodBinding {
-			s.log.Warn("not a binding request. dropping...")
-			continue
+	if m.Type.Class != stun.ClassRequest {
+		s.log.Warn("not a request. dropping...")
+		s.finish(&st, span, e, from, m, relayNone, outcomeIgnored, nil)
+		return
+	}
+
+	if m.Type.Method != stun.MethodBinding {
+		s.log.Warn("not a binding request. dropping...")
+		s.finish(&st, span, e, from, m, relayNone, outcomeIgnored, nil)
+		return
+	}
+
+	classic := classicID(m) != nil
+	if classic && st.auth != nil {
+		if st.debug {
+			s.log.Debugf("RFC 3489 request from %s cannot authenticate. dropping...", from.String())
 		}
-		conn, err := s.getConn(index, from, m)
-		if err != nil || conn == nil {
-			s.log.Warnf("get connection failure %v, or conn to sec", err)
-			continue
+		s.finish(&st, span, e, from, m, relayNone, outcomeUnauthorized, errClassicAuth)
+		return
+	}
+	var key stun.Setter // signs the response
+	if st.auth != nil {
+		var err error
+		if key, err = s.authenticate(st.auth, conn, from, m); err != nil {
+			s.log.Debugf("%s. dropping...", err.Error())
+			s.finish(&st, span, e, from, m, relayNone, outcomeUnauthorized, err)
+			return
 		}
-		err = s.handleBindingRequest(from, m, conn)
-		if err != nil {
-			s.log.Errorf("readLoop: handleBindingRequest failed: %s", err.Error())
-			// 不要直接 return，继续处理下一个请求，避免 goroutine 退出导致连接无法处理
-			continue
+	}
+	if err := checkResponsePort(m); err != nil {
+		if st.debug {
+			s.log.Debugf("%s from %s. rejecting...", err.Error(), from.String())
+		}
+		if err2 := s.sendError(conn, from, m, stun.CodeBadRequest); err2 != nil {
+			s.log.Warnf("failed to send 400: %s", err2.Error())
+		}
+		s.finish(&st, span, e, from, m, relayNone, outcomeMalformed, err)
+		return
+	}
+	if st.rendezvous != nil && m.Contains(attrTypeRendezvousSession) {
+		if err := s.handleRendezvous(&st, conn, from, m, key); err != nil {
+			s.log.Errorf("readLoop: handleRendezvous failed: %s", err.Error())
+			s.finish(&st, span, e, from, m, relayNone, outcomeFailed, err)
+		} else {
+			s.finish(&st, span, e, from, m, relayLocal, outcomeRendezvous, nil)
 		}
+		return
+	}
+	// RFC 3489 has no ALTERNATE-SERVER
+	if st.redirect != nil && !classic && e.redirects(m) && !fromSelf(st.endpoints, p.from.IP) {
+		if alternate := st.redirect.target(&p.from); alternate != nil {
+			if err := s.sendRedirect(conn, from, m, alternate, key); err != nil {
+				s.log.Errorf("readLoop: sendRedirect failed: %s", err.Error())
+				s.finish(&st, span, e, from, m, relayNone, outcomeFailed, err)
+			} else {
+				s.finish(&st, span, e, from, m, relayNone, outcomeRedirected, nil)
+			}
+			return
+		}
+	}
+
+	respond, relay, err := s.getEndpoint(ctx, &st, e, from, m)
+	if err != nil || respond == nil {
+		s.log.Warnf("get endpoint failure %v, or relayed to sec", err)
+		switch {
+		case err != nil:
+			s.finish(&st, span, e, from, m, relay, outcomeFailed, err)
+		case relay == relaySecondary:
+			s.finish(&st, span, e, from, m, relay, outcomeRelayed, nil)
+		default:
+			s.finish(&st, span, e, from, m, relay, outcomeNoPartner, nil)
+		}
+		return
 	}
+	if span.IsRecording() {
+		span.SetAttributes(attrKeyResponder.String(respond.Name))
+	}
+	err = s.handleBindingRequest(&st, from, m, e, respond, out, key)
+	if err != nil {
+		s.log.Errorf("readLoop: handleBindingRequest failed: %s", err.Error())
+		s.finish(&st, span, e, from, m, relay, outcomeFailed, err)
+		return
+	}
+	s.finish(&st, span, e, from, m, relay, outcomeOK, nil)
 }
-func (s *STUNServer) getConn(index int, from net.Addr, m *stun.Message) (conn net.PacketConn, err error) {
+
+// getEndpoint returns the local endpoint answering a request received on
+// e, and the relay decision. It returns nil when the request was relayed
+// to the secondary or rejected because the requested change is not
+// available.
+func (s *STUNServer) getEndpoint(ctx context.Context, st *snapshot, e *endpoint, from net.Addr, m *stun.Message) (*endpoint, string, error) {
 	// Check CHANGE-REQUEST
 	changeReq := attrChangeRequest{}
-	err = changeReq.GetFrom(m)
-	if err != nil {
-		s.log.Debugf("CHANGE-REQUEST not found: %s", err.Error())
-		conn = s.conns[index]
-	} else {
+	if err := changeReq.GetFrom(m); err != nil {
+		if st.debug {
+			s.log.Debugf("CHANGE-REQUEST not found: %s", err.Error())
+		}
+		return e, relayLocal, nil
+	}
+	if st.debug {
 		s.log.Debugf("CHANGE-REQUEST: changeIP=%v changePort=%v",
 			changeReq.ChangeIP, changeReq.ChangePort)
-		if changeReq.ChangeIP {
-			index ^= 0x2
-		}
-		if changeReq.ChangePort {
-			index ^= 0x1
-		}
-		if index >= len(s.conns) {
-			if s.role == "pri" {
-				return nil, s.sendMsgToSec(index, from, m)
-			} else {
-				s.log.Errorf("not expect %d %s", index, s.role)
-				return nil, errors.New("not expect")
-			}
-		} else {
-			conn = s.conns[index]
-		}
 	}
-	return conn, nil
+
+	respond := e.partner(changeReq.ChangeIP, changeReq.ChangePort)
+	if respond == nil {
+		s.log.Debugf("no partner on %s for the CHANGE-REQUEST", e.Name)
+		return nil, relayNone, s.sendError(e.conn, from, m, stun.CodeUnknownAttribute,
+			stun.UnknownAttributes{attrTypeChangeRequest})
+	}
+	if respond.conn != nil {
+		return respond, relayLocal, nil
+	}
+	if s.role == "pri" {
+		return nil, relaySecondary, s.sendMsgToSec(ctx, e, respond, from, m)
+	}
+	s.log.Errorf("not expect %s %s", respond.Name, s.role)
+	return nil, relayNone, errors.New("not expect")
 }
 
-func (s *STUNServer) handleBindingRequest(from net.Addr, m *stun.Message, conn net.PacketConn) error {
-	s.log.Debugf("received BindingRequest from %s", from.String())
+// handleBindingRequest answers with the response attributes of st a
+// request received on endpoint received, nil if unknown, from endpoint
+// respond, queueing the response in out if not nil, and signing it with key
+// if not nil. The response is built in a pooled message, so this does not
+// allocate unless the response is signed. RFC 3489 requests get an RFC 3489
+// response, echoing their transaction ID.
+func (s *STUNServer) handleBindingRequest(st *snapshot, from net.Addr, m *stun.Message, received, respond *endpoint, out *batch, key stun.Setter) error {
+	if st.debug {
+		s.log.Debugf("received BindingRequest from %s", from.String())
+	}
 
 	udpAddr := from.(*net.UDPAddr)
+	attrs, software := st.response, st.software
+	classic := classicID(m)
+	if classic != nil {
+		attrs = responseProfiles[ProfileRFC3489]
+	}
 
-	attrs := s.makeAttrs(m.TransactionID, stun.BindingSuccess,
-		&stun.XORMappedAddress{
-			IP:   udpAddr.IP,
-			Port: udpAddr.Port,
-		},
-		&stun.XORMappedAddress{
-			IP:   udpAddr.IP,
-			Port: udpAddr.Port,
-		},
-		&attrChangedAddress{
-			attrAddress{
-				IP:   s.secAddrs[1].IP,
-				Port: s.secAddrs[1].Port,
-			},
-		},
-		stun.Fingerprint)
-
-	msg, err := stun.Build(attrs...)
-	if err != nil {
-		return err
+	res := responsePool.Get().(*response)
+	queued := false
+	defer func() {
+		if !queued {
+			responsePool.Put(res)
+		}
+	}()
+	res.reset(m.TransactionID, stun.BindingSuccess)
+	if attrs.has(respMappedAddress) {
+		res.addAddress(stun.AttrMappedAddress, udpAddr.IP, udpAddr.Port, false)
+	}
+	if attrs.has(respXORMappedAddress) {
+		res.addAddress(stun.AttrXORMappedAddress, udpAddr.IP, udpAddr.Port, true)
+	}
+	if attrs.has(respSourceAddress) {
+		res.addAddress(attrTypeSourceAddress, respond.addr.IP, respond.addr.Port, false)
+	}
+	// CHANGED-ADDRESS (OTHER-ADDRESS) is where a change of both IP and
+	// port would be answered from
+	if received != nil && received.changeBoth != nil {
+		other := received.changeBoth.addr
+		if attrs.has(respChangedAddress) {
+			res.addAddress(attrTypeChangedAddress, other.IP, other.Port, false)
+		}
+		if attrs.has(respOtherAddress) {
+			res.addAddress(attrTypeOtherAddress, other.IP, other.Port, false)
+		}
+	}
+	if attrs.has(respResponseOrigin) {
+		res.addAddress(attrTypeResponseOrigin, respond.addr.IP, respond.addr.Port, false)
+	}
+	if attrs.has(respSoftware) && len(software) > 0 {
+		res.Add(stun.AttrSoftware, software)
 	}
 
-	//s.log.Infof("%+v %+v %+v", conn, msg, from)
-	_, err = conn.WriteTo(msg.Raw, from)
-	if err != nil {
-		return err
+	// Echo PADDING so the response is as large as the request
+	padding := attrPadding{}
+	if err := padding.GetFrom(m); err == nil {
+		if err = padding.AddTo(&res.Message); err != nil {
+			return err
+		}
 	}
-	return nil
+	if key != nil {
+		if err := key.AddTo(&res.Message); err != nil {
+			return err
+		}
+	}
+	if attrs.has(respFingerprint) {
+		if err := stun.Fingerprint.AddTo(&res.Message); err != nil {
+			return err
+		}
+	}
+	copy(res.Raw[4:8], classic)
+
+	// Honour RESPONSE-PORT: reply to the same IP but the requested port
+	to := from
+	responsePort := attrResponsePort{}
+	if err := responsePort.GetFrom(m); err == nil {
+		if st.debug {
+			s.log.Debugf("RESPONSE-PORT: %d", responsePort.Port)
+		}
+		res.to = net.UDPAddr{IP: udpAddr.IP, Port: responsePort.Port, Zone: udpAddr.Zone}
+		to = &res.to
+	}
+
+	if out != nil {
+		out.queue(respond.conn, res, to)
+		queued = true
+		return nil
+	}
+	_, err := respond.conn.WriteTo(res.Raw, to)
+	return err
 }
-func (s *STUNServer) sendMsgToSec(index int, from net.Addr, m *stun.Message) error {
+
+// sendMsgToSec hands the request to the secondary, which answers it from
+// respond. The trace context of ctx goes along in the HTTP headers.
+func (s *STUNServer) sendMsgToSec(ctx context.Context, received, respond *endpoint, from net.Addr, m *stun.Message) error {
+	ctx, span := s.tracer.Start(ctx, "stun.relay",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrKeyResponder.String(respond.Name)))
+	defer span.End()
+
 	client := http.Client{
 		Timeout: 3 * time.Second,
 	}
 	fromUDP := from.(*net.UDPAddr)
 	pts := priToSec{
-		From:  fromUDP,
-		M:     m,
-		Index: index,
+		From:     fromUDP,
+		M:        m,
+		Received: received.Name,
+		Endpoint: respond.Name,
 	}
 	bytesPts, err := json.Marshal(pts)
 	if err != nil {
 		s.log.Warnf("marshal pts err: %s", err.Error())
+		spanError(span, err)
 		return err
 	}
-	req, err := http.NewRequest(http.MethodPost, "http://"+s.pri2SecHost+priToSecUri, bytes.NewReader(bytesPts))
+	s.mutex.RLock()
+	host := s.pri2SecHost
+	s.mutex.RUnlock()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+host+priToSecUri, bytes.NewReader(bytesPts))
 	if err != nil {
 		s.log.Warnf("NewRequest  err: %s", err.Error())
+		spanError(span, err)
 		return err
 	}
+	s.propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
 	resp, err := client.Do(req)
 	if err != nil {
 		s.log.Warnf("client do  err: %s", err.Error())
+		spanError(span, err)
 		return err
 	}
 	defer resp.Body.Close()
+	span.SetAttributes(attrKeyHTTPStatus.Int(resp.StatusCode))
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("secondary answered %s", resp.Status)
+		spanError(span, err)
+		return err
+	}
 	s.log.Debug("client do  success ")
 	return nil
 }
+
+// newSoftware returns the SOFTWARE attribute for name, nil if empty.
+func newSoftware(name string) stun.Software {
+	if name == "" {
+		return nil
+	}
+	return stun.NewSoftware(name)
+}
+
 func (s *STUNServer) makeAttrs(
 	transactionID [stun.TransactionIDSize]byte,
 	msgType stun.MessageType,
 	additional ...stun.Setter) []stun.Setter {
 	attrs := append([]stun.Setter{&stun.Message{TransactionID: transactionID}, msgType}, additional...)
-	if len(s.software) > 0 {
-		attrs = append(attrs, s.software)
+	s.mutex.RLock()
+	software := s.software
+	s.mutex.RUnlock()
+	if len(software) > 0 {
+		attrs = append(attrs, software)
 	}
 	return attrs
 }
 
 func (s *STUNServer) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.selfTest != nil {
+		s.selfTest.close()
+	}
+	if s.pool != nil {
+		s.pool.close()
+	}
 	var err error
-	for _, conn := range s.conns {
-		if conn != nil {
+	if s.turnServer != nil {
+		err = s.turnServer.Close()
+	}
+	if s.accessLog != nil {
+		if err2 := s.accessLog.close(); err2 != nil && err == nil {
+			err = err2
+		}
+	}
+	for _, e := range s.endpoints {
+		for _, conn := range e.conns {
 			err2 := conn.Close()
 			if err2 != nil && err == nil {
 				err = err2
@@ -0,0 +1,262 @@
+package nats
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+const defaultNonceLifetime = 10 * time.Minute
+
+// errClassicAuth drops RFC 3489 requests when authentication is on, as
+// they cannot carry RFC 5389 credentials.
+var errClassicAuth = errors.New("RFC 3489 request without credentials")
+
+// AuthHandler looks up the password of username. realm is empty for
+// short-term credentials. Returning false rejects the request. srcAddr is
+// reused after the call returns and must be copied to be kept.
+type AuthHandler func(username, realm string, srcAddr net.Addr) (password string, ok bool)
+
+// AuthConfig enables MESSAGE-INTEGRITY (or MESSAGE-INTEGRITY-SHA256) checks
+// on binding requests.
+type AuthConfig struct {
+	// LongTerm selects long-term credentials with a REALM/NONCE challenge,
+	// otherwise short-term credentials are expected.
+	LongTerm bool
+	Realm    string
+	// NonceLifetime defaults to 10 minutes.
+	NonceLifetime time.Duration
+	// CredentialsFile holds one "username:password" per line; lines
+	// starting with '#' are ignored.
+	CredentialsFile string
+	// Handler takes precedence over CredentialsFile.
+	Handler AuthHandler
+}
+
+type serverAuth struct {
+	longTerm      bool
+	realm         stun.Realm
+	nonceLifetime time.Duration
+	nonceSecret   []byte
+	handler       AuthHandler
+}
+
+// newServerAuth validates config and loads its credentials. Nonces issued
+// by previous stay valid if the realm and the kind of credentials did not
+// change.
+func newServerAuth(config *AuthConfig, previous *serverAuth) (*serverAuth, error) {
+	a := &serverAuth{
+		longTerm:      config.LongTerm,
+		realm:         stun.NewRealm(config.Realm),
+		nonceLifetime: config.NonceLifetime,
+		handler:       config.Handler,
+	}
+	if a.longTerm && len(a.realm) == 0 {
+		return nil, errors.New("long-term credentials need a realm")
+	}
+	if a.nonceLifetime <= 0 {
+		a.nonceLifetime = defaultNonceLifetime
+	}
+	if a.handler == nil {
+		if config.CredentialsFile == "" {
+			return nil, errors.New("need a credentials file or an auth handler")
+		}
+		users, err := loadCredentials(config.CredentialsFile)
+		if err != nil {
+			return nil, err
+		}
+		a.handler = func(username, realm string, srcAddr net.Addr) (string, bool) {
+			password, ok := users[username]
+			return password, ok
+		}
+	}
+	if previous != nil && previous.longTerm == a.longTerm && previous.realm.String() == a.realm.String() {
+		a.nonceSecret = previous.nonceSecret
+		return a, nil
+	}
+	a.nonceSecret = make([]byte, 16)
+	if _, err := rand.Read(a.nonceSecret); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// loadCredentials reads "username:password" lines from path.
+func loadCredentials(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		i := strings.Index(text, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("%s:%d: want username:password", path, line)
+		}
+		users[text[:i]] = text[i+1:]
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// newNonce returns a stateless nonce: the issue time followed by its HMAC,
+// so verifying it needs no per-client state.
+func (a *serverAuth) newNonce(now time.Time) stun.Nonce {
+	ts := make([]byte, 8)
+	binary.BigEndian.PutUint64(ts, uint64(now.Unix()))
+	return stun.NewNonce(hex.EncodeToString(ts) + hex.EncodeToString(a.nonceMAC(ts)))
+}
+
+func (a *serverAuth) nonceMAC(ts []byte) []byte {
+	mac := hmac.New(sha256.New, a.nonceSecret)
+	mac.Write(ts) // nolint:errcheck,gosec
+	return mac.Sum(nil)[:8]
+}
+
+// checkNonce reports whether nonce was issued by us and is still fresh.
+func (a *serverAuth) checkNonce(nonce stun.Nonce, now time.Time) bool {
+	raw, err := hex.DecodeString(nonce.String())
+	if err != nil || len(raw) != 16 {
+		return false
+	}
+	if !hmac.Equal(raw[8:], a.nonceMAC(raw[:8])) {
+		return false
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint64(raw[:8])), 0)
+	return now.Sub(issued) < a.nonceLifetime
+}
+
+// integrity returns the key checking (and signing) m for password, using
+// MESSAGE-INTEGRITY-SHA256 when m carries it.
+func (a *serverAuth) integrity(m *stun.Message, username, password string) stun.Setter {
+	useSHA256 := m.Contains(attrTypeMessageIntegritySHA256)
+	switch {
+	case a.longTerm && useSHA256:
+		return newLongTermIntegritySHA256(username, a.realm.String(), password)
+	case a.longTerm:
+		return stun.NewLongTermIntegrity(username, a.realm.String(), password)
+	case useSHA256:
+		return messageIntegritySHA256(password)
+	}
+	return stun.NewShortTermIntegrity(password)
+}
+
+type integrityChecker interface {
+	Check(m *stun.Message) error
+}
+
+// authenticate checks the credentials of request m received on conn
+// against a and returns the key signing the response. It answers failures itself with
+// the matching error response and returns a non-nil error, in which case
+// the request must be dropped.
+func (s *STUNServer) authenticate(a *serverAuth, conn net.PacketConn, from net.Addr, m *stun.Message) (stun.Setter, error) {
+	now := time.Now()
+	challenge := func(code stun.ErrorCode, reason string) error {
+		attrs := []stun.Setter{code}
+		if a.longTerm {
+			attrs = append(attrs, a.realm, a.newNonce(now))
+		}
+		if err := s.sendError(conn, from, m, attrs...); err != nil {
+			s.log.Warnf("auth: failed to send %d: %s", int(code), err.Error())
+		}
+		return fmt.Errorf("auth: %s from %s", reason, from.String())
+	}
+
+	hasIntegrity := m.Contains(stun.AttrMessageIntegrity) ||
+		m.Contains(attrTypeMessageIntegritySHA256)
+	if !hasIntegrity {
+		if a.longTerm {
+			return nil, challenge(stun.CodeUnauthorized, "missing MESSAGE-INTEGRITY")
+		}
+		return nil, challenge(stun.CodeBadRequest, "missing MESSAGE-INTEGRITY")
+	}
+
+	var username stun.Username
+	if err := username.GetFrom(m); err != nil {
+		return nil, challenge(stun.CodeBadRequest, "missing USERNAME")
+	}
+
+	if a.longTerm {
+		var realm stun.Realm
+		var nonce stun.Nonce
+		if realm.GetFrom(m) != nil || nonce.GetFrom(m) != nil {
+			return nil, challenge(stun.CodeBadRequest, "missing REALM or NONCE")
+		}
+		if realm.String() != a.realm.String() {
+			return nil, challenge(stun.CodeUnauthorized, "unknown realm")
+		}
+		if !a.checkNonce(nonce, now) {
+			return nil, challenge(stun.CodeStaleNonce, "stale nonce")
+		}
+	}
+
+	realm := ""
+	if a.longTerm {
+		realm = a.realm.String()
+	}
+	password, ok := a.handler(username.String(), realm, from)
+	if !ok {
+		return nil, challenge(stun.CodeUnauthorized, "unknown user "+username.String())
+	}
+	key := a.integrity(m, username.String(), password)
+	if err := key.(integrityChecker).Check(m); err != nil {
+		return nil, challenge(stun.CodeUnauthorized, "integrity check failed for "+username.String())
+	}
+	return key, nil
+}
+
+// responseIntegrity returns the MESSAGE-INTEGRITY setter signing the response
+// to m, or nil if a is nil or m is unsigned. It does
+// not verify m: it is for the secondary, the primary has done so already
+// and signs with the key authenticate returned.
+func (s *STUNServer) responseIntegrity(a *serverAuth, from net.Addr, m *stun.Message) stun.Setter {
+	if a == nil {
+		return nil
+	}
+	var username stun.Username
+	if err := username.GetFrom(m); err != nil {
+		return nil
+	}
+	realm := ""
+	if a.longTerm {
+		realm = a.realm.String()
+	}
+	password, ok := a.handler(username.String(), realm, from)
+	if !ok {
+		return nil
+	}
+	return a.integrity(m, username.String(), password)
+}
+
+// sendError answers m with a binding error response carrying attrs.
+func (s *STUNServer) sendError(conn net.PacketConn, to net.Addr, m *stun.Message, attrs ...stun.Setter) error {
+	setters := s.makeAttrs(m.TransactionID,
+		stun.NewType(stun.MethodBinding, stun.ClassErrorResponse), attrs...)
+	setters = append(setters, stun.Fingerprint)
+	msg, err := stun.Build(setters...)
+	if err != nil {
+		return err
+	}
+	_, err = conn.WriteTo(msg.Raw, to)
+	return err
+}
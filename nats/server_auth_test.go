@@ -0,0 +1,273 @@
+package nats
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageIntegritySHA256(t *testing.T) {
+	key := messageIntegritySHA256("secret")
+	msg, err := stun.Build(stun.TransactionID, stun.BindingRequest,
+		stun.NewUsername("alice"), key, stun.Fingerprint)
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+
+	decoded := &stun.Message{Raw: append([]byte{}, msg.Raw...)}
+	if !assert.NoError(t, decoded.Decode(), "should succeed") {
+		return
+	}
+	assert.NoError(t, key.Check(decoded), "should match")
+	assert.Error(t, messageIntegritySHA256("wrong").Check(decoded), "should not match")
+
+	_, err = stun.Build(stun.TransactionID, stun.BindingRequest, stun.Fingerprint, key)
+	assert.Equal(t, stun.ErrFingerprintBeforeIntegrity, err, "should be rejected")
+}
+
+// truncatedIntegritySHA256 adds MESSAGE-INTEGRITY-SHA256 truncated to size
+// bytes.
+type truncatedIntegritySHA256 struct {
+	key  []byte
+	size int
+}
+
+func (i truncatedIntegritySHA256) AddTo(m *stun.Message) error {
+	length := m.Length
+	m.Length += uint32(4 + i.size)
+	m.WriteLength()
+	mac := hmac.New(sha256.New, i.key)
+	mac.Write(m.Raw) // nolint:errcheck,gosec
+	m.Length = length
+	m.Add(attrTypeMessageIntegritySHA256, mac.Sum(nil)[:i.size])
+	return nil
+}
+
+func TestMessageIntegritySHA256Truncated(t *testing.T) {
+	key := messageIntegritySHA256("secret")
+	for _, test := range []struct {
+		size int
+		ok   bool
+	}{
+		{32, true},
+		{16, true},
+		{24, true},
+		{12, false},
+		{18, false},
+	} {
+		msg, err := stun.Build(stun.TransactionID, stun.BindingRequest,
+			stun.NewUsername("alice"), truncatedIntegritySHA256{key, test.size})
+		if !assert.NoError(t, err, "should succeed") {
+			continue
+		}
+		decoded := &stun.Message{Raw: append([]byte{}, msg.Raw...)}
+		if !assert.NoError(t, decoded.Decode(), "should succeed") {
+			continue
+		}
+		if test.ok {
+			assert.NoError(t, key.Check(decoded), "should accept %d bytes", test.size)
+			assert.Error(t, messageIntegritySHA256("wrong").Check(decoded), "should not match")
+		} else {
+			assert.Error(t, key.Check(decoded), "should reject %d bytes", test.size)
+		}
+	}
+}
+
+func TestLongTermIntegritySHA256Key(t *testing.T) {
+	// no PASSWORD-ALGORITHM negotiation: the MD5 key of MESSAGE-INTEGRITY
+	assert.Equal(t,
+		[]byte(stun.NewLongTermIntegrity("alice", "pion.ly", "secret")),
+		[]byte(newLongTermIntegritySHA256("alice", "pion.ly", "secret")),
+		"should use the MD5 long-term key")
+}
+
+func TestNonce(t *testing.T) {
+	config := &AuthConfig{
+		LongTerm: true,
+		Realm:    "pion.ly",
+		Handler:  func(string, string, net.Addr) (string, bool) { return "", false },
+	}
+	a, err := newServerAuth(config, nil)
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+
+	now := time.Now()
+	nonce := a.newNonce(now)
+	assert.True(t, a.checkNonce(nonce, now), "should be fresh")
+	assert.False(t, a.checkNonce(nonce, now.Add(defaultNonceLifetime)), "should be stale")
+	forged := []byte(nonce.String())
+	forged[len(forged)-1] ^= 1
+	assert.False(t, a.checkNonce(stun.NewNonce(string(forged)), now), "should be forged")
+
+	reloaded, err := newServerAuth(config, a)
+	if assert.NoError(t, err, "should succeed") {
+		assert.True(t, reloaded.checkNonce(nonce, now), "should keep the nonces of an unchanged realm")
+	}
+	reloaded, err = newServerAuth(&AuthConfig{LongTerm: true, Realm: "other", Handler: config.Handler}, a)
+	if assert.NoError(t, err, "should succeed") {
+		assert.False(t, reloaded.checkNonce(nonce, now), "should drop the nonces of another realm")
+	}
+}
+
+func TestAuthOnVNet(t *testing.T) {
+	f, err := ioutil.TempFile("", "credentials")
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer os.Remove(f.Name()) // nolint:errcheck,gosec
+	_, err = f.WriteString("# test users\nalice:secret\n")
+	assert.NoError(t, err, "should succeed")
+	assert.NoError(t, f.Close(), "should succeed")
+
+	natType := &vnet.NATType{
+		MappingBehavior:   vnet.EndpointIndependent,
+		FilteringBehavior: vnet.EndpointIndependent,
+	}
+
+	for _, longTerm := range []bool{false, true} {
+		longTerm := longTerm
+		name := "short-term"
+		if longTerm {
+			name = "long-term"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			v, err := buildVNetWithServer(natType, &STUNServerConfig{
+				Auth: &AuthConfig{
+					LongTerm:        longTerm,
+					Realm:           "pion.ly",
+					CredentialsFile: f.Name(),
+				},
+			})
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+			defer v.close()
+
+			discover := func(username, password string, useSHA256 bool) (*DiscoverResult, error) {
+				nats, err := NewNATS(&Config{
+					Server:       "stun.pion.net:3478",
+					Verbose:      true,
+					Net:          v.net0,
+					Username:     username,
+					Password:     password,
+					LongTermAuth: longTerm,
+					UseSHA256:    useSHA256,
+				})
+				if err != nil {
+					return nil, err
+				}
+				return nats.Discover()
+			}
+
+			for _, useSHA256 := range []bool{false, true} {
+				res, err := discover("alice", "secret", useSHA256)
+				if assert.NoError(t, err, "should succeed") {
+					assert.Equal(t, FullCone, res.NATType, "should match")
+				}
+			}
+
+			_, err = discover("alice", "wrong", false)
+			assert.Error(t, err, "should fail with a wrong password")
+
+			_, err = discover("", "", false)
+			assert.Error(t, err, "should fail without credentials")
+		})
+	}
+}
+
+// challengeTransactor answers unsigned requests with a 401 carrying nonce,
+// once all of them have arrived, and signed ones with a signed success.
+type challengeTransactor struct {
+	nonce      stun.Nonce
+	challenged sync.WaitGroup
+
+	mutex  sync.Mutex
+	signed []stun.Nonce // nonces of the signed requests
+}
+
+func (c *challengeTransactor) transact(msg *stun.Message, to net.Addr) (*stun.Message, net.Addr, error) {
+	var nonce stun.Nonce
+	if nonce.GetFrom(msg) != nil {
+		c.challenged.Done()
+		c.challenged.Wait()
+		res, err := stun.Build(stun.NewTransactionIDSetter(msg.TransactionID),
+			stun.NewType(stun.MethodBinding, stun.ClassErrorResponse),
+			stun.CodeUnauthorized, stun.NewRealm("pion.ly"), c.nonce)
+		return res, to, err
+	}
+	c.mutex.Lock()
+	c.signed = append(c.signed, nonce)
+	c.mutex.Unlock()
+	res, err := stun.Build(stun.NewTransactionIDSetter(msg.TransactionID), stun.BindingSuccess,
+		stun.NewLongTermIntegrity("alice", "pion.ly", "secret"), stun.Fingerprint)
+	return res, to, err
+}
+
+func (c *challengeTransactor) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return len(p), nil
+}
+
+func TestLongTermChallengeRace(t *testing.T) {
+	const requests = 8
+	nats := &NATS{auth: newClientAuth(&Config{Username: "alice", Password: "secret", LongTermAuth: true})}
+	c := &challengeTransactor{nonce: stun.NewNonce("fresh")}
+	c.challenged.Add(requests)
+	to := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 3478}
+
+	errs := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		go func() {
+			_, _, err := nats.performTransaction(c, to, stun.TransactionID, stun.BindingRequest)
+			errs <- err
+		}()
+	}
+	for i := 0; i < requests; i++ {
+		assert.NoError(t, <-errs, "should retry with the fresh nonce")
+	}
+	// every request was challenged once, so one signed retry each
+	if assert.Len(t, c.signed, requests, "should retry each request exactly once") {
+		for _, nonce := range c.signed {
+			assert.Equal(t, "fresh", nonce.String(), "should use the fresh nonce")
+		}
+	}
+}
+
+func TestAuthLooksUpOnce(t *testing.T) {
+	var lookups int32
+	v, err := buildVNetWithServer(&vnet.NATType{
+		MappingBehavior:   vnet.EndpointIndependent,
+		FilteringBehavior: vnet.EndpointIndependent,
+	}, &STUNServerConfig{Auth: &AuthConfig{Handler: func(username, realm string, srcAddr net.Addr) (string, bool) {
+		atomic.AddInt32(&lookups, 1)
+		return "secret", username == "alice"
+	}}})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer v.close()
+	conn, err := v.net0.ListenPacket("udp4", "0.0.0.0:0")
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer conn.Close() // nolint:errcheck,gosec
+
+	res, _ := exchange(t, conn, "1.2.3.4:3478",
+		stun.NewUsername("alice"), stun.NewShortTermIntegrity("secret"))
+	if !assert.NotNil(t, res, "should respond") {
+		return
+	}
+	assert.NoError(t, stun.NewShortTermIntegrity("secret").Check(res), "should be signed")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&lookups), "should look the password up once")
+}
@@ -0,0 +1,210 @@
+package nats
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pion/transport/vnet"
+)
+
+// RedirectConfig lets the server shed clients to other servers. Only the
+// first request of a test, a binding request without CHANGE-REQUEST on the
+// primary address, may be answered with 300 (Try Alternate) and an
+// ALTERNATE-SERVER; the other requests are always answered, so that tests
+// in progress complete. Clients are sent to the alternate whose Prefixes
+// contain their IP; otherwise LocalWeight and MaxRate decide whether they
+// are redirected, to an alternate picked by Weight.
+type RedirectConfig struct {
+	Alternates []Alternate
+	// MaxRate is the number of tests per second this server takes, the
+	// next ones being redirected. A client, told apart by IP and port, is
+	// charged once for its test: its retransmissions and the requests it
+	// sends again within takenLifetime are taken too. 0 removes the limit.
+	MaxRate int
+	// LocalWeight, if set, keeps this server's share of the clients,
+	// weighed against the alternates' Weight, and redirects the others
+	// whatever the load. Clients are told apart by IP, so a client is
+	// always sent the same way.
+	LocalWeight int
+}
+
+// Alternate is a server clients are redirected to.
+type Alternate struct {
+	// Address is the primary address of the alternate, as IP:port.
+	Address string `json:"address"`
+	// Weight is the alternate's share of the redirected clients; with 0
+	// it only gets the clients of its Prefixes.
+	Weight int `json:"weight"`
+	// Prefixes are the client networks, in CIDR notation, always sent to
+	// this alternate.
+	Prefixes []string `json:"prefixes"`
+}
+
+type alternate struct {
+	addr     *net.UDPAddr
+	weight   int
+	prefixes []*net.IPNet
+}
+
+// takenLifetime is how long a client whose test was taken keeps being
+// taken without counting against MaxRate. It outlasts the retransmissions
+// of a request at the default RTO.
+const takenLifetime = 30 * time.Second
+
+type redirect struct {
+	alternates  []alternate
+	weights     int // sum of the alternates' weights
+	localWeight int
+	maxRate     int
+
+	mutex   sync.Mutex
+	window  time.Time                    // start of the current second
+	taken   int                          // tests taken since window
+	clients map[netip.AddrPort]time.Time // clients taken, by when
+}
+
+func newRedirect(n *vnet.Net, config *RedirectConfig) (*redirect, error) {
+	if config.MaxRate < 0 || config.LocalWeight < 0 {
+		return nil, errors.New("redirect: negative rate or weight")
+	}
+	r := &redirect{
+		maxRate:     config.MaxRate,
+		localWeight: config.LocalWeight,
+		clients:     map[netip.AddrPort]time.Time{},
+	}
+	for _, a := range config.Alternates {
+		addr, err := n.ResolveUDPAddr("udp", a.Address)
+		if err != nil {
+			return nil, fmt.Errorf("redirect: alternate %s: %s", a.Address, err.Error())
+		}
+		if a.Weight < 0 {
+			return nil, fmt.Errorf("redirect: alternate %s: negative weight", a.Address)
+		}
+		alt := alternate{addr: addr, weight: a.Weight}
+		for _, prefix := range a.Prefixes {
+			_, network, err := net.ParseCIDR(prefix)
+			if err != nil {
+				return nil, fmt.Errorf("redirect: alternate %s: %s", a.Address, err.Error())
+			}
+			alt.prefixes = append(alt.prefixes, network)
+		}
+		r.alternates = append(r.alternates, alt)
+		r.weights += a.Weight
+	}
+	if r.weights == 0 && (r.maxRate > 0 || r.localWeight > 0) {
+		return nil, errors.New("redirect: no alternate has a weight")
+	}
+	return r, nil
+}
+
+// target returns the alternate the client at from is sent to, nil if this
+// server takes the test.
+func (r *redirect) target(from *net.UDPAddr) *net.UDPAddr {
+	ip := from.IP
+	for _, a := range r.alternates {
+		for _, prefix := range a.prefixes {
+			if prefix.Contains(ip) {
+				return a.addr
+			}
+		}
+	}
+	if r.weights == 0 {
+		return nil
+	}
+
+	h := int(hashIP(ip) % uint32(r.localWeight+r.weights))
+	if r.localWeight > 0 && h >= r.localWeight {
+		return r.pick(h - r.localWeight)
+	}
+	if r.maxRate > 0 && !r.take(from.AddrPort()) {
+		return r.pick(h % r.weights)
+	}
+	return nil
+}
+
+// pick returns the alternate whose share of the weights contains n.
+func (r *redirect) pick(n int) *net.UDPAddr {
+	for _, a := range r.alternates {
+		if n < a.weight {
+			return a.addr
+		}
+		n -= a.weight
+	}
+	return nil
+}
+
+// take reports whether the test of client is taken: it was already, or
+// it is counted against MaxRate and within.
+func (r *redirect) take(client netip.AddrPort) bool {
+	now := time.Now()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if now.Sub(r.window) >= time.Second {
+		r.window, r.taken = now, 0
+		for c, at := range r.clients {
+			if now.Sub(at) >= takenLifetime {
+				delete(r.clients, c)
+			}
+		}
+	}
+	if at, ok := r.clients[client]; ok && now.Sub(at) < takenLifetime {
+		return true
+	}
+	if r.taken >= r.maxRate {
+		return false
+	}
+	r.taken++
+	r.clients[client] = now
+	return true
+}
+
+// hashIP is FNV-1a over the 16-byte form of ip.
+func hashIP(ip net.IP) uint32 {
+	h := uint32(2166136261)
+	for _, b := range ip.To16() {
+		h ^= uint32(b)
+		h *= 16777619
+	}
+	return h
+}
+
+// redirects reports whether m, received on e, may be redirected: it is a
+// binding request starting a test on the primary address.
+func (e *endpoint) redirects(m *stun.Message) bool {
+	return e.index == 0 && !m.Contains(attrTypeChangeRequest)
+}
+
+// fromSelf reports whether ip is the IP of one of endpoints, as is the
+// source of the self-test's probes: they are never redirected nor counted
+// against MaxRate, lest the server redirect its own test.
+func fromSelf(endpoints []*endpoint, ip net.IP) bool {
+	for _, e := range endpoints {
+		if e.addr.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// sendRedirect answers m with 300 (Try Alternate), signed with key like a
+// success response would be.
+func (s *STUNServer) sendRedirect(conn net.PacketConn, to net.Addr, m *stun.Message, alternate *net.UDPAddr, key stun.Setter) error {
+	setters := s.makeAttrs(m.TransactionID,
+		stun.NewType(stun.MethodBinding, stun.ClassErrorResponse),
+		stun.CodeTryAlternate, &stun.AlternateServer{IP: alternate.IP, Port: alternate.Port})
+	if key != nil {
+		setters = append(setters, key)
+	}
+	setters = append(setters, stun.Fingerprint)
+	msg, err := stun.Build(setters...)
+	if err != nil {
+		return err
+	}
+	_, err = conn.WriteTo(msg.Raw, to)
+	return err
+}
@@ -0,0 +1,198 @@
+package nats
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/pion/stun"
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedirectTarget(t *testing.T) {
+	n := vnet.NewNet(nil)
+	r, err := newRedirect(n, &RedirectConfig{
+		Alternates: []Alternate{
+			{Address: "10.0.0.1:3478", Prefixes: []string{"192.0.2.0/24"}},
+			{Address: "10.0.0.2:3478", Weight: 1},
+			{Address: "10.0.0.3:3478", Weight: 2},
+		},
+		LocalWeight: 1,
+	})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	client := func(ip string, port int) *net.UDPAddr {
+		return &net.UDPAddr{IP: net.ParseIP(ip), Port: port}
+	}
+	assert.Equal(t, "10.0.0.1:3478", r.target(client("192.0.2.7", 5000)).String(), "should send the prefix to its alternate")
+
+	counts := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		from := &net.UDPAddr{IP: net.IPv4(27, byte(i>>16), byte(i>>8), byte(i)), Port: 5000}
+		to := r.target(from)
+		name := "local"
+		if to != nil {
+			name = to.String()
+		}
+		counts[name]++
+		assert.Equal(t, to, r.target(from), "should always send a client the same way")
+	}
+	assert.InDelta(t, 1000, counts["local"], 200, "should keep its weight")
+	assert.InDelta(t, 1000, counts["10.0.0.2:3478"], 200, "should split by weight")
+	assert.InDelta(t, 2000, counts["10.0.0.3:3478"], 200, "should split by weight")
+	assert.Zero(t, counts["10.0.0.1:3478"], "should not split to an alternate without weight")
+
+	r, err = newRedirect(n, &RedirectConfig{Alternates: []Alternate{{Address: "10.0.0.2:3478", Weight: 1}}, MaxRate: 2})
+	if assert.NoError(t, err, "should succeed") {
+		for i := 0; i < 3; i++ {
+			// retransmissions of the first test are not charged again
+			assert.Nil(t, r.target(client("27.1.1.1", 5000)), "should take the first test")
+		}
+		assert.Nil(t, r.target(client("27.1.1.1", 5001)), "should take the second test")
+		assert.NotNil(t, r.target(client("27.1.1.1", 5002)), "should redirect beyond the rate")
+		for _, port := range []int{5000, 5001} {
+			assert.Nil(t, r.target(client("27.1.1.1", port)), "should keep taking the tests in progress")
+		}
+	}
+
+	for _, config := range []*RedirectConfig{
+		{Alternates: []Alternate{{Address: "10.0.0.2:3478"}}, MaxRate: 2},
+		{Alternates: []Alternate{{Address: "10.0.0.2:3478", Prefixes: []string{"bogus"}}}},
+		{Alternates: []Alternate{{Address: "10.0.0.2:3478", Weight: -1}}},
+		{LocalWeight: -1},
+	} {
+		_, err = newRedirect(n, config)
+		assert.Error(t, err, "should reject %+v", config)
+	}
+}
+
+// buildVNetClusters runs two clusters, A on 1.2.3.4/1.2.3.5 (v.server)
+// with redirect, and B on 1.2.4.4/1.2.4.5, which it returns.
+func buildVNetClusters(natType *vnet.NATType, redirect *RedirectConfig) (*virtualNet, *STUNServer, error) {
+	v, serverNets, err := buildTopology([][]string{{"1.2.3.4", "1.2.3.5"}, {"1.2.4.4", "1.2.4.5"}}, natType)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err := NewSTUNServer(&STUNServerConfig{
+		PrimaryAddress:   "1.2.4.4:3478",
+		SecondaryAddress: "1.2.4.5:3479",
+		Net:              serverNets[1],
+		Role:             "both",
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = b.Start(); err != nil {
+		return nil, nil, err
+	}
+	v.cleanup = append(v.cleanup, func() {
+		b.Close() // nolint:errcheck,gosec
+	})
+
+	v.server, err = NewSTUNServer(&STUNServerConfig{
+		PrimaryAddress:   "1.2.3.4:3478",
+		SecondaryAddress: "1.2.3.5:3479",
+		Net:              serverNets[0],
+		Role:             "both",
+		Redirect:         redirect,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = v.server.Start(); err != nil {
+		return nil, nil, err
+	}
+	return v, b, nil
+}
+
+func TestRedirectOnVNet(t *testing.T) {
+	v, b, err := buildVNetClusters(&vnet.NATType{
+		MappingBehavior:   vnet.EndpointIndependent,
+		FilteringBehavior: vnet.EndpointAddrPortDependent,
+	}, &RedirectConfig{
+		Alternates: []Alternate{{Address: "1.2.4.4:3478", Prefixes: []string{"0.0.0.0/0"}}},
+	})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer v.close()
+
+	t.Run("requests", func(t *testing.T) {
+		conn, err := v.net0.ListenPacket("udp4", "0.0.0.0:0")
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		defer conn.Close() // nolint:errcheck,gosec
+
+		res, _ := exchange(t, conn, "1.2.3.4:3478")
+		if assert.NotNil(t, res, "should respond") {
+			var code stun.ErrorCodeAttribute
+			var alternate stun.AlternateServer
+			if assert.NoError(t, code.GetFrom(res), "should be an error") &&
+				assert.NoError(t, alternate.GetFrom(res), "should carry ALTERNATE-SERVER") {
+				assert.Equal(t, stun.CodeTryAlternate, code.Code, "should match")
+				assert.Equal(t, "1.2.4.4:3478", (&net.UDPAddr{IP: alternate.IP, Port: alternate.Port}).String(), "should match")
+			}
+		}
+		// tests in progress are not cut short
+		for _, addr := range []string{"1.2.3.4:3479", "1.2.3.5:3478"} {
+			res, _ = exchange(t, conn, addr)
+			if assert.NotNil(t, res, "should respond") {
+				assert.Equal(t, stun.BindingSuccess, res.Type, "should not redirect %s", addr)
+			}
+		}
+		res, _ = exchange(t, conn, "1.2.3.4:3478", &attrChangeRequest{ChangePort: true})
+		if assert.NotNil(t, res, "should respond") {
+			assert.Equal(t, stun.BindingSuccess, res.Type, "should not redirect a CHANGE-REQUEST")
+		}
+	})
+
+	t.Run("follow", func(t *testing.T) {
+		n, err := NewNATS(&Config{Server: "1.2.3.4:3478", Net: v.net0})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		res, err := n.Discover()
+		if assert.NoError(t, err, "should succeed") {
+			assert.Equal(t, RestricPortNAT, res.NATType, "should match")
+			assert.Equal(t, "1.2.4.4:3478", res.Server, "should report the alternate")
+		}
+		assert.Equal(t, "1.2.3.4:3478", n.serverAddr.String(), "should start over from the server")
+	})
+
+	t.Run("not follow", func(t *testing.T) {
+		n, err := NewNATS(&Config{Server: "1.2.3.4:3478", Net: v.net0, MaxRedirects: -1})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		_, err = n.Discover()
+		var redirect *RedirectError
+		if assert.True(t, errors.As(err, &redirect), "should return the redirect") {
+			assert.Equal(t, "1.2.4.4:3478", redirect.Alternate.String(), "should match")
+		}
+	})
+
+	t.Run("loop", func(t *testing.T) {
+		err := b.Reload(&STUNServerConfig{
+			PrimaryAddress:   "1.2.4.4:3478",
+			SecondaryAddress: "1.2.4.5:3479",
+			Role:             "both",
+			Redirect: &RedirectConfig{
+				Alternates: []Alternate{{Address: "1.2.3.4:3478", Prefixes: []string{"0.0.0.0/0"}}},
+			},
+		})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		n, err := NewNATS(&Config{Server: "1.2.3.4:3478", Net: v.net0})
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		_, err = n.Discover()
+		if assert.Error(t, err, "should fail") {
+			assert.Contains(t, err.Error(), "redirect loop", "should detect the loop")
+		}
+	})
+}
@@ -0,0 +1,264 @@
+package nats
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+
+	"github.com/pion/logging"
+	turnv2 "github.com/pion/turn/v2"
+)
+
+// Reload applies config to a running server without dropping the tests in
+// flight. The log level, the relay peer (Pri2SecHost or the secondary
+// pool, whose secondaries keep their health), authentication (whose nonces
+// stay valid if the realm did not change), the access log, the response
+// attributes, the redirect policy and the rendezvous session TTL change in
+// place. Listeners are rebound only for endpoints whose address changed,
+// and the TURN relay restarts only when its configuration or the primary IP
+// changed. The new state is built while the running one serves, and
+// swapped in at once. On error nothing changes, except that a TURN relay
+// that failed to restart comes back without its allocations. The role,
+// the network and the relay listener of a secondary cannot change;
+// Workers, BatchSize and SelfTest are kept, with a warning if config
+// changes them.
+func (s *STUNServer) Reload(config *STUNServerConfig) error {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+	if config.LogLevel < logging.LogLevelDisabled || config.LogLevel > logging.LogLevelTrace {
+		return errors.New("invalid log level")
+	}
+	if config.Role != s.role {
+		return fmt.Errorf("reload: cannot change role %s to %s", s.role, config.Role)
+	}
+	if config.Net != nil && config.Net != s.net {
+		return errors.New("reload: cannot change network")
+	}
+
+	topology := config.Topology
+	if len(topology) == 0 {
+		topology = defaultTopology(config.PrimaryAddress, config.SecondaryAddress)
+	}
+	s.mutex.RLock()
+	previousPool, previousAuth := s.pool, s.auth
+	s.mutex.RUnlock()
+	pri2SecHost, serving := config.Pri2SecHost, topology
+	var pool *secondaryPool
+	if config.SecondaryPool != nil {
+		if s.role != "pri" {
+			return errSecondaryPoolRole
+		}
+		var err error
+		if pool, err = newSecondaryPool(config.SecondaryPool, previousPool); err != nil {
+			return err
+		}
+		pri2SecHost = ""
+		sec := pool.secondary(pool.active())
+		if sec != nil {
+			pri2SecHost = sec.Host
+		}
+		serving = withSecondary(topology, sec)
+	}
+	endpoints, err := newTopology(s.net, serving)
+	if err != nil {
+		return err
+	}
+	byName := map[string]*endpoint{}
+	var bindings []*net.UDPAddr
+	for _, e := range endpoints {
+		byName[e.Name] = e
+		bindings = append(bindings, e.addr)
+	}
+
+	response, err := config.ResponseProfile.attrs()
+	if err != nil {
+		return err
+	}
+	var auth *serverAuth
+	if config.Auth != nil {
+		if auth, err = newServerAuth(config.Auth, previousAuth); err != nil {
+			return err
+		}
+	}
+	if config.TURN != nil {
+		if err = config.TURN.validate(bindings...); err != nil {
+			return err
+		}
+	}
+	var rd *redirect
+	if config.Redirect != nil {
+		if rd, err = newRedirect(s.net, config.Redirect); err != nil {
+			return err
+		}
+	}
+
+	// the running state is only replaced below and by failover, both
+	// holding reloadMutex, so it is read without s.mutex
+	if s.role == "sec" && config.Pri2SecHost != s.pri2SecHost {
+		return errors.New("reload: cannot move the relay listener of a secondary")
+	}
+	accessLog := s.accessLog
+	switch {
+	case config.AccessLog == nil:
+		accessLog = nil
+	case s.accessLog == nil || !reflect.DeepEqual(*config.AccessLog, s.accessLog.configured):
+		// the old log stays open until the new one is in place
+		if accessLog, err = newAccessLog(config.AccessLog); err != nil {
+			return err
+		}
+	}
+	closeAccessLog := func() {
+		if accessLog != nil && accessLog != s.accessLog {
+			accessLog.close() // nolint:errcheck,gosec
+		}
+	}
+
+	started, stale, err := s.bind(endpoints)
+	if err != nil {
+		closeAccessLog()
+		return err
+	}
+	// TURN is replaced last, as the running one must stop to free its port
+	priIP := endpoints[0].addr.IP
+	turnServer := s.turnServer
+	if !s.endpoints[0].addr.IP.Equal(priIP) || !reflect.DeepEqual(config.TURN, s.turnConfig) {
+		if turnServer, err = s.replaceTURN(config.TURN, priIP); err != nil {
+			for _, e := range started {
+				closeAll(e.conns)
+			}
+			closeAccessLog()
+			return err
+		}
+	}
+
+	s.warnUnchangeable(config)
+	previousAccessLog, previousPool := s.accessLog, s.pool
+	s.mutex.Lock()
+	s.accessLog = accessLog
+	s.turnServer, s.turnConfig = turnServer, config.TURN
+	s.topology, s.endpoints, s.byName = topology, endpoints, byName
+	s.generation++
+	generation := s.generation
+	s.pool = pool
+	if l, ok := s.log.(*logging.DefaultLeveledLogger); ok && config.LogLevel != s.logLevel {
+		l.SetLevel(config.LogLevel)
+	}
+	s.logLevel = config.LogLevel
+	s.pri2SecHost = pri2SecHost
+	s.auth = auth
+	s.redirect = rd
+	s.software = newSoftware(config.Software)
+	s.response = response
+	switch {
+	case config.Rendezvous == nil:
+		s.rendezvous = nil
+	case s.rendezvous == nil:
+		s.rendezvous = newRendezvous(config.Rendezvous)
+	default:
+		s.rendezvous.configure(config.Rendezvous)
+	}
+	s.mutex.Unlock()
+
+	for _, e := range started {
+		s.serve(e, generation)
+	}
+	for _, conns := range stale {
+		closeAll(conns)
+	}
+	if previousAccessLog != nil && accessLog != previousAccessLog {
+		previousAccessLog.close() // nolint:errcheck,gosec
+	}
+	if previousPool != nil {
+		previousPool.close()
+	}
+	if pool != nil {
+		go s.heartbeatLoop(pool)
+	}
+	return nil
+}
+
+// replaceTURN stops the running TURN server and starts one for c on
+// priIP, which it returns. If that fails, the running configuration's
+// server is started again, without the allocations of the stopped one.
+func (s *STUNServer) replaceTURN(c *TURNConfig, priIP net.IP) (*turnv2.Server, error) {
+	if s.turnServer != nil {
+		if err := s.turnServer.Close(); err != nil {
+			s.log.Warnf("reload: closing TURN: %s", err.Error())
+		}
+	}
+	server, err := s.startTURN(c, priIP)
+	if err == nil {
+		return server, nil
+	}
+	restored, err2 := s.startTURN(s.turnConfig, s.endpoints[0].addr.IP)
+	if err2 != nil {
+		s.log.Errorf("reload: restarting TURN: %s", err2.Error())
+	}
+	s.mutex.Lock()
+	s.turnServer = restored
+	s.mutex.Unlock()
+	return nil, fmt.Errorf("reload: %s", err.Error())
+}
+
+// warnUnchangeable logs the settings of config a reload does not apply.
+func (s *STUNServer) warnUnchangeable(config *STUNServerConfig) {
+	if config.Workers != s.workers {
+		s.log.Warnf("reload: workers cannot change without a restart, keeping %d", s.workers)
+	}
+	if config.BatchSize != s.batchSize {
+		s.log.Warnf("reload: batchSize cannot change without a restart, keeping %d", s.batchSize)
+	}
+	if s.role != "sec" {
+		var running *SelfTestConfig
+		if s.selfTest != nil {
+			running = &s.selfTest.configured
+		}
+		if !reflect.DeepEqual(config.SelfTest, running) {
+			s.log.Warnf("reload: selfTest cannot change without a restart, keeping the running one")
+		}
+	}
+}
+
+// bind opens the listeners of endpoints, reusing the sockets of the
+// current endpoints whose address did not change. It returns the endpoints
+// with new listeners, which are not served yet, and the sockets of the
+// current listeners that endpoints drop, which the caller closes once
+// endpoints are in place; on failure nothing changes.
+func (s *STUNServer) bind(endpoints []*endpoint) (started []*endpoint, stale [][]net.PacketConn, err error) {
+	current := map[string][]net.PacketConn{}
+	for _, e := range s.endpoints {
+		if e.conn != nil {
+			current[e.addr.String()] = e.conns
+		}
+	}
+
+	kept := map[string]bool{}
+	for _, e := range endpoints {
+		if !s.listensOn(e) {
+			continue
+		}
+		if conns, ok := current[e.addr.String()]; ok {
+			e.conn, e.conns = conns[0], conns
+			kept[e.addr.String()] = true
+			continue
+		}
+		conns, err := s.listen(e)
+		if err != nil {
+			for _, started := range started {
+				closeAll(started.conns)
+			}
+			return nil, nil, err
+		}
+		e.conn, e.conns = conns[0], conns
+		started = append(started, e)
+	}
+
+	for addr, conns := range current {
+		if !kept[addr] {
+			s.log.Debugf("stop listening on %s...", addr)
+			stale = append(stale, conns)
+		}
+	}
+	return started, stale, nil
+}
@@ -0,0 +1,178 @@
+package nats
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+// exchange sends a binding request with setters to addr and returns the
+// response, nil if none came back within 500ms.
+func exchange(t *testing.T, conn net.PacketConn, addr string, setters ...stun.Setter) (*stun.Message, net.Addr) {
+	to, err := net.ResolveUDPAddr("udp4", addr)
+	if !assert.NoError(t, err, "should succeed") {
+		return nil, nil
+	}
+	msg, err := stun.Build(append([]stun.Setter{stun.TransactionID, stun.BindingRequest}, setters...)...)
+	if !assert.NoError(t, err, "should succeed") {
+		return nil, nil
+	}
+	if _, err = conn.WriteTo(msg.Raw, to); !assert.NoError(t, err, "should succeed") {
+		return nil, nil
+	}
+	res, from, err := readResponse(conn, msg.TransactionID, 500*time.Millisecond)
+	assert.NoError(t, err, "should succeed")
+	return res, from
+}
+
+func TestReloadOnVNet(t *testing.T) {
+	fullCone := &vnet.NATType{
+		MappingBehavior:   vnet.EndpointIndependent,
+		FilteringBehavior: vnet.EndpointIndependent,
+	}
+
+	v, err := buildVNetTopology(fullCone, testTopology, false)
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer v.close()
+	conn, err := v.net0.ListenPacket("udp4", "0.0.0.0:0")
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer conn.Close() // nolint:errcheck,gosec
+
+	config := func(topology []Endpoint) *STUNServerConfig {
+		return &STUNServerConfig{Topology: topology, Role: "both"}
+	}
+
+	t.Run("rejected", func(t *testing.T) {
+		assert.Error(t, v.server.Reload(&STUNServerConfig{Topology: testTopology, Role: "pri"}), "should not change role")
+		assert.Error(t, v.server.Reload(config(testTopology[:1])), "should not accept unknown partners")
+		res, _ := exchange(t, conn, "1.2.3.4:5000")
+		assert.NotNil(t, res, "should keep serving")
+	})
+
+	t.Run("rebind changed addresses only", func(t *testing.T) {
+		primary := v.server.endpoints[0].conn
+
+		moved := append([]Endpoint{}, testTopology...)
+		moved[4].Address = "1.2.3.4:5001"
+		moved[5].Address = "1.2.3.5:5001"
+		if !assert.NoError(t, v.server.Reload(config(moved)), "should succeed") {
+			return
+		}
+		assert.Equal(t, primary, v.server.endpoints[0].conn, "should keep the unchanged listener")
+
+		res, _ := exchange(t, conn, "1.2.3.4:5000")
+		assert.Nil(t, res, "should have stopped listening")
+		res, from := exchange(t, conn, "1.2.3.4:5001", &attrChangeRequest{ChangeIP: true})
+		if assert.NotNil(t, res, "should listen on the new address") {
+			assert.Equal(t, "1.2.3.5:5001", from.String(), "should follow the partner")
+		}
+	})
+
+	t.Run("auth", func(t *testing.T) {
+		reloaded := config(testTopology)
+		reloaded.Auth = &AuthConfig{Handler: func(username, realm string, srcAddr net.Addr) (string, bool) {
+			return "", false
+		}}
+		if !assert.NoError(t, v.server.Reload(reloaded), "should succeed") {
+			return
+		}
+		res, _ := exchange(t, conn, "1.2.3.4:3478")
+		if assert.NotNil(t, res, "should respond") {
+			assert.Equal(t, stun.BindingError, res.Type, "should require credentials")
+		}
+
+		if !assert.NoError(t, v.server.Reload(config(testTopology)), "should succeed") {
+			return
+		}
+		res, _ = exchange(t, conn, "1.2.3.4:3478")
+		if assert.NotNil(t, res, "should respond") {
+			assert.Equal(t, stun.BindingSuccess, res.Type, "should be open again")
+		}
+	})
+
+	t.Run("nonces", func(t *testing.T) {
+		reloaded := config(testTopology)
+		reloaded.Auth = &AuthConfig{LongTerm: true, Realm: "pion.ly", Handler: func(username, realm string, srcAddr net.Addr) (string, bool) {
+			return "secret", username == "alice"
+		}}
+		if !assert.NoError(t, v.server.Reload(reloaded), "should succeed") {
+			return
+		}
+		defer v.server.Reload(config(testTopology)) // nolint:errcheck,gosec
+		nonce := v.server.auth.newNonce(time.Now())
+		if !assert.NoError(t, v.server.Reload(reloaded), "should succeed") {
+			return
+		}
+		res, _ := exchange(t, conn, "1.2.3.4:3478", stun.NewUsername("alice"), stun.NewRealm("pion.ly"), nonce,
+			stun.NewLongTermIntegrity("alice", "pion.ly", "secret"))
+		if assert.NotNil(t, res, "should respond") {
+			assert.Equal(t, stun.BindingSuccess, res.Type, "should accept the nonce issued before the reload")
+		}
+	})
+
+	t.Run("failed TURN", func(t *testing.T) {
+		endpoints, software := v.server.endpoints, v.server.software
+		moved := append([]Endpoint{}, testTopology...)
+		moved[4].Address = "1.2.3.4:5002"
+		moved[5].Address = "1.2.3.5:5002"
+		reloaded := config(moved)
+		reloaded.Software = "reloaded"
+		reloaded.TURN = &TURNConfig{Port: 3480, Realm: "pion.ly", Users: map[string]string{"alice": "secret"}}
+		assert.Error(t, v.server.Reload(reloaded), "should not run TURN on a virtual network")
+		assert.Equal(t, endpoints, v.server.endpoints, "should keep the endpoints")
+		assert.Equal(t, software, v.server.software, "should keep the other settings")
+		assert.Nil(t, v.server.turnConfig, "should keep the TURN settings")
+
+		res, _ := exchange(t, conn, "1.2.3.4:5000")
+		assert.NotNil(t, res, "should keep the running listeners")
+		res, _ = exchange(t, conn, "1.2.3.4:5002")
+		assert.Nil(t, res, "should close the new listeners")
+	})
+}
+
+func TestReloadRelayPeerOnVNet(t *testing.T) {
+	v, err := buildVNetSplitRole(&vnet.NATType{
+		MappingBehavior:   vnet.EndpointIndependent,
+		FilteringBehavior: vnet.EndpointIndependent,
+	})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer v.close()
+
+	// The new peer only counts what it is sent
+	var relayed int32
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&relayed, 1)
+	}))
+	defer relay.Close()
+
+	conn, err := v.net0.ListenPacket("udp4", "0.0.0.0:0")
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer conn.Close() // nolint:errcheck,gosec
+
+	err = v.server.Reload(&STUNServerConfig{
+		PrimaryAddress:   "1.2.3.4:3478",
+		SecondaryAddress: "1.2.3.5:3479",
+		Role:             "pri",
+		Pri2SecHost:      relay.Listener.Addr().String(),
+	})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	exchange(t, conn, "1.2.3.4:3478", &attrChangeRequest{ChangeIP: true})
+	assert.Equal(t, int32(1), atomic.LoadInt32(&relayed), "should relay to the new peer")
+}
@@ -0,0 +1,84 @@
+package nats
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pion/transport/vnet"
+)
+
+// FuzzServerReadLoop feeds arbitrary datagrams to running servers, one open
+// and one with long-term credentials, and checks that both still answer a
+// plain binding request afterwards.
+func FuzzServerReadLoop(f *testing.F) {
+	seeds := [][]stun.Setter{
+		{stun.BindingRequest},
+		{stun.BindingRequest, &attrChangeRequest{ChangeIP: true, ChangePort: true}},
+		{stun.BindingRequest, &attrPadding{Length: 64}},
+		{stun.BindingRequest, &attrResponsePort{Port: 3478}},
+		{stun.BindingRequest, &attrSession{ID: "fuzz"}},
+		{stun.BindingRequest, stun.NewUsername("user"), stun.NewRealm("pion.ly"), stun.NewNonce("00")},
+		{stun.BindingRequest, stun.Fingerprint},
+		{stun.BindingSuccess},
+	}
+	for _, attrs := range seeds {
+		m, err := stun.Build(append([]stun.Setter{stun.TransactionID}, attrs...)...)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(m.Raw)
+		f.Add(m.Raw[:len(m.Raw)-1])
+	}
+	f.Add([]byte{})
+	f.Add([]byte("not a STUN message"))
+
+	natType := &vnet.NATType{
+		MappingBehavior:   vnet.EndpointIndependent,
+		FilteringBehavior: vnet.EndpointIndependent,
+	}
+	var conns []net.PacketConn
+	for _, config := range []*STUNServerConfig{
+		{Rendezvous: &RendezvousConfig{}},
+		{Auth: &AuthConfig{
+			LongTerm: true,
+			Realm:    "pion.ly",
+			Handler:  func(string, string, net.Addr) (string, bool) { return "pass", true },
+		}},
+	} {
+		v, err := buildVNetWithServer(natType, config)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Cleanup(v.close)
+		conn, err := v.net0.ListenPacket("udp4", "0.0.0.0:0")
+		if err != nil {
+			f.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	server := &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 3478}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, conn := range conns {
+			if _, err := conn.WriteTo(data, server); err != nil {
+				t.Fatal(err)
+			}
+			m, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = conn.WriteTo(m.Raw, server); err != nil {
+				t.Fatal(err)
+			}
+			res, _, err := readResponse(conn, m.TransactionID, time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res == nil {
+				t.Fatalf("server stopped answering after %x", data)
+			}
+		}
+	})
+}
@@ -0,0 +1,156 @@
+package nats
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+var errTransactionTimeout = errors.New("STUN transaction timed out")
+
+const (
+	// defaultRTO is the first retransmission timeout of the transactions
+	// on the sockets Discover owns.
+	defaultRTO = 200 * time.Millisecond
+	// maxRTO caps the doubling of the retransmission timeout.
+	maxRTO = 1600 * time.Millisecond
+	// rtoTransmissions is the number of transmissions (Rc) of a request.
+	rtoTransmissions = 7
+)
+
+// rtoTimeouts returns how long a transaction waits for its response after
+// each transmission: rto (defaultRTO if zero) doubling up to maxRTO.
+//
+// RFC 5389 Section 7.2.1
+func rtoTimeouts(rto time.Duration) []time.Duration {
+	if rto <= 0 {
+		rto = defaultRTO
+	}
+	timeouts := make([]time.Duration, rtoTransmissions)
+	for i := range timeouts {
+		timeouts[i] = rto
+		if rto *= 2; rto > maxRTO {
+			rto = maxRTO
+		}
+	}
+	return timeouts
+}
+
+type sharedResponse struct {
+	msg  *stun.Message
+	from net.Addr
+}
+
+// SharedConn wraps an application socket so that NATS.DiscoverOn can run
+// STUN transactions over it while the application keeps using it. Responses
+// to those transactions are consumed by ReadFrom; every other datagram is
+// returned to the caller as usual.
+type SharedConn struct {
+	net.PacketConn
+	timeouts []time.Duration // wait after each transmission of a request
+	mutex    sync.Mutex
+	pending  map[[stun.TransactionIDSize]byte]chan sharedResponse
+}
+
+// NewSharedConn returns a SharedConn reading from and writing to conn.
+func NewSharedConn(conn net.PacketConn) *SharedConn {
+	timeouts := make([]time.Duration, probeAttempts)
+	for i := range timeouts {
+		timeouts[i] = probeTimeout
+	}
+	return newSharedConn(conn, timeouts)
+}
+
+func newSharedConn(conn net.PacketConn, timeouts []time.Duration) *SharedConn {
+	return &SharedConn{
+		PacketConn: conn,
+		timeouts:   timeouts,
+		pending:    map[[stun.TransactionIDSize]byte]chan sharedResponse{},
+	}
+}
+
+// ownConn runs transactions over conn, a socket nobody else reads, with
+// the retransmissions of rtoTimeouts(rto). It reads conn in the
+// background until conn is closed.
+func ownConn(conn net.PacketConn, rto time.Duration) *SharedConn {
+	c := newSharedConn(conn, rtoTimeouts(rto))
+	go func() {
+		buf := make([]byte, maxMessageSize)
+		for {
+			// other datagrams are dropped
+			if _, _, err := c.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+	return c
+}
+
+// ReadFrom reads the next datagram that is not a response to a pending
+// discovery transaction. p must be large enough for the STUN responses.
+func (c *SharedConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, from, err := c.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, from, err
+		}
+		if !c.deliver(p[:n], from) {
+			return n, from, nil
+		}
+	}
+}
+
+// deliver hands a STUN response to the transaction waiting for it and
+// reports whether it did.
+func (c *SharedConn) deliver(b []byte, from net.Addr) bool {
+	if !stun.IsMessage(b) {
+		return false
+	}
+	msg := &stun.Message{Raw: append([]byte{}, b...)}
+	if msg.Decode() != nil || msg.Type.Class == stun.ClassRequest {
+		return false
+	}
+
+	c.mutex.Lock()
+	ch, ok := c.pending[msg.TransactionID]
+	c.mutex.Unlock()
+	if !ok {
+		return false
+	}
+
+	select {
+	case ch <- sharedResponse{msg: msg, from: from}:
+	default: // duplicate response to a retransmission
+	}
+	return true
+}
+
+func (c *SharedConn) transact(msg *stun.Message, to net.Addr) (*stun.Message, net.Addr, error) {
+	ch := make(chan sharedResponse, 1)
+	c.mutex.Lock()
+	c.pending[msg.TransactionID] = ch
+	c.mutex.Unlock()
+
+	defer func() {
+		c.mutex.Lock()
+		delete(c.pending, msg.TransactionID)
+		c.mutex.Unlock()
+	}()
+
+	for _, timeout := range c.timeouts {
+		if _, err := c.WriteTo(msg.Raw, to); err != nil {
+			return nil, nil, err
+		}
+		timer := time.NewTimer(timeout)
+		select {
+		case res := <-ch:
+			timer.Stop()
+			return res.msg, res.from, nil
+		case <-timer.C:
+		}
+	}
+	return nil, nil, errTransactionTimeout
+}
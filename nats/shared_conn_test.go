@@ -0,0 +1,195 @@
+package nats
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+type appDatagram struct {
+	data string
+	from string
+}
+
+// readApp reads conn like an application would, forwarding everything it
+// gets to the returned channel until conn is closed.
+func readApp(conn net.PacketConn) <-chan appDatagram {
+	ch := make(chan appDatagram, 64)
+	go func() {
+		defer close(ch)
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			ch <- appDatagram{data: string(buf[:n]), from: from.String()}
+		}
+	}()
+	return ch
+}
+
+func TestDiscoverOnSharedConn(t *testing.T) {
+	fullCone := &vnet.NATType{
+		MappingBehavior:   vnet.EndpointIndependent,
+		FilteringBehavior: vnet.EndpointIndependent,
+	}
+	v, err := buildVNetLANs(&STUNServerConfig{}, fullCone, fullCone)
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer v.close()
+
+	nats, err := NewNATS(&Config{
+		Server:  "stun.pion.net:3478",
+		Verbose: true,
+		Net:     v.net0,
+	})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+
+	// A peer on the other LAN echoes whatever the application sends.
+	peerConn, err := v.nets[1].ListenPacket("udp4", "0.0.0.0:0")
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer peerConn.Close() // nolint:errcheck,gosec
+	msg, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	_, err = peerConn.WriteTo(msg.Raw, nats.serverAddr)
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	res, _, err := readResponse(peerConn, msg.TransactionID, time.Second)
+	if !assert.NoError(t, err, "should succeed") || !assert.NotNil(t, res, "should respond") {
+		return
+	}
+	var peerAddr stun.XORMappedAddress
+	if !assert.NoError(t, peerAddr.GetFrom(res), "should succeed") {
+		return
+	}
+	peer := &net.UDPAddr{IP: peerAddr.IP, Port: peerAddr.Port}
+	if !assert.NoError(t, peerConn.SetReadDeadline(time.Time{}), "should succeed") {
+		return
+	}
+	peerFrom := make(chan string, 64)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := peerConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			peerFrom <- from.String()
+			peerConn.WriteTo(buf[:n], from) // nolint:errcheck,gosec
+		}
+	}()
+
+	t.Run("mapping and filtering", func(t *testing.T) {
+		mappingConn, err := v.net0.ListenPacket("udp4", "0.0.0.0:0")
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		filteringConn, err := v.net0.ListenPacket("udp4", "0.0.0.0:0")
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		shared := NewSharedConn(mappingConn)
+		sharedFiltering := NewSharedConn(filteringConn)
+		appCh := readApp(shared)
+		filteringCh := readApp(sharedFiltering)
+
+		// Keep application traffic flowing while discovery runs.
+		stop := make(chan struct{})
+		sent := make(chan int)
+		go func() {
+			n := 0
+			if _, err := shared.WriteTo([]byte("ping"), peer); err == nil {
+				n++
+			}
+			ticker := time.NewTicker(20 * time.Millisecond)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stop:
+					sent <- n
+					return
+				case <-ticker.C:
+					if _, err := shared.WriteTo([]byte("ping"), peer); err == nil {
+						n++
+					}
+				}
+			}
+		}()
+
+		res, err := nats.DiscoverOn(shared, sharedFiltering)
+		close(stop)
+		n := <-sent
+		time.Sleep(100 * time.Millisecond)
+		mappingConn.Close()   // nolint:errcheck,gosec
+		filteringConn.Close() // nolint:errcheck,gosec
+
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		assert.True(t, res.IsNatted, "should be natted")
+		assert.Equal(t, EndpointIndependent, res.MappingBehavior, "should match")
+		assert.Equal(t, EndpointIndependent, res.FilteringBehavior, "should match")
+		assert.Equal(t, FullCone, res.NATType, "should match")
+		assert.Equal(t, "27.1.1.1", res.ExternalIP, "should match")
+
+		// The peer saw the application socket at the discovered address.
+		external := net.JoinHostPort(res.ExternalIP, res.ExternalPort)
+		select {
+		case from := <-peerFrom:
+			assert.Equal(t, external, from, "should match")
+		case <-time.After(time.Second):
+			t.Error("peer received no application data")
+		}
+		for len(peerFrom) > 0 {
+			<-peerFrom
+		}
+
+		// Only the echoes reached the application; the STUN responses did not.
+		echoes := 0
+		for d := range appCh {
+			assert.Equal(t, "ping", d.data, "should be application data")
+			assert.Equal(t, peer.String(), d.from, "should come from the peer")
+			echoes++
+		}
+		assert.True(t, n > 0, "should have sent application data")
+		assert.Equal(t, n, echoes, "should receive every echo")
+		for d := range filteringCh {
+			t.Errorf("unexpected datagram on the filtering socket: %q", d.data)
+		}
+	})
+
+	t.Run("mapping only", func(t *testing.T) {
+		conn, err := v.net0.ListenPacket("udp4", "0.0.0.0:0")
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		shared := NewSharedConn(conn)
+		appCh := readApp(shared)
+
+		res, err := nats.DiscoverOn(shared, nil)
+		conn.Close() // nolint:errcheck,gosec
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		assert.True(t, res.IsNatted, "should be natted")
+		assert.Equal(t, EndpointIndependent, res.MappingBehavior, "should match")
+		assert.Equal(t, EndpointUndefined, res.FilteringBehavior, "should match")
+		assert.Equal(t, NATTypeUndefined, res.NATType, "should match")
+		for d := range appCh {
+			t.Errorf("unexpected datagram: %q", d.data)
+		}
+	})
+}
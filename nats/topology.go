@@ -0,0 +1,152 @@
+package nats
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/pion/transport/vnet"
+)
+
+// Endpoint is one address of the server. A topology lists every endpoint
+// of a deployment and, for each, the endpoints answering a CHANGE-REQUEST
+// received on it.
+type Endpoint struct {
+	// Name identifies the endpoint in partner references, defaulting to
+	// Address.
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	// Host is the role ("pri" or "sec") of the server listening on the
+	// endpoint, "pri" if empty. A server with role "both" listens on all
+	// of them.
+	Host string `json:"host"`
+	// ChangeIP, ChangePort and ChangeBoth name the partner endpoints. A
+	// CHANGE-REQUEST without a partner is answered with 420 (Unknown
+	// Attribute).
+	ChangeIP   string `json:"changeIP"`
+	ChangePort string `json:"changePort"`
+	ChangeBoth string `json:"changeBoth"`
+}
+
+type endpoint struct {
+	Endpoint
+	addr  *net.UDPAddr
+	index int            // position in the topology
+	conn  net.PacketConn // nil unless this server listens on it
+	// conns are all the sockets bound to addr, conn being the first
+	conns []net.PacketConn
+
+	changeIP   *endpoint
+	changePort *endpoint
+	changeBoth *endpoint
+}
+
+// partner returns the endpoint answering a request received on e, nil if
+// the requested change is not available.
+func (e *endpoint) partner(changeIP, changePort bool) *endpoint {
+	switch {
+	case changeIP && changePort:
+		return e.changeBoth
+	case changeIP:
+		return e.changeIP
+	case changePort:
+		return e.changePort
+	}
+	return e
+}
+
+// defaultTopology crosses the primary and secondary IPs and ports into the
+// four endpoints of RFC 5780, the first one being the primary address.
+func defaultTopology(primary, secondary string) []Endpoint {
+	split := func(addr string) (string, string) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			// no port, or an IPv6 address without brackets
+			return strings.Trim(addr, "[]"), "3478"
+		}
+		return host, port
+	}
+	priIP, priPort := split(primary)
+	secIP, secPort := split(secondary)
+
+	addrs := []string{
+		net.JoinHostPort(priIP, priPort), // primary IP, primary port
+		net.JoinHostPort(priIP, secPort), // primary IP, secondary port
+		net.JoinHostPort(secIP, priPort), // secondary IP, primary port
+		net.JoinHostPort(secIP, secPort), // secondary IP, secondary port
+	}
+	var topology []Endpoint
+	for i, addr := range addrs {
+		host := "pri"
+		if i >= 2 {
+			host = "sec"
+		}
+		topology = append(topology, Endpoint{
+			Address:    addr,
+			Host:       host,
+			ChangeIP:   addrs[i^0x2],
+			ChangePort: addrs[i^0x1],
+			ChangeBoth: addrs[i^0x3],
+		})
+	}
+	return topology
+}
+
+// newTopology resolves and cross-links the endpoints of config, checking
+// that each partner differs from its endpoint as its change requires.
+func newTopology(n *vnet.Net, config []Endpoint) ([]*endpoint, error) {
+	if len(config) == 0 {
+		return nil, fmt.Errorf("topology: no endpoints")
+	}
+
+	var endpoints []*endpoint
+	byName := map[string]*endpoint{}
+	for _, c := range config {
+		if c.Name == "" {
+			c.Name = c.Address
+		}
+		if c.Host == "" {
+			c.Host = "pri"
+		}
+		if c.Host != "pri" && c.Host != "sec" {
+			return nil, fmt.Errorf("topology: endpoint %s: bad host %q", c.Name, c.Host)
+		}
+		if _, ok := byName[c.Name]; ok {
+			return nil, fmt.Errorf("topology: duplicate endpoint %s", c.Name)
+		}
+		addr, err := n.ResolveUDPAddr("udp", c.Address)
+		if err != nil {
+			return nil, fmt.Errorf("topology: endpoint %s: %s", c.Name, err.Error())
+		}
+		e := &endpoint{Endpoint: c, addr: addr, index: len(endpoints)}
+		endpoints = append(endpoints, e)
+		byName[c.Name] = e
+	}
+
+	for _, e := range endpoints {
+		for _, p := range []struct {
+			name    string
+			partner **endpoint
+			// the partner differs in IP, in port
+			changeIP, changePort bool
+			differs              string
+		}{
+			{e.ChangeIP, &e.changeIP, true, false, "in IP only"},
+			{e.ChangePort, &e.changePort, false, true, "in port only"},
+			{e.ChangeBoth, &e.changeBoth, true, true, "in both IP and port"},
+		} {
+			if p.name == "" {
+				continue
+			}
+			partner, ok := byName[p.name]
+			if !ok {
+				return nil, fmt.Errorf("topology: endpoint %s: unknown partner %s", e.Name, p.name)
+			}
+			if partner.addr.IP.Equal(e.addr.IP) == p.changeIP || (partner.addr.Port == e.addr.Port) == p.changePort {
+				return nil, fmt.Errorf("topology: endpoint %s: partner %s must differ %s", e.Name, p.name, p.differs)
+			}
+			*p.partner = partner
+		}
+	}
+	return endpoints, nil
+}
@@ -0,0 +1,225 @@
+package nats
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultTopology(t *testing.T) {
+	endpoints, err := newTopology(vnet.NewNet(nil), defaultTopology("1.2.3.4:3478", "1.2.3.5:3479"))
+	if !assert.NoError(t, err, "should succeed") || !assert.Len(t, endpoints, 4, "should cross IPs and ports") {
+		return
+	}
+	for i, want := range []string{"1.2.3.4:3478", "1.2.3.4:3479", "1.2.3.5:3478", "1.2.3.5:3479"} {
+		assert.Equal(t, want, endpoints[i].addr.String(), "should match")
+	}
+	for i, e := range endpoints {
+		assert.Equal(t, endpoints[i^0x2], e.partner(true, false), "should change IP")
+		assert.Equal(t, endpoints[i^0x1], e.partner(false, true), "should change port")
+		assert.Equal(t, endpoints[i^0x3], e.partner(true, true), "should change both")
+		assert.Equal(t, e, e.partner(false, false), "should not change")
+	}
+	assert.Equal(t, "pri", endpoints[1].Host, "should match")
+	assert.Equal(t, "sec", endpoints[2].Host, "should match")
+
+	var addrs []string
+	for _, e := range defaultTopology("[::1]:3478", "::2") {
+		addrs = append(addrs, e.Address)
+	}
+	assert.Equal(t, []string{"[::1]:3478", "[::1]:3478", "[::2]:3478", "[::2]:3478"}, addrs, "should keep IPv6 addresses whole")
+}
+
+func TestNewTopologyErrors(t *testing.T) {
+	for _, topology := range [][]Endpoint{
+		nil,
+		{{Address: "1.2.3.4:3478"}, {Address: "1.2.3.4:3478"}},
+		{{Name: "a", Address: "1.2.3.4:3478", ChangeIP: "b"}},
+		{{Address: "1.2.3.4:3478", Host: "both"}},
+		{{Address: "1.2.3.4:bogus"}},
+	} {
+		_, err := newTopology(vnet.NewNet(nil), topology)
+		assert.Error(t, err, "should fail: %+v", topology)
+	}
+}
+
+func TestNewTopologyPartners(t *testing.T) {
+	for name, topology := range map[string][]Endpoint{
+		"change IP to another port": {
+			{Address: "1.2.3.4:3478", ChangeIP: "1.2.3.5:3479"},
+			{Address: "1.2.3.5:3479", Host: "sec"},
+		},
+		"change IP to the same IP": {
+			{Address: "1.2.3.4:3478", ChangeIP: "1.2.3.4:3479"},
+			{Address: "1.2.3.4:3479"},
+		},
+		"change port to another IP": {
+			{Address: "1.2.3.4:3478", ChangePort: "1.2.3.5:3479"},
+			{Address: "1.2.3.5:3479", Host: "sec"},
+		},
+		"change port to the same port": {
+			{Address: "1.2.3.4:3478", ChangePort: "1.2.3.5:3478"},
+			{Address: "1.2.3.5:3478", Host: "sec"},
+		},
+		"change both to the same IP": {
+			{Address: "1.2.3.4:3478", ChangeBoth: "1.2.3.4:3479"},
+			{Address: "1.2.3.4:3479"},
+		},
+		"change both to the same port": {
+			{Address: "1.2.3.4:3478", ChangeBoth: "1.2.3.5:3478"},
+			{Address: "1.2.3.5:3478", Host: "sec"},
+		},
+		"change to itself": {
+			{Address: "1.2.3.4:3478", ChangeIP: "1.2.3.4:3478"},
+		},
+	} {
+		_, err := newTopology(vnet.NewNet(nil), topology)
+		if assert.Error(t, err, "should reject %s", name) {
+			assert.Contains(t, err.Error(), "must differ", "should reject %s", name)
+		}
+	}
+
+	_, err := newTopology(vnet.NewNet(nil), testTopology)
+	assert.NoError(t, err, "should accept the test topology")
+}
+
+// testTopology is the RFC 5780 layout on named endpoints plus an alternate
+// pair, "alt" on the primary host and "alt-sec" on the secondary, on ports
+// of their own and without a port partner.
+var testTopology = []Endpoint{
+	{Name: "pp", Address: "1.2.3.4:3478", ChangeIP: "sp", ChangePort: "ps", ChangeBoth: "ss"},
+	{Name: "ps", Address: "1.2.3.4:3479", ChangeIP: "ss", ChangePort: "pp", ChangeBoth: "sp"},
+	{Name: "sp", Address: "1.2.3.5:3478", Host: "sec", ChangeIP: "pp", ChangePort: "ss", ChangeBoth: "ps"},
+	{Name: "ss", Address: "1.2.3.5:3479", Host: "sec", ChangeIP: "ps", ChangePort: "sp", ChangeBoth: "pp"},
+	{Name: "alt", Address: "1.2.3.4:5000", ChangeIP: "alt-sec"},
+	{Name: "alt-sec", Address: "1.2.3.5:5000", Host: "sec", ChangeIP: "alt"},
+}
+
+// buildVNetTopology is buildVNet with an explicit topology, served by one
+// server with role "both" or by split "pri" and "sec" servers.
+func buildVNetTopology(natType *vnet.NATType, topology []Endpoint, split bool) (*virtualNet, error) {
+	if !split {
+		return buildVNetWithServer(natType, &STUNServerConfig{Topology: topology})
+	}
+
+	v, serverNets, err := buildTopology([][]string{{"1.2.3.4"}, {"1.2.3.5"}}, natType)
+	if err != nil {
+		return nil, err
+	}
+	sec, err := NewSTUNServer(&STUNServerConfig{
+		Topology: topology,
+		Net:      serverNets[1],
+		Role:     "sec",
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = sec.Start(); err != nil {
+		return nil, err
+	}
+	relay := httptest.NewServer(http.HandlerFunc(sec.priToSecHandler))
+	v.cleanup = append(v.cleanup, relay.Close, func() {
+		sec.Close() // nolint:errcheck,gosec
+	})
+
+	v.server, err = NewSTUNServer(&STUNServerConfig{
+		Topology:    topology,
+		Net:         serverNets[0],
+		Role:        "pri",
+		Pri2SecHost: relay.Listener.Addr().String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = v.server.Start(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func TestTopologyOnVNet(t *testing.T) {
+	fullCone := &vnet.NATType{
+		MappingBehavior:   vnet.EndpointIndependent,
+		FilteringBehavior: vnet.EndpointIndependent,
+	}
+
+	for _, split := range []bool{false, true} {
+		split := split
+		name := "both"
+		if split {
+			name = "split"
+		}
+		t.Run(name, func(t *testing.T) {
+			v, err := buildVNetTopology(fullCone, testTopology, split)
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+			defer v.close()
+
+			t.Run("discover", func(t *testing.T) {
+				n, err := NewNATS(&Config{Server: "1.2.3.4:3478", Net: v.net0})
+				if !assert.NoError(t, err, "should succeed") {
+					return
+				}
+				res, err := n.Discover()
+				if !assert.NoError(t, err, "should succeed") {
+					return
+				}
+				assert.Equal(t, FullCone, res.NATType, "should match")
+			})
+
+			conn, err := v.net0.ListenPacket("udp4", "0.0.0.0:0")
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+			defer conn.Close() // nolint:errcheck,gosec
+			alt := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 5000}
+
+			request := func(t *testing.T, changeIP, changePort bool) (*stun.Message, net.Addr) {
+				msg, err := stun.Build(stun.TransactionID, stun.BindingRequest,
+					&attrChangeRequest{ChangeIP: changeIP, ChangePort: changePort})
+				if !assert.NoError(t, err, "should succeed") {
+					return nil, nil
+				}
+				if _, err = conn.WriteTo(msg.Raw, alt); !assert.NoError(t, err, "should succeed") {
+					return nil, nil
+				}
+				res, from, err := readResponse(conn, msg.TransactionID, time.Second)
+				assert.NoError(t, err, "should succeed")
+				return res, from
+			}
+
+			t.Run("change IP on alternate endpoint", func(t *testing.T) {
+				res, from := request(t, true, false)
+				if !assert.NotNil(t, res, "should respond") {
+					return
+				}
+				assert.Equal(t, stun.BindingSuccess, res.Type, "should succeed")
+				assert.Equal(t, "1.2.3.5:5000", from.String(), "should come from the partner")
+				assert.False(t, res.Contains(attrTypeChangedAddress), "should have no CHANGED-ADDRESS")
+			})
+
+			t.Run("change port without partner", func(t *testing.T) {
+				res, from := request(t, false, true)
+				if !assert.NotNil(t, res, "should respond") {
+					return
+				}
+				assert.Equal(t, alt.String(), from.String(), "should come from the receiving endpoint")
+				var code stun.ErrorCodeAttribute
+				if assert.NoError(t, code.GetFrom(res), "should have ERROR-CODE") {
+					assert.Equal(t, stun.CodeUnknownAttribute, code.Code, "should match")
+				}
+				var unknown stun.UnknownAttributes
+				if assert.NoError(t, unknown.GetFrom(res), "should have UNKNOWN-ATTRIBUTES") {
+					assert.Equal(t, stun.UnknownAttributes{attrTypeChangeRequest}, unknown, "should match")
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package nats
+
+import (
+	"context"
+	"net"
+
+	"github.com/pion/stun"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/jiangz222/go-nat-discovery/nats"
+
+// Span attributes of request handling.
+const (
+	attrKeySource     = attribute.Key("stun.source")
+	attrKeyListener   = attribute.Key("stun.listener")
+	attrKeyEndpoint   = attribute.Key("stun.endpoint")
+	attrKeyResponder  = attribute.Key("stun.responder")
+	attrKeyChangeIP   = attribute.Key("stun.change_ip")
+	attrKeyChangePort = attribute.Key("stun.change_port")
+	attrKeyRelay      = attribute.Key("stun.relay")
+	attrKeyOutcome    = attribute.Key("stun.outcome")
+	attrKeyHTTPStatus = attribute.Key("http.status_code")
+)
+
+// startSpan starts a server span for a request from from. Without tracing
+// it returns the no-op span of ctx, which costs no allocation.
+func (s *STUNServer) startSpan(ctx context.Context, name string, from net.Addr) (context.Context, trace.Span) {
+	if !s.tracing {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	var attrs []attribute.KeyValue
+	if from != nil {
+		attrs = append(attrs, attrKeySource.String(from.String()))
+	}
+	return s.tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attrs...))
+}
+
+// spanError marks span as failed with err.
+func spanError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// finish ends the span of a request received on e (nil if unknown) with
+// its relay decision and outcome, and writes its access log entry to the
+// access log of st. st may be nil for requests without a source.
+func (s *STUNServer) finish(st *snapshot, span trace.Span, e *endpoint, from net.Addr, m *stun.Message, relay, outcome string, err error) {
+	if span.IsRecording() {
+		span.SetAttributes(attrKeyRelay.String(relay), attrKeyOutcome.String(outcome))
+		if e != nil {
+			span.SetAttributes(attrKeyListener.Int(e.index), attrKeyEndpoint.String(e.Name))
+		}
+		if m != nil {
+			changeReq := attrChangeRequest{}
+			if changeReq.GetFrom(m) == nil {
+				span.SetAttributes(attrKeyChangeIP.Bool(changeReq.ChangeIP), attrKeyChangePort.Bool(changeReq.ChangePort))
+			}
+		}
+		if err != nil {
+			spanError(span, err)
+		}
+	}
+	span.End()
+
+	if from != nil {
+		s.logAccess(st.accessLog, e, from, m, relay, outcome, err)
+	}
+}
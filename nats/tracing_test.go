@@ -0,0 +1,102 @@
+package nats
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// spansByName waits for n spans and indexes them by name.
+func spansByName(t *testing.T, exporter *tracetest.InMemoryExporter, n int) map[string]tracetest.SpanStub {
+	assert.Eventually(t, func() bool {
+		return len(exporter.GetSpans()) >= n
+	}, time.Second, 10*time.Millisecond, "should export %d spans", n)
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	return spans
+}
+
+func attrValue(span tracetest.SpanStub, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTracingAcrossRelayOnVNet(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer tp.Shutdown(context.Background()) // nolint:errcheck,gosec
+
+	v, err := buildVNetSplitRoleWith(&vnet.NATType{
+		MappingBehavior:   vnet.EndpointIndependent,
+		FilteringBehavior: vnet.EndpointIndependent,
+	}, &STUNServerConfig{TracerProvider: tp})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer v.close()
+	conn, err := v.net0.ListenPacket("udp4", "0.0.0.0:0")
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer conn.Close() // nolint:errcheck,gosec
+
+	t.Run("one trace over the relay", func(t *testing.T) {
+		exporter.Reset()
+		res, from := exchange(t, conn, "1.2.3.4:3478", &attrChangeRequest{ChangeIP: true})
+		if !assert.NotNil(t, res, "should respond") {
+			return
+		}
+		assert.Equal(t, "1.2.3.5:3478", from.String(), "should come from the secondary")
+
+		spans := spansByName(t, exporter, 3)
+		request, relay, relayed := spans["stun.request"], spans["stun.relay"], spans["stun.relayed"]
+		assert.False(t, request.Parent.IsValid(), "request should be the root")
+		assert.Equal(t, request.SpanContext.TraceID(), relay.SpanContext.TraceID(), "should share the trace")
+		assert.Equal(t, request.SpanContext.SpanID(), relay.Parent.SpanID(), "relay should be a child of the request")
+		assert.Equal(t, relay.SpanContext.TraceID(), relayed.SpanContext.TraceID(), "should cross the HTTP hop")
+		assert.Equal(t, relay.SpanContext.SpanID(), relayed.Parent.SpanID(), "secondary should be a child of the relay")
+
+		assert.Equal(t, relaySecondary, attrValue(request, attrKeyRelay).AsString(), "should match")
+		assert.Equal(t, outcomeRelayed, attrValue(request, attrKeyOutcome).AsString(), "should match")
+		assert.True(t, attrValue(request, attrKeyChangeIP).AsBool(), "should record the flags")
+		assert.Equal(t, int64(200), attrValue(relay, attrKeyHTTPStatus).AsInt64(), "should match")
+		assert.Equal(t, outcomeOK, attrValue(relayed, attrKeyOutcome).AsString(), "should match")
+	})
+
+	t.Run("local request", func(t *testing.T) {
+		exporter.Reset()
+		res, _ := exchange(t, conn, "1.2.3.4:3478")
+		if !assert.NotNil(t, res, "should respond") {
+			return
+		}
+		spans := spansByName(t, exporter, 1)
+		assert.Len(t, spans, 1, "should not relay")
+		assert.Equal(t, relayLocal, attrValue(spans["stun.request"], attrKeyRelay).AsString(), "should match")
+	})
+
+	t.Run("secondary down", func(t *testing.T) {
+		v.cleanup[0]() // close the relay
+		exporter.Reset()
+		res, _ := exchange(t, conn, "1.2.3.4:3478", &attrChangeRequest{ChangeIP: true})
+		assert.Nil(t, res, "should be lost")
+
+		spans := spansByName(t, exporter, 2)
+		assert.Equal(t, codes.Error, spans["stun.relay"].Status.Code, "relay should fail")
+		assert.Equal(t, codes.Error, spans["stun.request"].Status.Code, "request should fail")
+		assert.Equal(t, outcomeFailed, attrValue(spans["stun.request"], attrKeyOutcome).AsString(), "should match")
+	})
+}
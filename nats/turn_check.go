@@ -0,0 +1,181 @@
+package nats
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/stun"
+	"github.com/pion/turn"
+)
+
+// TURNResult contains the outcome of CheckTURN.
+type TURNResult struct {
+	Allocated      bool   `json:"allocated"`
+	RelayedAddress string `json:"relayedAddress,omitempty"`
+	// RoundTrip is set when data made it through the relay and back.
+	RoundTrip time.Duration `json:"roundTrip,omitempty"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// CheckTURN tells whether TURN works from this network: it allocates a
+// relay on Config.TURNServer, then sends data from a second local socket to
+// the relayed address and echoes it back through the relay.
+//
+// Failures of the test itself are reported in TURNResult.Error, the error
+// return is for local problems only.
+func (nats *NATS) CheckTURN() (*TURNResult, error) {
+	if nats.turnServer == "" {
+		return nil, errors.New("TURN server is not configured")
+	}
+	res := &TURNResult{}
+
+	conn, err := nats.net.ListenPacket("udp4", "0.0.0.0:0")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	c, err := turn.NewClient(&turn.ClientConfig{
+		STUNServerAddr: nats.turnServer,
+		TURNServerAddr: nats.turnServer,
+		Username:       nats.turnUsername,
+		Password:       nats.turnPassword,
+		Realm:          nats.turnRealm,
+		Conn:           conn,
+		LoggerFactory:  logging.NewDefaultLoggerFactory(),
+		Net:            nats.net,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	if err = c.Listen(); err != nil {
+		return nil, err
+	}
+
+	relayConn, err := c.Allocate()
+	if err != nil {
+		res.Error = fmt.Sprintf("allocation failed: %s", err.Error())
+		return res, nil
+	}
+	defer relayConn.Close()
+	res.Allocated = true
+	res.RelayedAddress = relayConn.LocalAddr().String()
+	if nats.verbose {
+		log.Printf("TURN relayed address: %s", res.RelayedAddress)
+	}
+
+	// The peer socket stands in for a remote party; it learns its own
+	// reflexive address from the TURN server so the relay can be
+	// permitted to reach it.
+	peer, err := nats.net.ListenPacket("udp4", "0.0.0.0:0")
+	if err != nil {
+		return nil, err
+	}
+	defer peer.Close()
+
+	peerAddr, err := nats.reflexiveAddr(peer, c.TURNServerAddr(), false)
+	if err != nil {
+		res.Error = fmt.Sprintf("peer binding failed: %s", err.Error())
+		return res, nil
+	}
+
+	// Permits the peer, the datagram itself may well be filtered by the
+	// peer's NAT.
+	if _, err = relayConn.WriteTo([]byte("permit"), peerAddr); err != nil {
+		res.Error = fmt.Sprintf("create permission failed: %s", err.Error())
+		return res, nil
+	}
+
+	// Relay side: echo whatever the peer sends.
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := relayConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if _, err = relayConn.WriteTo(buf[:n], from); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := []byte("go-nat-discovery turn check")
+	relayedAddr := relayConn.LocalAddr()
+	buf := make([]byte, 1500)
+	for i := 0; i < probeAttempts && res.RoundTrip == 0; i++ {
+		start := time.Now()
+		if _, err = peer.WriteTo(ping, relayedAddr); err != nil {
+			return nil, err
+		}
+		if err = peer.SetReadDeadline(start.Add(probeTimeout * 2)); err != nil {
+			return nil, err
+		}
+		for {
+			n, from, err := peer.ReadFrom(buf)
+			if err != nil {
+				break // timed out, resend
+			}
+			if from.String() == relayedAddr.String() && bytes.Equal(buf[:n], ping) {
+				res.RoundTrip = time.Since(start)
+				break
+			}
+		}
+	}
+	if res.RoundTrip == 0 {
+		res.Error = "no data came back through the relay"
+	} else if nats.verbose {
+		log.Printf("TURN round trip: %s", res.RoundTrip)
+	}
+	return res, nil
+}
+
+// reflexiveAddr returns the address of conn as seen by the STUN server at to.
+// signed requests carry the credentials from Config, for our own server.
+func (nats *NATS) reflexiveAddr(conn net.PacketConn, to net.Addr, signed bool) (net.Addr, error) {
+	build := stun.Build
+	if signed {
+		build = nats.buildRequest
+	}
+	msg, err := build(stun.TransactionID, stun.BindingRequest)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < probeAttempts; i++ {
+		if _, err = conn.WriteTo(msg.Raw, to); err != nil {
+			return nil, err
+		}
+		res, _, err := readResponse(conn, msg.TransactionID, probeTimeout)
+		if err != nil {
+			return nil, err
+		}
+		if res == nil {
+			continue
+		}
+		if signed {
+			retry, err := nats.checkResponse(msg, res)
+			if err != nil {
+				return nil, err
+			}
+			if retry {
+				if msg, err = build(stun.TransactionID, stun.BindingRequest); err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
+		mapped, err := getMappedAddress(res)
+		if err != nil {
+			return nil, err
+		}
+		return mapped, nil
+	}
+	return nil, errors.New("no response")
+}
@@ -0,0 +1,141 @@
+package nats
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/pion/logging"
+	turnv2 "github.com/pion/turn/v2"
+)
+
+const (
+	defaultRelayMinPort = 49152
+	defaultRelayMaxPort = 65535
+)
+
+// TURNConfig runs a TURN server on the primary IP next to the binding
+// service, as a relay fallback for clients that cannot connect directly.
+type TURNConfig struct {
+	// Port must differ from the primary and secondary ports.
+	Port  int
+	Realm string
+	// Users holds static long-term credentials, username to password.
+	Users map[string]string
+	// SharedSecret also accepts time-limited credentials generated with
+	// the TURN REST API scheme (username "expiry:name").
+	SharedSecret string
+	// RelayAddress is the IP advertised for allocations, defaults to the
+	// primary IP. Set it when the server is behind a 1:1 NAT, or to an
+	// IPv4 address of the server when the primary IP is IPv6.
+	RelayAddress string
+	// RelayMinPort and RelayMaxPort bound the relayed ports, defaulting
+	// to 49152-65535.
+	RelayMinPort int
+	RelayMaxPort int
+}
+
+func (c *TURNConfig) validate(bindings ...*net.UDPAddr) error {
+	if c.Port <= 0 || c.Port > 0xFFFF {
+		return fmt.Errorf("turn: invalid port %d", c.Port)
+	}
+	for _, addr := range bindings {
+		if c.Port == addr.Port {
+			return fmt.Errorf("turn: port %d is used by the binding service", c.Port)
+		}
+	}
+	if c.Realm == "" {
+		return errors.New("turn: need a realm")
+	}
+	if len(c.Users) == 0 && c.SharedSecret == "" {
+		return errors.New("turn: need users or a shared secret")
+	}
+	if c.RelayAddress != "" && net.ParseIP(c.RelayAddress) == nil {
+		return fmt.Errorf("turn: invalid relay address %s", c.RelayAddress)
+	}
+	if c.RelayMinPort == 0 {
+		c.RelayMinPort = defaultRelayMinPort
+	}
+	if c.RelayMaxPort == 0 {
+		c.RelayMaxPort = defaultRelayMaxPort
+	}
+	if c.RelayMinPort < 1 || c.RelayMaxPort > 0xFFFF || c.RelayMinPort > c.RelayMaxPort {
+		return fmt.Errorf("turn: invalid relay port range %d-%d", c.RelayMinPort, c.RelayMaxPort)
+	}
+	return nil
+}
+
+// startTURN starts a TURN server for c on the primary IP priIP, nil if c
+// is nil or this server has no primary role. It only runs on the native
+// network: pion/turn/v2 does not accept our vnet. Its relays are IPv4
+// only, so an IPv6 primary relays on all IPv4 addresses and needs
+// c.RelayAddress.
+func (s *STUNServer) startTURN(c *TURNConfig, priIP net.IP) (*turnv2.Server, error) {
+	if c == nil || (s.role != "pri" && s.role != "both") {
+		return nil, nil
+	}
+	if s.net.IsVirtual() {
+		return nil, errors.New("turn: not supported on a virtual network")
+	}
+
+	relayIP, relayOn := priIP, priIP.String()
+	if c.RelayAddress != "" {
+		relayIP = net.ParseIP(c.RelayAddress)
+	}
+	if priIP.To4() == nil {
+		relayOn = "0.0.0.0"
+	}
+	if relayIP.To4() == nil {
+		return nil, fmt.Errorf("turn: relays are IPv4 only, set an IPv4 relay address for primary %s", priIP.String())
+	}
+
+	conn, err := net.ListenPacket("udp", net.JoinHostPort(priIP.String(), fmt.Sprint(c.Port)))
+	if err != nil {
+		return nil, err
+	}
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+	loggerFactory.DefaultLogLevel = s.logLevel
+	log := loggerFactory.NewLogger("turn")
+
+	keys := map[string][]byte{}
+	for username, password := range c.Users {
+		keys[username] = turnv2.GenerateAuthKey(username, c.Realm, password)
+	}
+	var secretHandler turnv2.AuthHandler
+	if c.SharedSecret != "" {
+		secretHandler = turnv2.NewLongTermAuthHandler(c.SharedSecret, log)
+	}
+
+	server, err := turnv2.NewServer(turnv2.ServerConfig{
+		Realm:         c.Realm,
+		LoggerFactory: loggerFactory,
+		AuthHandler: func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+			if key, ok := keys[username]; ok {
+				return key, true
+			}
+			if secretHandler != nil {
+				return secretHandler(username, realm, srcAddr)
+			}
+			return nil, false
+		},
+		PacketConnConfigs: []turnv2.PacketConnConfig{
+			{
+				PacketConn: conn,
+				RelayAddressGenerator: &turnv2.RelayAddressGeneratorPortRange{
+					RelayAddress: relayIP,
+					Address:      relayOn,
+					MinPort:      uint16(c.RelayMinPort),
+					MaxPort:      uint16(c.RelayMaxPort),
+				},
+			},
+		},
+	})
+	if err != nil {
+		conn.Close() // nolint:errcheck,gosec
+		return nil, err
+	}
+	s.log.Infof("turn: listening on %s, relaying on %s:%d-%d",
+		conn.LocalAddr().String(), relayIP.String(), c.RelayMinPort, c.RelayMaxPort)
+	return server, nil
+}
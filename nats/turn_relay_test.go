@@ -0,0 +1,235 @@
+package nats
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/stun"
+	"github.com/pion/turn"
+	"github.com/stretchr/testify/assert"
+)
+
+// freePorts returns n UDP ports that were free on 127.0.0.1 a moment ago.
+func freePorts(t *testing.T, n int) []int {
+	var ports []int
+	var conns []net.PacketConn
+	for i := 0; i < n; i++ {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+		ports = append(ports, conn.LocalAddr().(*net.UDPAddr).Port)
+	}
+	for _, conn := range conns {
+		conn.Close() // nolint:errcheck,gosec
+	}
+	return ports
+}
+
+func TestTURNConfigValidate(t *testing.T) {
+	pri := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 3478}
+	sec := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 5), Port: 3479}
+	users := map[string]string{"alice": "secret"}
+
+	c := &TURNConfig{Port: 3480, Realm: "pion.ly", Users: users}
+	assert.NoError(t, c.validate(pri, sec), "should succeed")
+	assert.Equal(t, defaultRelayMinPort, c.RelayMinPort, "should default")
+	assert.Equal(t, defaultRelayMaxPort, c.RelayMaxPort, "should default")
+
+	for _, c := range []*TURNConfig{
+		{Port: 3478, Realm: "pion.ly", Users: users},
+		{Port: 3480, Users: users},
+		{Port: 3480, Realm: "pion.ly"},
+		{Port: 3480, Realm: "pion.ly", Users: users, RelayMinPort: 50000, RelayMaxPort: 40000},
+		{Port: 3480, Realm: "pion.ly", Users: users, RelayAddress: "bogus"},
+	} {
+		assert.Error(t, c.validate(pri, sec), "should fail: %+v", c)
+	}
+}
+
+func TestTURNRelayOnLoopback(t *testing.T) {
+	ports := freePorts(t, 3)
+	server, err := NewSTUNServer(&STUNServerConfig{
+		PrimaryAddress:   fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		SecondaryAddress: fmt.Sprintf("127.0.0.2:%d", ports[1]),
+		Role:             "both",
+		TURN: &TURNConfig{
+			Port:         ports[2],
+			Realm:        "pion.ly",
+			Users:        map[string]string{"alice": "secret"},
+			RelayMinPort: 40000,
+			RelayMaxPort: 40100,
+		},
+	})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	if !assert.NoError(t, server.Start(), "should succeed") {
+		return
+	}
+	defer server.Close() // nolint:errcheck,gosec
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer conn.Close() // nolint:errcheck,gosec
+
+	c, err := turn.NewClient(&turn.ClientConfig{
+		TURNServerAddr: fmt.Sprintf("127.0.0.1:%d", ports[2]),
+		Username:       "alice",
+		Password:       "secret",
+		Realm:          "pion.ly",
+		Conn:           conn,
+		LoggerFactory:  logging.NewDefaultLoggerFactory(),
+	})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer c.Close()
+	if !assert.NoError(t, c.Listen(), "should succeed") {
+		return
+	}
+
+	relayConn, err := c.Allocate()
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer relayConn.Close() // nolint:errcheck,gosec
+
+	relayed := relayConn.LocalAddr().(*net.UDPAddr)
+	assert.Equal(t, "127.0.0.1", relayed.IP.String(), "should relay on the primary IP")
+	assert.True(t, relayed.Port >= 40000 && relayed.Port <= 40100, "should be in range: %d", relayed.Port)
+}
+
+func TestTURNRelayOnIPv6Loopback(t *testing.T) {
+	probe, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Skip("no IPv6 loopback")
+	}
+	probe.Close() // nolint:errcheck,gosec
+
+	ports := freePorts(t, 3)
+	server, err := NewSTUNServer(&STUNServerConfig{
+		PrimaryAddress:   fmt.Sprintf("[::1]:%d", ports[0]),
+		SecondaryAddress: fmt.Sprintf("127.0.0.2:%d", ports[1]),
+		Role:             "both",
+		TURN: &TURNConfig{
+			Port:         ports[2],
+			Realm:        "pion.ly",
+			Users:        map[string]string{"alice": "secret"},
+			RelayAddress: "127.0.0.1",
+			RelayMinPort: 40000,
+			RelayMaxPort: 40100,
+		},
+	})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	if !assert.NoError(t, server.Start(), "should succeed") {
+		return
+	}
+	defer server.Close() // nolint:errcheck,gosec
+
+	// pion's TURN clients only speak IPv4, so allocate by hand
+	conn, err := net.ListenPacket("udp6", "[::1]:0")
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer conn.Close() // nolint:errcheck,gosec
+	to := &net.UDPAddr{IP: net.IPv6loopback, Port: ports[2]}
+	allocate := func(setters ...stun.Setter) *stun.Message {
+		msg, err := stun.Build(append([]stun.Setter{stun.TransactionID,
+			stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+			stun.RawAttribute{Type: stun.AttrRequestedTransport, Value: []byte{17, 0, 0, 0}}},
+			setters...)...)
+		if !assert.NoError(t, err, "should succeed") {
+			return nil
+		}
+		if _, err = conn.WriteTo(msg.Raw, to); !assert.NoError(t, err, "should succeed") {
+			return nil
+		}
+		res, _, err := readResponse(conn, msg.TransactionID, time.Second)
+		assert.NoError(t, err, "should succeed")
+		return res
+	}
+
+	challenge := allocate()
+	if !assert.NotNil(t, challenge, "should challenge") {
+		return
+	}
+	var nonce stun.Nonce
+	if !assert.NoError(t, nonce.GetFrom(challenge), "should send a nonce") {
+		return
+	}
+	res := allocate(stun.NewUsername("alice"), stun.NewRealm("pion.ly"), nonce,
+		stun.NewLongTermIntegrity("alice", "pion.ly", "secret"), stun.Fingerprint)
+	if !assert.NotNil(t, res, "should respond") {
+		return
+	}
+	assert.Equal(t, stun.ClassSuccessResponse, res.Type.Class, "should allocate")
+	var relayed stun.XORMappedAddress
+	if assert.NoError(t, relayed.GetFromAs(res, stun.AttrXORRelayedAddress), "should succeed") {
+		assert.Equal(t, "127.0.0.1", relayed.IP.String(), "should relay on the relay address")
+		assert.True(t, relayed.Port >= 40000 && relayed.Port <= 40100, "should be in range: %d", relayed.Port)
+	}
+}
+
+func TestCheckTURNOnLoopback(t *testing.T) {
+	ports := freePorts(t, 3)
+	server, err := NewSTUNServer(&STUNServerConfig{
+		PrimaryAddress:   fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		SecondaryAddress: fmt.Sprintf("127.0.0.2:%d", ports[1]),
+		Role:             "both",
+		TURN: &TURNConfig{
+			Port:  ports[2],
+			Realm: "pion.ly",
+			Users: map[string]string{"alice": "secret"},
+		},
+	})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	if !assert.NoError(t, server.Start(), "should succeed") {
+		return
+	}
+	defer server.Close() // nolint:errcheck,gosec
+
+	check := func(password string) (*TURNResult, error) {
+		nats, err := NewNATS(&Config{
+			Server:       fmt.Sprintf("127.0.0.1:%d", ports[0]),
+			Verbose:      true,
+			TURNServer:   fmt.Sprintf("127.0.0.1:%d", ports[2]),
+			TURNUsername: "alice",
+			TURNPassword: password,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return nats.CheckTURN()
+	}
+
+	t.Run("relay works", func(t *testing.T) {
+		res, err := check("secret")
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		assert.True(t, res.Allocated, "should allocate")
+		assert.Empty(t, res.Error, "should not fail")
+		assert.NotEmpty(t, res.RelayedAddress, "should report the relayed address")
+		assert.True(t, res.RoundTrip > 0, "should measure the round trip")
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		res, err := check("wrong")
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		assert.False(t, res.Allocated, "should not allocate")
+		assert.NotEmpty(t, res.Error, "should explain")
+	})
+}
@@ -0,0 +1,112 @@
+package nats
+
+import (
+	"errors"
+	"net"
+)
+
+// errReusePortUnsupported is returned by listenReusePort where the OS has
+// no SO_REUSEPORT.
+var errReusePortUnsupported = errors.New("SO_REUSEPORT is not supported")
+
+// listen opens the sockets of endpoint e. With several workers on the real
+// network, each worker gets its own SO_REUSEPORT socket so the kernel
+// spreads the datagrams over them. Otherwise, and where SO_REUSEPORT is
+// unavailable, there is one socket shared by the workers.
+func (s *STUNServer) listen(e *endpoint) ([]net.PacketConn, error) {
+	s.log.Debugf("start listening on %s (%s)...", e.addr.String(), e.Name)
+	if s.workers > 1 && !s.net.IsVirtual() {
+		// Another process of the same user could join the SO_REUSEPORT
+		// group and silently take part of the traffic. A socket without
+		// SO_REUSEPORT cannot bind while anyone holds the address, so it
+		// detects that process, or keeps it from starting after us.
+		probe, err := net.ListenUDP("udp", e.addr)
+		if err != nil {
+			return nil, err
+		}
+		probe.Close() // nolint:errcheck,gosec
+
+		var conns []net.PacketConn
+		for i := 0; i < s.workers; i++ {
+			conn, err := listenReusePort(e.addr)
+			if err != nil {
+				closeAll(conns)
+				if err != errReusePortUnsupported {
+					return nil, err
+				}
+				s.log.Debugf("%s, %d workers share %s", err.Error(), s.workers, e.addr.String())
+				conns = nil
+				break
+			}
+			conns = append(conns, conn)
+		}
+		if conns != nil {
+			return conns, nil
+		}
+	}
+
+	conn, err := s.net.ListenUDP("udp", e.addr)
+	if err != nil {
+		return nil, err
+	}
+	return []net.PacketConn{conn}, nil
+}
+
+// worker reads one socket of an endpoint. It keeps the endpoint, looked
+// up again only once the endpoints of generation were replaced.
+type worker struct {
+	conn       net.PacketConn
+	e          *endpoint
+	generation uint64
+}
+
+// endpoint returns the current endpoint of w's socket, nil once a reload
+// removed it.
+func (w *worker) endpoint(st *snapshot) *endpoint {
+	if w.generation == st.generation {
+		return w.e
+	}
+	w.e, w.generation = nil, st.generation
+	for _, e := range st.endpoints {
+		for _, c := range e.conns {
+			if c == w.conn {
+				w.e = e
+			}
+		}
+	}
+	return w.e
+}
+
+// serve starts the workers reading the sockets of e, one per socket, or
+// all of them on a single shared socket. generation is that of the
+// endpoints e belongs to.
+func (s *STUNServer) serve(e *endpoint, generation uint64) {
+	if len(e.conns) > 1 {
+		for _, conn := range e.conns {
+			s.serveConn(&worker{conn: conn, e: e, generation: generation})
+		}
+		return
+	}
+	workers := s.workers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		s.serveConn(&worker{conn: e.conn, e: e, generation: generation})
+	}
+}
+
+// serveConn starts w, reading batches if configured.
+func (s *STUNServer) serveConn(w *worker) {
+	if s.batched(w.conn) {
+		go s.readBatchLoop(w)
+		return
+	}
+	go s.readLoop(w)
+}
+
+func closeAll(conns []net.PacketConn) {
+	for _, conn := range conns {
+		conn.Close() // nolint:errcheck,gosec
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package nats
+
+import "net"
+
+func listenReusePort(addr *net.UDPAddr) (net.PacketConn, error) {
+	return nil, errReusePortUnsupported
+}
@@ -0,0 +1,161 @@
+package nats
+
+import (
+	"net"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+// freeLoopbackAddr returns a loopback address of the real network with a
+// free UDP port.
+func freeLoopbackAddr(tb testing.TB) string {
+	probe, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer probe.Close() // nolint:errcheck,gosec
+	return probe.LocalAddr().String()
+}
+
+// startLoopbackServer runs a server configured by config, or a default
+// one, on a free loopback port of the real network and returns its
+// address.
+func startLoopbackServer(tb testing.TB, config *STUNServerConfig) (*STUNServer, string) {
+	if config == nil {
+		config = &STUNServerConfig{}
+	}
+	if len(config.Topology) == 0 {
+		config.Topology = []Endpoint{{Address: freeLoopbackAddr(tb)}}
+	}
+	config.Role = "both"
+	addr := config.Topology[0].Address
+	s, err := NewSTUNServer(config)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err = s.Start(); err != nil {
+		tb.Fatal(err)
+	}
+	return s, addr
+}
+
+func TestWorkersOnLoopback(t *testing.T) {
+	s, addr := startLoopbackServer(t, &STUNServerConfig{Workers: 4})
+	defer s.Close() // nolint:errcheck,gosec
+
+	if runtime.GOOS == "linux" {
+		assert.Len(t, s.endpoints[0].conns, 4, "should open a socket per worker")
+	} else {
+		assert.Len(t, s.endpoints[0].conns, 1, "should share the socket")
+	}
+
+	// SO_REUSEPORT spreads clients by source port, use many
+	for i := 0; i < 16; i++ {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if !assert.NoError(t, err, "should succeed") {
+			return
+		}
+		res, from := exchange(t, conn, addr)
+		conn.Close() // nolint:errcheck,gosec
+		if assert.NotNil(t, res, "should respond") {
+			assert.Equal(t, addr, from.String(), "should answer from the endpoint")
+		}
+	}
+}
+
+func TestWorkersSecondInstance(t *testing.T) {
+	s, addr := startLoopbackServer(t, &STUNServerConfig{Workers: 2})
+	defer s.Close() // nolint:errcheck,gosec
+
+	second, err := NewSTUNServer(&STUNServerConfig{Topology: []Endpoint{{Address: addr}}, Role: "both", Workers: 2})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	if !assert.Error(t, second.Start(), "should not share the address with another instance") {
+		second.Close() // nolint:errcheck,gosec
+	}
+}
+
+func TestWorkersOnVNet(t *testing.T) {
+	v, err := buildVNetWithServer(&vnet.NATType{
+		MappingBehavior:   vnet.EndpointIndependent,
+		FilteringBehavior: vnet.EndpointIndependent,
+	}, &STUNServerConfig{Workers: 4})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer v.close()
+	assert.Len(t, v.server.endpoints[0].conns, 1, "should share the socket")
+
+	conn, err := v.net0.ListenPacket("udp4", "0.0.0.0:0")
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer conn.Close() // nolint:errcheck,gosec
+	res, _ := exchange(t, conn, "1.2.3.4:3478", &attrChangeRequest{ChangeIP: true})
+	assert.NotNil(t, res, "should respond")
+
+	_, err = NewSTUNServer(&STUNServerConfig{PrimaryAddress: "1.2.3.4:3478", SecondaryAddress: "1.2.3.5:3479", Workers: -1})
+	assert.Error(t, err, "should reject a negative count")
+}
+
+func TestWorkerEndpoint(t *testing.T) {
+	s, w := newDiscardServer(t)
+	primary := s.endpoints[0]
+	st := s.snapshot()
+	assert.Equal(t, primary, w.endpoint(&st), "should keep its endpoint")
+
+	// a reload keeping the socket under a new endpoint
+	moved := &endpoint{Endpoint: primary.Endpoint, conn: primary.conn, conns: primary.conns}
+	st.endpoints, st.generation = []*endpoint{moved}, st.generation+1
+	assert.Equal(t, moved, w.endpoint(&st), "should follow the reload")
+	assert.Equal(t, moved, w.endpoint(&st), "should keep the new endpoint")
+
+	st.endpoints, st.generation = s.endpoints[1:], st.generation+1
+	assert.Nil(t, w.endpoint(&st), "should be removed with the socket")
+}
+
+// BenchmarkServerWorkers measures binding requests per second on loopback,
+// with one client socket per parallel goroutine.
+func BenchmarkServerWorkers(b *testing.B) {
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(strconv.Itoa(workers), func(b *testing.B) {
+			s, addr := startLoopbackServer(b, &STUNServerConfig{Workers: workers})
+			defer s.Close() // nolint:errcheck,gosec
+			to, err := net.ResolveUDPAddr("udp4", addr)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.SetParallelism(4)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				defer conn.Close() // nolint:errcheck,gosec
+				for pb.Next() {
+					msg := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+					if _, err = conn.WriteTo(msg.Raw, to); err != nil {
+						b.Error(err)
+						return
+					}
+					// loopback should not lose any, a lost datagram
+					// fails the benchmark after the timeout
+					if _, _, err = readResponse(conn, msg.TransactionID, time.Second); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,245 @@
+// Package natstest builds virtual NAT labs on top of pion/transport/vnet: a
+// WAN with a running nats.STUNServer and any number of LANs behind
+// configurable (and possibly nested) NATs, with optional loss and delay.
+// Each LAN host comes with a nats.Config ready to run discovery against the
+// lab's server.
+package natstest
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/jiangz222/go-nat-discovery/nats"
+	"github.com/pion/logging"
+	"github.com/pion/transport/vnet"
+)
+
+const (
+	// ServerHost resolves to the primary address of the lab's server.
+	ServerHost       = "stun.natstest.net"
+	PrimaryAddress   = "1.2.3.4:3478"
+	SecondaryAddress = "1.2.3.5:3479"
+)
+
+// LANConfig describes one LAN of the lab.
+type LANConfig struct {
+	// NATs are the NAT routers between the hosts and the WAN, outermost
+	// first; more than one builds nested NATs. Without NATs the hosts get
+	// public addresses on the WAN.
+	NATs []*vnet.NATType
+	// Hosts is the number of hosts on the LAN, 1 if zero.
+	Hosts int
+	// MinDelay and MaxJitter delay every packet going through the
+	// outermost NAT, so they need at least one NAT.
+	MinDelay  time.Duration
+	MaxJitter time.Duration
+	// LossRate is the probability (0 to 1) that a packet to or from the
+	// LAN is dropped on the WAN.
+	LossRate float64
+}
+
+// Config has config parameters for NewLab.
+type Config struct {
+	LANs []LANConfig
+	// Server holds extra settings for the lab's STUNServer; addresses,
+	// role and network are filled in. Nil runs a plain server.
+	Server *nats.STUNServerConfig
+	// MinDelay and MaxJitter delay every packet crossing the WAN.
+	MinDelay      time.Duration
+	MaxJitter     time.Duration
+	LoggerFactory logging.LoggerFactory
+}
+
+// LAN is one LAN of a Lab.
+type LAN struct {
+	// Nets are the hosts of the LAN.
+	Nets []*vnet.Net
+	// ExternalIPs are the addresses the LAN is seen from on the WAN: the
+	// outermost NAT's address, or one public address per host.
+	ExternalIPs []string
+}
+
+// Lab is a running virtual network. Close it when done.
+type Lab struct {
+	Server *nats.STUNServer
+	LANs   []*LAN
+	wan    *vnet.Router
+}
+
+// NewLab builds and starts the network described by config. LAN i is seen
+// on the WAN as 27.1.(i+1).1 behind NATs, or 27.1.(i+1).(h+1) for public
+// host h; its hosts live in 192.168.i.0/24 and nested NATs in
+// 10.i.k.0/24.
+func NewLab(config *Config) (_ *Lab, err error) {
+	loggerFactory := config.LoggerFactory
+	if loggerFactory == nil {
+		loggerFactory = logging.NewDefaultLoggerFactory()
+	}
+
+	wan, err := vnet.NewRouter(&vnet.RouterConfig{
+		CIDR:          "0.0.0.0/0",
+		MinDelay:      config.MinDelay,
+		MaxJitter:     config.MaxJitter,
+		LoggerFactory: loggerFactory,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		// Start may fail on a child after starting the WAN itself;
+		// stopping a router that never started only returns an error
+		if err != nil {
+			wan.Stop() // nolint:errcheck,gosec
+		}
+	}()
+
+	priIP, _, err := net.SplitHostPort(PrimaryAddress)
+	if err != nil {
+		return nil, err
+	}
+	secIP, _, err := net.SplitHostPort(SecondaryAddress)
+	if err != nil {
+		return nil, err
+	}
+	wanNet := vnet.NewNet(&vnet.NetConfig{
+		StaticIPs: []string{priIP, secIP},
+	})
+	if err = wan.AddNet(wanNet); err != nil {
+		return nil, err
+	}
+	if err = wan.AddHost(ServerHost, priIP); err != nil {
+		return nil, err
+	}
+
+	lab := &Lab{wan: wan}
+	for i := range config.LANs {
+		lan, err := addLAN(wan, i, &config.LANs[i], loggerFactory)
+		if err != nil {
+			return nil, fmt.Errorf("LAN %d: %s", i, err.Error())
+		}
+		lab.LANs = append(lab.LANs, lan)
+	}
+
+	if err = wan.Start(); err != nil {
+		return nil, err
+	}
+
+	serverConfig := nats.STUNServerConfig{}
+	if config.Server != nil {
+		serverConfig = *config.Server
+	}
+	serverConfig.PrimaryAddress = PrimaryAddress
+	serverConfig.SecondaryAddress = SecondaryAddress
+	serverConfig.Net = wanNet
+	serverConfig.Role = "both"
+	lab.Server, err = nats.NewSTUNServer(&serverConfig)
+	if err == nil {
+		err = lab.Server.Start()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return lab, nil
+}
+
+func addLAN(wan *vnet.Router, i int, config *LANConfig, loggerFactory logging.LoggerFactory) (*LAN, error) {
+	if config.LossRate < 0 || config.LossRate > 1 {
+		return nil, fmt.Errorf("loss rate %v out of [0, 1]", config.LossRate)
+	}
+	if len(config.NATs) == 0 && (config.MinDelay > 0 || config.MaxJitter > 0) {
+		return nil, fmt.Errorf("delay needs at least one NAT")
+	}
+	hosts := config.Hosts
+	if hosts == 0 {
+		hosts = 1
+	}
+
+	lan := &LAN{}
+
+	if len(config.NATs) == 0 {
+		for h := 0; h < hosts; h++ {
+			ip := fmt.Sprintf("27.1.%d.%d", i+1, h+1)
+			hostNet := vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{ip}})
+			if err := wan.AddNet(hostNet); err != nil {
+				return nil, err
+			}
+			lan.Nets = append(lan.Nets, hostNet)
+			lan.ExternalIPs = append(lan.ExternalIPs, ip)
+		}
+	} else {
+		parent := wan
+		for k, natType := range config.NATs {
+			routerConfig := &vnet.RouterConfig{
+				CIDR:          fmt.Sprintf("10.%d.%d.0/24", i, k),
+				NATType:       natType,
+				LoggerFactory: loggerFactory,
+			}
+			if k == 0 {
+				routerConfig.StaticIP = fmt.Sprintf("27.1.%d.1", i+1)
+				routerConfig.MinDelay = config.MinDelay
+				routerConfig.MaxJitter = config.MaxJitter
+			}
+			if k == len(config.NATs)-1 {
+				routerConfig.CIDR = fmt.Sprintf("192.168.%d.0/24", i)
+			}
+			router, err := vnet.NewRouter(routerConfig)
+			if err != nil {
+				return nil, err
+			}
+			if err = parent.AddRouter(router); err != nil {
+				return nil, err
+			}
+			parent = router
+		}
+		for h := 0; h < hosts; h++ {
+			hostNet := vnet.NewNet(&vnet.NetConfig{})
+			if err := parent.AddNet(hostNet); err != nil {
+				return nil, err
+			}
+			lan.Nets = append(lan.Nets, hostNet)
+		}
+		lan.ExternalIPs = []string{fmt.Sprintf("27.1.%d.1", i+1)}
+	}
+
+	if config.LossRate > 0 {
+		external := map[string]bool{}
+		for _, ip := range lan.ExternalIPs {
+			external[ip] = true
+		}
+		loss := config.LossRate
+		wan.AddChunkFilter(func(c vnet.Chunk) bool {
+			if external[hostOf(c.SourceAddr())] || external[hostOf(c.DestinationAddr())] {
+				return rand.Float64() >= loss // nolint:gosec
+			}
+			return true
+		})
+	}
+
+	return lan, nil
+}
+
+func hostOf(addr net.Addr) string {
+	host, _, _ := net.SplitHostPort(addr.String()) // nolint:errcheck
+	return host
+}
+
+// Config returns a nats.Config for discovery from the given host of the LAN
+// against the lab's server.
+func (lan *LAN) Config(host int) *nats.Config {
+	return &nats.Config{
+		Server: ServerHost + ":3478",
+		Net:    lan.Nets[host],
+	}
+}
+
+// Close stops the server and the network.
+func (l *Lab) Close() error {
+	err := l.Server.Close()
+	if err2 := l.wan.Stop(); err == nil {
+		err = err2
+	}
+	return err
+}
@@ -0,0 +1,148 @@
+package natstest
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jiangz222/go-nat-discovery/nats"
+	"github.com/pion/stun"
+	"github.com/pion/transport/vnet"
+	"github.com/stretchr/testify/assert"
+)
+
+// roundTrip sends a binding request from the host and returns how long the
+// response took, or 0 if none came back within timeout.
+func roundTrip(t *testing.T, host *vnet.Net, timeout time.Duration) time.Duration {
+	conn, err := host.ListenPacket("udp4", "0.0.0.0:0")
+	if !assert.NoError(t, err, "should succeed") {
+		return 0
+	}
+	defer conn.Close() // nolint:errcheck,gosec
+
+	msg, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+	if !assert.NoError(t, err, "should succeed") {
+		return 0
+	}
+	to, err := net.ResolveUDPAddr("udp4", PrimaryAddress)
+	if !assert.NoError(t, err, "should succeed") {
+		return 0
+	}
+	start := time.Now()
+	if _, err = conn.WriteTo(msg.Raw, to); !assert.NoError(t, err, "should succeed") {
+		return 0
+	}
+	if !assert.NoError(t, conn.SetReadDeadline(start.Add(timeout)), "should succeed") {
+		return 0
+	}
+	buf := make([]byte, 1500)
+	if _, _, err = conn.ReadFrom(buf); err != nil {
+		return 0
+	}
+	return time.Since(start)
+}
+
+func TestLabDiscover(t *testing.T) {
+	fullCone := &vnet.NATType{
+		MappingBehavior:   vnet.EndpointIndependent,
+		FilteringBehavior: vnet.EndpointIndependent,
+	}
+	portRestricted := &vnet.NATType{
+		MappingBehavior:   vnet.EndpointIndependent,
+		FilteringBehavior: vnet.EndpointAddrPortDependent,
+	}
+	symmetric := &vnet.NATType{
+		MappingBehavior:   vnet.EndpointAddrPortDependent,
+		FilteringBehavior: vnet.EndpointAddrPortDependent,
+	}
+
+	lab, err := NewLab(&Config{
+		LANs: []LANConfig{
+			{},
+			{NATs: []*vnet.NATType{fullCone}, Hosts: 2},
+			{NATs: []*vnet.NATType{symmetric}},
+			{NATs: []*vnet.NATType{fullCone, portRestricted}},
+		},
+	})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer lab.Close() // nolint:errcheck,gosec
+
+	tests := []struct {
+		name      string
+		lan, host int
+		natted    bool
+		mapping   nats.EndpointDependencyType
+		filtering nats.EndpointDependencyType
+		natType   nats.NATType
+	}{
+		{"public host", 0, 0, false, nats.EndpointIndependent, nats.EndpointIndependent, nats.OpenInternet},
+		{"full cone", 1, 0, true, nats.EndpointIndependent, nats.EndpointIndependent, nats.FullCone},
+		{"second host behind full cone", 1, 1, true, nats.EndpointIndependent, nats.EndpointIndependent, nats.FullCone},
+		{"symmetric", 2, 0, true, nats.EndpointAddrPortDependent, nats.EndpointAddrPortDependent, nats.SymmetricNAT},
+		{"port restricted behind full cone", 3, 0, true, nats.EndpointIndependent, nats.EndpointAddrPortDependent, nats.RestricPortNAT},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			lan := lab.LANs[test.lan]
+			n, err := nats.NewNATS(lan.Config(test.host))
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+			res, err := n.Discover()
+			if !assert.NoError(t, err, "should succeed") {
+				return
+			}
+			assert.Equal(t, test.natted, res.IsNatted, "should match")
+			if test.natted {
+				assert.Equal(t, test.mapping, res.MappingBehavior, "should match")
+			}
+			assert.Equal(t, test.filtering, res.FilteringBehavior, "should match")
+			assert.Equal(t, test.natType, res.NATType, "should match")
+			assert.Equal(t, lan.ExternalIPs[0], res.ExternalIP, "should match")
+		})
+	}
+}
+
+func TestLabImpairments(t *testing.T) {
+	fullCone := &vnet.NATType{
+		MappingBehavior:   vnet.EndpointIndependent,
+		FilteringBehavior: vnet.EndpointIndependent,
+	}
+
+	lab, err := NewLab(&Config{
+		LANs: []LANConfig{
+			{NATs: []*vnet.NATType{fullCone}},
+			{NATs: []*vnet.NATType{fullCone}, MinDelay: 100 * time.Millisecond},
+			{NATs: []*vnet.NATType{fullCone}, LossRate: 1},
+		},
+	})
+	if !assert.NoError(t, err, "should succeed") {
+		return
+	}
+	defer lab.Close() // nolint:errcheck,gosec
+
+	t.Run("no impairment", func(t *testing.T) {
+		rtt := roundTrip(t, lab.LANs[0].Nets[0], time.Second)
+		assert.True(t, rtt > 0 && rtt < 100*time.Millisecond, "should be fast, got %v", rtt)
+	})
+
+	t.Run("delay", func(t *testing.T) {
+		rtt := roundTrip(t, lab.LANs[1].Nets[0], time.Second)
+		assert.True(t, rtt >= 200*time.Millisecond, "should be delayed both ways, got %v", rtt)
+	})
+
+	t.Run("loss", func(t *testing.T) {
+		assert.Equal(t, time.Duration(0), roundTrip(t, lab.LANs[2].Nets[0], 300*time.Millisecond), "should be lost")
+	})
+}
+
+func TestNewLabErrors(t *testing.T) {
+	_, err := NewLab(&Config{LANs: []LANConfig{{LossRate: 2}}})
+	assert.Error(t, err, "should fail")
+
+	_, err = NewLab(&Config{LANs: []LANConfig{{MinDelay: time.Second}}})
+	assert.Error(t, err, "should fail")
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jiangz222/go-nat-discovery/nats"
+)
+
+func check(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+func main() {
+	server := flag.String("H", "127.0.0.1", "STUN server address.")
+	port := flag.String("P", "3478", "STUN server port.")
+	rate := flag.Int("rate", 1000, "requests per second")
+	duration := flag.Duration("d", 10*time.Second, "how long to send requests")
+	sockets := flag.Int("sockets", 64, "number of source ports")
+	timeout := flag.Duration("timeout", time.Second, "how long to wait for responses after the last request")
+	plain := flag.Int("plain", 1, "weight of plain binding requests")
+	changePort := flag.Int("change-port", 1, "weight of CHANGE-REQUEST (port) requests")
+	changeIP := flag.Int("change-ip", 1, "weight of CHANGE-REQUEST (IP) requests")
+	changeBoth := flag.Int("change-both", 1, "weight of CHANGE-REQUEST (IP and port) requests")
+	jsonOut := flag.Bool("json", false, "print the report as JSON")
+
+	flag.Parse()
+
+	rep, err := nats.RunLoad(&nats.LoadConfig{
+		Server:   *server + ":" + *port,
+		Rate:     *rate,
+		Duration: *duration,
+		Sockets:  *sockets,
+		Timeout:  *timeout,
+		Mix: nats.LoadMix{
+			Plain:      *plain,
+			ChangePort: *changePort,
+			ChangeIP:   *changeIP,
+			ChangeBoth: *changeBoth,
+		},
+	})
+	check(err)
+
+	if *jsonOut {
+		bytes, err := json.MarshalIndent(rep, "", "  ")
+		check(err)
+		fmt.Println(string(bytes))
+		return
+	}
+
+	fmt.Printf("Sent: %d\nReceived: %d\nErrors: %d\nLoss: %.2f%%\n", rep.Sent, rep.Received, rep.Errors, rep.Loss*100)
+	fmt.Printf("Throughput: %.0f/s\n", rep.Throughput)
+	fmt.Printf("Latency: p50=%s p90=%s p99=%s max=%s\n", rep.LatencyP50, rep.LatencyP90, rep.LatencyP99, rep.LatencyMax)
+	fmt.Printf("Relay Path Failures: %d\n", rep.RelayFailures)
+	for _, v := range rep.Variants {
+		if v.Sent == 0 {
+			continue
+		}
+		fmt.Printf("  %-20s sent=%d received=%d misrouted=%d errors=%d\n", v.Name+":", v.Sent, v.Received, v.Misrouted, v.Errors)
+	}
+}